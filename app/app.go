@@ -2,38 +2,286 @@ package app
 
 import (
 	"context"
+	"html/template"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/mungujn/web-exp/config/validate"
+	"github.com/mungujn/web-exp/share"
 )
 
 // Config houses all the configurations for the distributed system
 type Config struct {
-	Username            string `mapstructure:"USERNAME"  default:"me"`
-	LocalRootFolder     string `mapstructure:"LOCAL_ROOT_FOLDER"  default:"test_folder"`
-	LocalWebServerPort  int    `mapstructure:"LOCAL_WEB_SERVER_PORT"  default:"8080"`
-	LocalNodeHost       string `mapstructure:"LOCAL_NODE_HOST"  default:"0.0.0.0"`
-	LocalNodePort       int    `mapstructure:"LOCAL_NODE_PORT"  default:"4040"`
-	NetworkName         string `mapstructure:"NETWORK_NAME"  default:"local"`
-	ProtocolId          string `mapstructure:"PROTOCOL_ID"  default:"localfiles"`
-	ProtocolVersion     string `mapstructure:"PROTOCOL_VERSION"  default:"0.1"`
-	RunGlobal           bool   `mapstructure:"RUN_GLOBAL"  default:"false"`
-	CustomBootstrapPeer string `mapstructure:"CUSTOM_BOOTSTRAP_PEER"  default:"/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ"`
-	Debug               bool   `mapstructure:"DEBUG"  default:"false"`
+	Username               string `mapstructure:"USERNAME"  default:"me"`
+	LocalRootFolder        string `mapstructure:"LOCAL_ROOT_FOLDER"  default:"test_folder"`
+	Shares                 string `mapstructure:"SHARES"  default:""`
+	InboxFolder            string `mapstructure:"INBOX_FOLDER"  default:""`
+	InboxMaxSize           int64  `mapstructure:"INBOX_MAX_SIZE"  default:"104857600"`
+	InboxAllowed           string `mapstructure:"INBOX_ALLOWED_UPLOADERS"  default:""`
+	CacheSize              int64  `mapstructure:"CACHE_SIZE"  default:"67108864"`
+	MaxFrameSize           int64  `mapstructure:"MAX_FRAME_SIZE"  default:"268435456"`
+	UploadRateLimit        int64  `mapstructure:"UPLOAD_RATE_LIMIT"  default:"0"`
+	PeerUploadRateLimit    int64  `mapstructure:"PEER_UPLOAD_RATE_LIMIT"  default:"0"`
+	PeerRequestsPerMinute  int    `mapstructure:"PEER_REQUESTS_PER_MINUTE"  default:"600"`
+	MaxConcurrentTransfers int    `mapstructure:"MAX_CONCURRENT_TRANSFERS"  default:"16"`
+	ReadyMinPeers          int    `mapstructure:"READY_MIN_PEERS"  default:"0"`
+	MirrorFolder           string `mapstructure:"MIRROR_FOLDER"  default:""`
+	Pins                   string `mapstructure:"PINS"  default:""`
+	MirrorInterval         int    `mapstructure:"MIRROR_INTERVAL"  default:"300"`
+	DownloadFolder         string `mapstructure:"DOWNLOAD_FOLDER"  default:""`
+	SearchFileContents     bool   `mapstructure:"SEARCH_FILE_CONTENTS"  default:"true"`
+	ThemeFolder            string `mapstructure:"THEME_FOLDER"  default:""`
+	IsolateOrigins         bool   `mapstructure:"ISOLATE_ORIGINS"  default:"false"`
+	LocalWebServerPort     int    `mapstructure:"LOCAL_WEB_SERVER_PORT"  default:"8080"`
+	LocalNodeHost          string `mapstructure:"LOCAL_NODE_HOST"  default:"0.0.0.0"`
+	LocalNodePort          int    `mapstructure:"LOCAL_NODE_PORT"  default:"4040"`
+	NetworkName            string `mapstructure:"NETWORK_NAME"  default:"local"`
+	ProtocolId             string `mapstructure:"PROTOCOL_ID"  default:"localfiles"`
+	ProtocolVersion        string `mapstructure:"PROTOCOL_VERSION"  default:"0.1"`
+	RunGlobal              bool   `mapstructure:"RUN_GLOBAL"  default:"false"`
+	RunBridge              bool   `mapstructure:"RUN_BRIDGE"  default:"false"`
+	CustomBootstrapPeer    string `mapstructure:"CUSTOM_BOOTSTRAP_PEER"  default:"/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ"`
+	Debug                  bool   `mapstructure:"DEBUG"  default:"false"`
+	KeyFile                string `mapstructure:"KEY_FILE"  default:""`
+	KnownPeers             string `mapstructure:"KNOWN_PEERS"  default:""`
+}
+
+// Validate checks the configuration and reports every problem found
+func (c Config) Validate() error {
+	var errs validate.Errors
+	if err := ValidateUsername(c.Username); err != nil {
+		errs.Add("USERNAME", "%s", err)
+	}
+	errs.NotEmpty("NETWORK_NAME", c.NetworkName)
+	errs.NotEmpty("PROTOCOL_ID", c.ProtocolId)
+	errs.NotEmpty("PROTOCOL_VERSION", c.ProtocolVersion)
+	errs.Port("LOCAL_NODE_PORT", c.LocalNodePort)
+	if net.ParseIP(c.LocalNodeHost) == nil {
+		errs.Add("LOCAL_NODE_HOST", "%q is not an IP address", c.LocalNodeHost)
+	}
+	if (c.RunGlobal || c.RunBridge) && c.CustomBootstrapPeer != "" {
+		if _, err := multiaddr.NewMultiaddr(c.CustomBootstrapPeer); err != nil {
+			errs.Add("CUSTOM_BOOTSTRAP_PEER", "%q is not a valid multiaddr: %s", c.CustomBootstrapPeer, err)
+		}
+	}
+	known, err := ParseKnownPeers(c.KnownPeers)
+	if err != nil {
+		errs.Add("KNOWN_PEERS", "%s", err)
+	}
+	// a bridge only relays the network, it shares no files and runs no web server
+	if c.RunBridge {
+		return errs.Err()
+	}
+	errs.Port("LOCAL_WEB_SERVER_PORT", c.LocalWebServerPort)
+	if c.LocalWebServerPort == c.LocalNodePort {
+		errs.Add("LOCAL_NODE_PORT", "port %d is already used by LOCAL_WEB_SERVER_PORT", c.LocalNodePort)
+	}
+	shares, err := c.AllShares()
+	if err != nil {
+		errs.Add("SHARES", "%s", err)
+	}
+	if c.LocalRootFolder == "" && len(shares) == 0 {
+		errs.Add("LOCAL_ROOT_FOLDER", "must not be empty unless SHARES is set")
+	}
+	names := make(map[string]bool)
+	for _, sh := range shares {
+		setting := "SHARES"
+		if sh.Name == share.DefaultName {
+			setting = "LOCAL_ROOT_FOLDER"
+		} else if names[sh.Name] {
+			errs.Add(setting, "share %s is defined more than once", sh.Name)
+		}
+		names[sh.Name] = true
+		if info, err := os.Stat(sh.Root); err != nil {
+			errs.Add(setting, "folder %s can not be read: %s", sh.Root, err)
+		} else if !info.IsDir() {
+			errs.Add(setting, "%s is not a folder", sh.Root)
+		}
+	}
+	// access lists name users by the usernames they claim, which any node can claim unless pinned to a peer ID
+	if known != nil {
+		for _, sh := range shares {
+			for _, username := range sh.Allowed {
+				if _, pinned := known[username]; !pinned {
+					errs.Add("SHARES", "share %s allows %s, who has to be pinned to a peer ID in KNOWN_PEERS", sh.Name, username)
+				}
+			}
+		}
+		if inbox := c.Inbox(); inbox != nil {
+			for _, username := range inbox.Allowed {
+				if _, pinned := known[username]; !pinned {
+					errs.Add("INBOX_ALLOWED_UPLOADERS", "%s has to be pinned to a peer ID in KNOWN_PEERS", username)
+				}
+			}
+		}
+	}
+	if c.InboxFolder != "" {
+		if info, err := os.Stat(c.InboxFolder); err != nil {
+			errs.Add("INBOX_FOLDER", "folder %s can not be read: %s", c.InboxFolder, err)
+		} else if !info.IsDir() {
+			errs.Add("INBOX_FOLDER", "%s is not a folder", c.InboxFolder)
+		}
+		if c.InboxMaxSize <= 0 {
+			errs.Add("INBOX_MAX_SIZE", "must be greater than 0")
+		}
+	}
+	if c.ThemeFolder != "" {
+		if info, err := os.Stat(c.ThemeFolder); err != nil {
+			errs.Add("THEME_FOLDER", "folder %s can not be read: %s", c.ThemeFolder, err)
+		} else if !info.IsDir() {
+			errs.Add("THEME_FOLDER", "%s is not a folder", c.ThemeFolder)
+		} else if _, err := loadTemplates(c.ThemeFolder); err != nil {
+			errs.Add("THEME_FOLDER", "%s", err)
+		}
+	}
+	if c.CacheSize < 0 {
+		errs.Add("CACHE_SIZE", "must not be negative")
+	}
+	if c.MaxFrameSize <= 0 {
+		errs.Add("MAX_FRAME_SIZE", "must be greater than 0")
+	}
+	if c.UploadRateLimit < 0 {
+		errs.Add("UPLOAD_RATE_LIMIT", "must not be negative")
+	}
+	if c.PeerUploadRateLimit < 0 {
+		errs.Add("PEER_UPLOAD_RATE_LIMIT", "must not be negative")
+	}
+	if c.PeerRequestsPerMinute < 0 {
+		errs.Add("PEER_REQUESTS_PER_MINUTE", "must not be negative")
+	}
+	if c.MaxConcurrentTransfers < 0 {
+		errs.Add("MAX_CONCURRENT_TRANSFERS", "must not be negative")
+	}
+	if c.ReadyMinPeers < 0 {
+		errs.Add("READY_MIN_PEERS", "must not be negative")
+	}
+	if c.MirrorFolder != "" {
+		if info, err := os.Stat(c.MirrorFolder); err != nil {
+			errs.Add("MIRROR_FOLDER", "folder %s can not be read: %s", c.MirrorFolder, err)
+		} else if !info.IsDir() {
+			errs.Add("MIRROR_FOLDER", "%s is not a folder", c.MirrorFolder)
+		}
+	}
+	if pins, err := ParsePins(c.Pins); err != nil {
+		errs.Add("PINS", "%s", err)
+	} else if len(pins) > 0 {
+		if c.MirrorFolder == "" {
+			errs.Add("PINS", "needs MIRROR_FOLDER to keep the pinned files in")
+		}
+		for _, pin := range pins {
+			if pin.Username == c.Username {
+				errs.Add("PINS", "pin %s is of the current user", pin)
+			}
+		}
+		if c.MirrorInterval <= 0 {
+			errs.Add("MIRROR_INTERVAL", "must be greater than 0")
+		}
+	}
+	if c.DownloadFolder != "" {
+		if info, err := os.Stat(c.DownloadFolder); err != nil {
+			errs.Add("DOWNLOAD_FOLDER", "folder %s can not be read: %s", c.DownloadFolder, err)
+		} else if !info.IsDir() {
+			errs.Add("DOWNLOAD_FOLDER", "%s is not a folder", c.DownloadFolder)
+		}
+	}
+	return errs.Err()
+}
+
+// AllShares returns the shares published by the node, LOCAL_ROOT_FOLDER being the default share.
+// A bridge publishes none.
+func (c Config) AllShares() (share.Shares, error) {
+	if c.RunBridge {
+		return nil, nil
+	}
+	shares, err := share.Parse(c.Shares)
+	if err != nil {
+		return nil, err
+	}
+	if c.LocalRootFolder != "" {
+		shares = append(share.Shares{{Name: share.DefaultName, Root: c.LocalRootFolder, ReadOnly: true}}, shares...)
+	}
+	return shares, nil
+}
+
+// Inbox returns the inbox other users can upload to, nil if uploads are disabled or the node is a bridge
+func (c Config) Inbox() *share.Inbox {
+	if c.InboxFolder == "" || c.RunBridge {
+		return nil
+	}
+	inbox := &share.Inbox{Root: c.InboxFolder, MaxSize: c.InboxMaxSize}
+	for _, uploader := range strings.Split(c.InboxAllowed, ",") {
+		if uploader = strings.TrimSpace(uploader); uploader != "" {
+			inbox.Allowed = append(inbox.Allowed, uploader)
+		}
+	}
+	return inbox
 }
 
 // FileProvider specifies the interface that file service providers must meet
 type FileProvider interface {
 	StartHost(ctx context.Context) error
 	GetFile(ctx context.Context, username, filename string) ([]byte, error)
+	// GetRange returns up to length bytes of a file from offset, as stored, fewer at the end of the file
+	GetRange(ctx context.Context, username, path string, offset, length int64) ([]byte, error)
+	// ListFolder lists a folder of a user by name, username is empty for the current user
+	ListFolder(ctx context.Context, username, path string) ([]share.FileInfo, error)
+	// Stat describes a file of a user without its contents, username is empty for the current user
+	Stat(ctx context.Context, username, path string) (share.FileStat, error)
+	// GetArchive writes an archive of a folder in format to w, reporting a folder that can not be read before writing
+	GetArchive(ctx context.Context, username, path, format string, w io.Writer) error
+	// PutFile uploads size bytes of content to the inbox of a remote user, or to a path in one of their writable shares
+	PutFile(ctx context.Context, username, filename string, content io.Reader, size int64) error
 	GetOnlineNodes() []string
+	// GetPeers returns the details of every user the node knows of, online or not
+	GetPeers() []share.Peer
+	// GetShares returns the named shares of a user, username is empty for the current user
+	GetShares(username string) []string
+	// Search returns the files of a user matching a query, username is empty for the current user
+	Search(ctx context.Context, username, query string) ([]share.SearchResult, error)
+	// Manifest lists the files of a user under prefix with their hashes, username is empty for the current user
+	Manifest(ctx context.Context, username, prefix string) ([]share.ManifestEntry, error)
+	// Changes returns notifications of files changing in the shares of any user, the current one included
+	Changes() <-chan share.Change
+	// Readiness checks the subsystems of the provider, such as the p2p host
+	Readiness() []share.Check
 }
 
 // App is the main implementation of the applications logic
 type App struct {
 	cfg          Config
 	fileProvider FileProvider
+	inbox        *share.Inbox
+	subscribers  *subscribers
+	templates    *template.Template
+	// mirror keeps the pinned files of other users, nil if nothing is pinned
+	mirror *mirror
+	// downloads runs the downloads started through the api, nil if DOWNLOAD_FOLDER is not set
+	downloads *downloads
 }
 
 // New returns a new instance of the system
 func New(ctx context.Context, cfg Config, fileProvider FileProvider) (*App, error) {
-	s := &App{cfg: cfg, fileProvider: fileProvider}
+	templates, err := loadTemplates(cfg.ThemeFolder)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := ParsePins(cfg.Pins)
+	if err != nil {
+		return nil, err
+	}
+	s := &App{cfg: cfg, fileProvider: fileProvider, inbox: cfg.Inbox(), subscribers: newSubscribers(), templates: templates}
+	go s.broadcastChanges(ctx)
+	if len(pins) > 0 {
+		s.mirror = newMirror(cfg.MirrorFolder, pins, time.Duration(cfg.MirrorInterval)*time.Second)
+		go s.runMirror(ctx)
+	}
+	if cfg.DownloadFolder != "" {
+		s.downloads = newDownloads(ctx, cfg.DownloadFolder)
+	}
 	return s, nil
 }
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+// subscriberBuffer is how many changes are held for a slow subscriber before they are dropped
+const subscriberBuffer = 16
+
+// subscribers are the listeners for file change notifications
+type subscribers struct {
+	mu       sync.Mutex
+	channels map[chan share.Change]bool
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{channels: make(map[chan share.Change]bool)}
+}
+
+// SubscribeChanges returns notifications of files changing in any users share,
+// until the returned cancel function is called
+func (s *App) SubscribeChanges() (<-chan share.Change, func()) {
+	changes := make(chan share.Change, subscriberBuffer)
+	s.subscribers.mu.Lock()
+	s.subscribers.channels[changes] = true
+	s.subscribers.mu.Unlock()
+	return changes, func() {
+		s.subscribers.mu.Lock()
+		delete(s.subscribers.channels, changes)
+		s.subscribers.mu.Unlock()
+	}
+}
+
+// broadcastChanges passes the changes reported by the file provider on to all subscribers until ctx is done
+func (s *App) broadcastChanges(ctx context.Context) {
+	changes := s.fileProvider.Changes()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-changes:
+			if change.Username == "" {
+				change.Username = s.cfg.Username
+			}
+			s.subscribers.mu.Lock()
+			for subscriber := range s.subscribers.channels {
+				select {
+				case subscriber <- change:
+				default:
+				}
+			}
+			s.subscribers.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/local"
+	"github.com/mungujn/web-exp/share"
+)
+
+// changingFilesystem is a local file system reporting changes pushed by the test
+type changingFilesystem struct {
+	*local.LocalFilesystem
+	changes chan share.Change
+}
+
+func (cfs *changingFilesystem) Changes() <-chan share.Change {
+	return cfs.changes
+}
+
+func Test_SubscribeChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider := &changingFilesystem{local.New("test_data/server_root"), make(chan share.Change)}
+	app, err := New(ctx, Config{Username: "me"}, provider)
+	assert.NoError(t, err)
+
+	changes, unsubscribe := app.SubscribeChanges()
+	defer unsubscribe()
+
+	cases := []struct {
+		Name     string
+		Change   share.Change
+		Expected share.Change
+	}{
+		{
+			Name:     "own change",
+			Change:   share.Change{Path: "index.html"},
+			Expected: share.Change{Username: "me", Path: "index.html"},
+		},
+		{
+			Name:     "peer change",
+			Change:   share.Change{Username: "user_2", Path: "docs/notes.md"},
+			Expected: share.Change{Username: "user_2", Path: "docs/notes.md"},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			provider.changes <- testCase.Change
+			select {
+			case change := <-changes:
+				assert.Equal(t, testCase.Expected, change)
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for change")
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+const (
+	// downloadChunkSize is how much of a file is asked for at once, unless MAX_FRAME_SIZE is smaller
+	downloadChunkSize = 4 << 20
+	// partExt is the extension of a file while it is downloaded
+	partExt = ".part"
+	// partStateExt is the extension of the file recording what a partial download belongs to
+	partStateExt = ".part.json"
+)
+
+// partState records the version of the file a partial download belongs to and how much of it is saved
+type partState struct {
+	Username string `json:"username"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	// Hash is the hex encoded sha256 of the whole file, as described by its owner
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+}
+
+// readPartState returns the state recorded next to a partial download, nil if there is none that can be read
+func readPartState(path string) *partState {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Errorf("error reading the state of a partial download, starting over: %s", err)
+		}
+		return nil
+	}
+	state := &partState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		log.Errorf("error reading the state of a partial download, starting over: %s", err)
+		return nil
+	}
+	return state
+}
+
+// DownloadFile downloads a file of a user to dest in parts, resuming from where an earlier attempt stopped if the file
+// did not change since. The parts are saved to dest.part, next to dest.part.json recording how much of which version of
+// the file was saved, and dest.part only replaces dest once its hash matches the one the owner gave.
+// progress is called with the bytes saved so far and the size of the file.
+func (s *App) DownloadFile(ctx context.Context, username, path, dest string, progress func(done, size int64)) error {
+	path = strings.Trim(slashpath.Clean("/"+path), "/")
+	entry, err := s.describeFile(ctx, username, path)
+	if err != nil {
+		return err
+	}
+	partPath, statePath := dest+partExt, dest+partStateExt
+	state := partState{Username: username, Path: path, Size: entry.Size, Hash: entry.Hash}
+	if recorded := readPartState(statePath); recorded != nil {
+		if recorded.Username == username && recorded.Path == path && recorded.Size == entry.Size && recorded.Hash == entry.Hash {
+			state.Offset = recorded.Offset
+			log.Infof("resuming download of %s of user %s at %d of %d bytes", path, username, state.Offset, state.Size)
+		} else {
+			log.Infof("file %s of user %s changed since it was partly downloaded, starting over", path, username)
+		}
+	}
+
+	part, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	// anything written past the recorded offset may be incomplete
+	if err = part.Truncate(state.Offset); err != nil {
+		return err
+	}
+	if _, err = part.Seek(state.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err = writePartState(statePath, state); err != nil {
+		return err
+	}
+
+	chunkSize := int64(downloadChunkSize)
+	if s.cfg.MaxFrameSize > 0 && s.cfg.MaxFrameSize < chunkSize {
+		chunkSize = s.cfg.MaxFrameSize
+	}
+	for state.Offset < state.Size {
+		progress(state.Offset, state.Size)
+		want := state.Size - state.Offset
+		if want > chunkSize {
+			want = chunkSize
+		}
+		data, err := s.fileProvider.GetRange(ctx, username, path, state.Offset, want)
+		if err != nil {
+			return fmt.Errorf("download of %s stopped at %d of %d bytes, try again to resume it: %w", path, state.Offset, state.Size, err)
+		}
+		if len(data) == 0 || int64(len(data)) > want {
+			discardPart(partPath, statePath)
+			return fmt.Errorf("file %s of user %s changed while it was downloaded, try again to download it anew", path, username)
+		}
+		if _, err = part.Write(data); err == nil {
+			err = part.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		state.Offset += int64(len(data))
+		if err = writePartState(statePath, state); err != nil {
+			return err
+		}
+	}
+	progress(state.Offset, state.Size)
+	if err = part.Close(); err != nil {
+		return err
+	}
+
+	hash, err := hashFile(partPath)
+	if err != nil {
+		return err
+	}
+	if hash != state.Hash {
+		discardPart(partPath, statePath)
+		return fmt.Errorf("downloaded file %s of user %s does not match its hash, it may have changed, try again to download it anew", path, username)
+	}
+	if err = os.Rename(partPath, dest); err != nil {
+		return err
+	}
+	if err = os.Remove(statePath); err != nil {
+		log.Error("error removing the state of a complete download: ", err)
+	}
+	return nil
+}
+
+// describeFile returns the size and hash of a file of a user
+func (s *App) describeFile(ctx context.Context, username, path string) (share.ManifestEntry, error) {
+	entries, err := s.fileProvider.Manifest(ctx, username, path)
+	if err != nil {
+		return share.ManifestEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Path == path {
+			return entry, nil
+		}
+	}
+	return share.ManifestEntry{}, fmt.Errorf("user %s has no file %s to download", username, path)
+}
+
+// writePartState records the state of a partial download
+func writePartState(path string, state partState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// discardPart removes a partial download that can not be resumed
+func discardPart(partPath, statePath string) {
+	for _, path := range []string{partPath, statePath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Error("error removing partial download: ", err)
+		}
+	}
+}
+
+// hashFile returns the hex encoded sha256 of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// downloads runs the downloads started through the api, each saved to a folder per user under root
+type downloads struct {
+	// ctx stops every download once done
+	ctx  context.Context
+	root string
+
+	mu      sync.Mutex
+	byPath  map[string]*share.Download
+	cancels map[string]context.CancelFunc
+}
+
+func newDownloads(ctx context.Context, root string) *downloads {
+	return &downloads{
+		ctx:     ctx,
+		root:    root,
+		byPath:  make(map[string]*share.Download),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// update changes a download with its lock held
+func (d *downloads) update(path string, change func(download *share.Download)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	change(d.byPath[path])
+}
+
+// downloadTarget splits the path of a file of another user into the username and the path of the file,
+// which never leaves the folder of the user once joined to it
+func (s *App) downloadTarget(path string) (string, string, error) {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("%q is not of the form username/path", path)
+	}
+	if err := ValidateUserReference(parts[0]); err != nil {
+		return "", "", fmt.Errorf("username %s", err)
+	}
+	if parts[0] == s.cfg.Username {
+		return "", "", errors.New("files of the current user are not downloaded")
+	}
+	filePath := strings.Trim(slashpath.Clean("/"+parts[1]), "/")
+	if filePath == "" {
+		return "", "", fmt.Errorf("%q is not of the form username/path", path)
+	}
+	return parts[0], filePath, nil
+}
+
+// StartDownload starts downloading a file of another user, given as username/path, to the download folder.
+// A download that was stopped resumes where it stopped, one that is running is returned as is.
+func (s *App) StartDownload(path string) (share.Download, error) {
+	d := s.downloads
+	if d == nil {
+		return share.Download{}, errors.New("downloads are disabled, set DOWNLOAD_FOLDER to enable them")
+	}
+	username, filePath, err := s.downloadTarget(path)
+	if err != nil {
+		return share.Download{}, err
+	}
+	key := username + "/" + filePath
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if download, ok := d.byPath[key]; ok && download.State == share.DownloadRunning {
+		return *download, nil
+	}
+	download := &share.Download{
+		Path:  key,
+		File:  filepath.Join(d.root, username, filepath.FromSlash(filePath)),
+		State: share.DownloadRunning,
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.byPath[key] = download
+	d.cancels[key] = cancel
+	go s.runDownload(ctx, cancel, username, filePath, *download)
+	return *download, nil
+}
+
+// runDownload downloads a file started with StartDownload, recording its progress and how it ended
+func (s *App) runDownload(ctx context.Context, cancel context.CancelFunc, username, filePath string, download share.Download) {
+	defer cancel()
+	d := s.downloads
+	log.Infof("downloading %s to %s", download.Path, download.File)
+	err := os.MkdirAll(filepath.Dir(download.File), 0755)
+	if err == nil {
+		err = s.DownloadFile(ctx, username, filePath, download.File, func(done, size int64) {
+			d.update(download.Path, func(download *share.Download) {
+				download.Done, download.Size = done, size
+			})
+		})
+	}
+	d.update(download.Path, func(download *share.Download) {
+		switch {
+		case err == nil:
+			download.State = share.DownloadComplete
+		case ctx.Err() != nil:
+			download.State = share.DownloadCancelled
+		default:
+			download.State, download.Error = share.DownloadFailed, err.Error()
+		}
+	})
+	if err != nil {
+		log.Errorf("error downloading %s: %s", download.Path, err)
+	} else {
+		log.Infof("downloaded %s to %s", download.Path, download.File)
+	}
+}
+
+// Downloads returns every download started since the node started, by path
+func (s *App) Downloads() []share.Download {
+	list := make([]share.Download, 0)
+	if s.downloads == nil {
+		return list
+	}
+	s.downloads.mu.Lock()
+	defer s.downloads.mu.Unlock()
+	for _, download := range s.downloads.byPath {
+		list = append(list, *download)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// CancelDownload stops a running download, keeping what was downloaded so that starting it again resumes it
+func (s *App) CancelDownload(path string) error {
+	if s.downloads == nil {
+		return errors.New("downloads are disabled, set DOWNLOAD_FOLDER to enable them")
+	}
+	username, filePath, err := s.downloadTarget(path)
+	if err != nil {
+		return err
+	}
+	key := username + "/" + filePath
+	s.downloads.mu.Lock()
+	defer s.downloads.mu.Unlock()
+	download, ok := s.downloads.byPath[key]
+	if !ok || download.State != share.DownloadRunning {
+		return fmt.Errorf("no download of %s is running", key)
+	}
+	s.downloads.cancels[key]()
+	return nil
+}
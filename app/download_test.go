@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/local"
+	"github.com/mungujn/web-exp/share"
+)
+
+// rangeFilesystem is a local file system where alice shares the files set by the test, and the connection to her
+// node drops once a download reaches dropAt
+type rangeFilesystem struct {
+	*local.LocalFilesystem
+	mu     sync.Mutex
+	files  fstest.MapFS
+	dropAt int64
+	// tamper flips the first byte of every range sent
+	tamper  bool
+	offsets []int64
+}
+
+func (rfs *rangeFilesystem) shares() share.Shares {
+	return share.Shares{{Name: share.DefaultName, Files: rfs.files}}
+}
+
+func (rfs *rangeFilesystem) Manifest(ctx context.Context, username, prefix string) ([]share.ManifestEntry, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	return rfs.shares().Manifest("me", prefix)
+}
+
+func (rfs *rangeFilesystem) GetRange(ctx context.Context, username, path string, offset, length int64) ([]byte, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	if rfs.dropAt > 0 && offset >= rfs.dropAt {
+		return nil, errors.New("error reading response from peer alice: stream reset")
+	}
+	rfs.offsets = append(rfs.offsets, offset)
+	data, err := rfs.shares().ReadRange("me", path, offset, length)
+	if err == nil && rfs.tamper && len(data) > 0 {
+		data[0] ^= 0xff
+	}
+	return data, err
+}
+
+// set changes what alice shares and how her node behaves, forgetting the ranges asked for so far
+func (rfs *rangeFilesystem) set(contents string, dropAt int64, tamper bool) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	rfs.files = fstest.MapFS{"videos/talk.mp4": {Data: []byte(contents)}}
+	rfs.dropAt, rfs.tamper, rfs.offsets = dropAt, tamper, nil
+}
+
+func Test_DownloadFile(t *testing.T) {
+	ctx := context.Background()
+	provider := &rangeFilesystem{LocalFilesystem: local.New("test_data/server_root")}
+	// a frame size of 4 bytes has files downloaded 4 bytes at a time
+	app, err := New(ctx, Config{Username: "me", MaxFrameSize: 4}, provider)
+	assert.NoError(t, err)
+	dest := filepath.Join(t.TempDir(), "talk.mp4")
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return !errors.Is(err, fs.ErrNotExist)
+	}
+	download := func() ([]int64, error) {
+		err := app.DownloadFile(ctx, "alice", "videos/talk.mp4", dest, func(done, size int64) {})
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+		return provider.offsets, err
+	}
+
+	t.Run("resumed after a drop", func(t *testing.T) {
+		provider.set("0123456789abcdef", 8, false)
+		offsets, err := download()
+		assert.Error(t, err)
+		assert.Equal(t, []int64{0, 4}, offsets)
+		assert.False(t, exists(dest))
+		partial, _ := ioutil.ReadFile(dest + partExt)
+		assert.Equal(t, "01234567", string(partial))
+
+		provider.set("0123456789abcdef", 0, false)
+		offsets, err = download()
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{8, 12}, offsets)
+		data, _ := ioutil.ReadFile(dest)
+		assert.Equal(t, "0123456789abcdef", string(data))
+		assert.False(t, exists(dest+partExt))
+		assert.False(t, exists(dest+partStateExt))
+	})
+
+	t.Run("changed between attempts", func(t *testing.T) {
+		provider.set("0123456789abcdef", 8, false)
+		_, err := download()
+		assert.Error(t, err)
+
+		provider.set("fedcba9876543210", 0, false)
+		offsets, err := download()
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{0, 4, 8, 12}, offsets)
+		data, _ := ioutil.ReadFile(dest)
+		assert.Equal(t, "fedcba9876543210", string(data))
+	})
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		os.Remove(dest)
+		provider.set("0123456789abcdef", 0, true)
+		_, err := download()
+		assert.EqualError(t, err, "downloaded file videos/talk.mp4 of user alice does not match its hash, it may have changed, try again to download it anew")
+		assert.False(t, exists(dest))
+		assert.False(t, exists(dest+partExt))
+		assert.False(t, exists(dest+partStateExt))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		err := app.DownloadFile(ctx, "alice", "videos", dest, func(done, size int64) {})
+		assert.EqualError(t, err, "user alice has no file videos to download")
+	})
+}
+
+func Test_StartDownload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider := &rangeFilesystem{LocalFilesystem: local.New("test_data/server_root")}
+	provider.set("0123456789abcdef", 0, false)
+	root := t.TempDir()
+	app, err := New(ctx, Config{Username: "me", MaxFrameSize: 4, DownloadFolder: root}, provider)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		Name          string
+		Path          string
+		ExpectedError string
+	}{
+		{Name: "no file", Path: "alice", ExpectedError: `"alice" is not of the form username/path`},
+		{Name: "own file", Path: "me/a.txt", ExpectedError: "files of the current user are not downloaded"},
+		{Name: "bad username", Path: "../a.txt", ExpectedError: "username \"..\" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := app.StartDownload(testCase.Path)
+			assert.EqualError(t, err, testCase.ExpectedError)
+		})
+	}
+
+	download, err := app.StartDownload("alice/../videos/talk.mp4")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice/videos/talk.mp4", download.Path)
+	assert.Equal(t, filepath.Join(root, "alice", "videos", "talk.mp4"), download.File)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for app.Downloads()[0].State == share.DownloadRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	download = app.Downloads()[0]
+	assert.Equal(t, share.DownloadComplete, download.State)
+	assert.Equal(t, int64(16), download.Done)
+	assert.Equal(t, int64(16), download.Size)
+	data, _ := ioutil.ReadFile(download.File)
+	assert.Equal(t, "0123456789abcdef", string(data))
+
+	assert.EqualError(t, app.CancelDownload("alice/videos/talk.mp4"), "no download of alice/videos/talk.mp4 is running")
+
+	_, err = (&App{}).StartDownload("alice/videos/talk.mp4")
+	assert.EqualError(t, err, "downloads are disabled, set DOWNLOAD_FOLDER to enable them")
+}
@@ -2,37 +2,50 @@ package app
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"sort"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mungujn/web-exp/markdown"
+	"github.com/mungujn/web-exp/share"
+	"github.com/mungujn/web-exp/tracing"
 )
 
-// GetFile returns file content
-func (s *App) GetFile(ctx context.Context, path string) ([]byte, string, error) {
-	log.Debug("GetFile: ", path)
-	var username string
-	var filename string
-	parts := strings.Split(path, "/")
-	noParts := len(parts)
+// renderQuery is added to links in rendered markdown so that linked markdown files are rendered too
+const renderQuery = "render=1"
 
-	if noParts == 1 && parts[0] == "" {
-		log.Info("fetching root path /")
-		return s.renderedHomePage(s.GetOnlineNodes())
-	}
+// GetFile returns file content, converting markdown files to html pages when render is set.
+// host is the Host header of the request, which names the user on an isolated origin.
+// The pinned files of an offline user are served from the mirror, returned along with a StaleError.
+func (s *App) GetFile(ctx context.Context, host, path string, render bool) (contents []byte, contentType string, err error) {
+	log.WithField(tracing.RequestIDKey, tracing.RequestID(ctx)).Debug("GetFile: ", host, " ", path)
+	ctx, span := tracing.StartSpan(ctx, "app.GetFile", attribute.String("host", host), attribute.String("path", path))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	username, isolated := s.OriginUsername(host)
+	var filename string
 
-	if noParts == 1 && parts[0] != "" {
-		log.Debug("no username provided, defaulting to current user")
-		username = s.cfg.Username
-		filename = parts[0]
-		filenameParts := strings.Split(filename, ".")
-		if len(filenameParts) == 1 {
-			log.Debug("no file extension provided, defaulting to current user index.html")
+	switch {
+	case isolated:
+		filename = path
+		if filename == "" {
 			filename = "index.html"
 		}
-	} else {
-		username = parts[0]
-		filename = strings.Join(parts[1:], "/")
+	case path == "":
+		log.Info("fetching root path /")
+		return s.renderedHomePage()
+	default:
+		username, filename = s.parsePath(path)
 	}
 
 	str := fmt.Sprintf("reading file %s of user %s", filename, username)
@@ -42,16 +55,172 @@ func (s *App) GetFile(ctx context.Context, path string) ([]byte, string, error)
 		username = ""
 	}
 
+	// staleErr is set when the file is served from the mirror, its owner being offline
+	var staleErr error
 	file, err := s.fileProvider.GetFile(ctx, username, filename)
 	if err != nil {
-		log.Error(err)
-		return []byte(err.Error()), plainTextContent, err
+		mirrored, stale := s.mirroredFile(username, filename, err)
+		if stale == nil {
+			log.Error(err)
+			return []byte(err.Error()), plainTextContent, err
+		}
+		log.Infof("user %s is offline, serving the offline copy of %s", username, filename)
+		file, staleErr = mirrored, stale
 	}
 
 	log.Info("file read")
-	return file, inferContentType(filename), nil
+	if render && markdown.IsMarkdown(filename) && !markdown.IsPage(file) {
+		page, err := markdown.Render(file, markdown.Page{RequestPath: filename, FilePath: filename, LinkQuery: renderQuery})
+		if err != nil {
+			log.Error(err)
+			return []byte(err.Error()), plainTextContent, err
+		}
+		return page, htmlContent, staleErr
+	}
+	return file, inferContentType(filename), staleErr
+}
+
+// StatFile describes the file GetFile returns for the same host and path, markdown left unrendered, without
+// transferring its contents. The pinned files of an offline user are described from the mirror, along with a StaleError.
+func (s *App) StatFile(ctx context.Context, host, path string) (share.FileStat, error) {
+	username, isolated := s.OriginUsername(host)
+	var filename string
+
+	switch {
+	case isolated:
+		filename = path
+		if filename == "" {
+			filename = "index.html"
+		}
+	case path == "":
+		page, contentType, err := s.renderedHomePage()
+		if err != nil {
+			return share.FileStat{}, err
+		}
+		return contentStat(page, contentType, time.Time{}), nil
+	default:
+		username, filename = s.parsePath(path)
+	}
+	if username == s.cfg.Username {
+		username = ""
+	}
+
+	stat, err := s.fileProvider.Stat(ctx, username, filename)
+	if err != nil {
+		mirrored, stale := s.mirroredFile(username, filename, err)
+		if stale == nil {
+			return share.FileStat{}, err
+		}
+		return contentStat(mirrored, inferContentType(filename), stale.SyncedAt), stale
+	}
+	if contentType := inferContentType(filename); contentType != "" && !stat.Mode.IsDir() {
+		stat.ContentType = contentType
+	}
+	return stat, nil
+}
+
+// contentStat describes contents that are at hand, such as a generated page, detecting their content type unless given
+func contentStat(contents []byte, contentType string, modified time.Time) share.FileStat {
+	if contentType == "" {
+		contentType = http.DetectContentType(contents)
+	}
+	hash := sha256.Sum256(contents)
+	return share.FileStat{
+		Size:        int64(len(contents)),
+		Modified:    modified,
+		Mode:        0444,
+		ContentType: contentType,
+		Hash:        hex.EncodeToString(hash[:]),
+	}
+}
+
+// GetArchive writes an archive of a folder to w in format, zip or tar.gz, as its owner sends it.
+// host is the Host header of the request, which names the user on an isolated origin.
+func (s *App) GetArchive(ctx context.Context, host, path, format string, w io.Writer) error {
+	username, isolated := s.OriginUsername(host)
+	folder := strings.Trim(path, "/")
+	if !isolated {
+		parts := strings.SplitN(folder, "/", 2)
+		username, folder = parts[0], ""
+		if len(parts) == 2 {
+			folder = parts[1]
+		}
+	}
+	if username == "" {
+		return errors.New("no user to archive the files of")
+	}
+	log.WithField(tracing.RequestIDKey, tracing.RequestID(ctx)).Infof("archiving folder %s of user %s as %s", folder, username, format)
+	if username == s.cfg.Username {
+		username = ""
+	}
+	return s.fileProvider.GetArchive(ctx, username, folder, format, w)
+}
+
+// ListFolder lists a folder addressed as username/path, the top level listing every user the node knows
+// to be online, the current one included, as folders
+func (s *App) ListFolder(ctx context.Context, path string) ([]share.FileInfo, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		list := []share.FileInfo{{Name: s.cfg.Username, Folder: true}}
+		for _, username := range s.GetOnlineNodes() {
+			if username != s.cfg.Username {
+				list = append(list, share.FileInfo{Name: username, Folder: true})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		return list, nil
+	}
+	parts := strings.SplitN(path, "/", 2)
+	username, folder := parts[0], ""
+	if len(parts) == 2 {
+		folder = parts[1]
+	}
+	if username == s.cfg.Username {
+		username = ""
+	}
+	return s.fileProvider.ListFolder(ctx, username, folder)
+}
+
+// GetRange returns up to length bytes of a file addressed as username/path from offset, as stored, fewer at the end
+// of the file or than the largest message peers accept
+func (s *App) GetRange(ctx context.Context, path string, offset, length int64) ([]byte, error) {
+	username, filename := s.parsePath(strings.Trim(path, "/"))
+	if username == s.cfg.Username {
+		username = ""
+	}
+	if s.cfg.MaxFrameSize > 0 && length > s.cfg.MaxFrameSize {
+		length = s.cfg.MaxFrameSize
+	}
+	return s.fileProvider.GetRange(ctx, username, filename, offset, length)
+}
+
+// parsePath splits a path on the main origin into the user it addresses and the path of the file
+func (s *App) parsePath(path string) (string, string) {
+	parts := strings.Split(path, "/")
+	if len(parts) > 1 {
+		return parts[0], strings.Join(parts[1:], "/")
+	}
+
+	log.Debug("no username provided, defaulting to current user")
+	filename := parts[0]
+	filenameParts := strings.Split(filename, ".")
+	if len(filenameParts) == 1 && !s.isOwnShare(filename) {
+		log.Debug("no file extension provided, defaulting to current user index.html")
+		filename = "index.html"
+	}
+	return s.cfg.Username, filename
 }
 
 func (s *App) GetOnlineNodes() []string {
 	return s.fileProvider.GetOnlineNodes()
 }
+
+// isOwnShare reports whether name is one of the current users named shares
+func (s *App) isOwnShare(name string) bool {
+	for _, share := range s.fileProvider.GetShares("") {
+		if share == name {
+			return true
+		}
+	}
+	return false
+}
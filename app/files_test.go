@@ -2,11 +2,16 @@ package app
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/mungujn/web-exp/local"
+	"github.com/mungujn/web-exp/share"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -91,7 +96,7 @@ func Test_GetFile(t *testing.T) {
 	for _, testCase := range cases {
 		t.Run(testCase.Name, func(t *testing.T) {
 			log.Debug("testing file case: ", testCase.Path)
-			data, contentType, err := app.GetFile(ctx, testCase.Path)
+			data, contentType, err := app.GetFile(ctx, "localhost:8080", testCase.Path, false)
 			// writeFile(testCase.Name, data)
 			assert.Nil(t, err)
 			assert.Equal(t, testCase.ExpectedContentType, contentType)
@@ -121,7 +126,7 @@ func Test_GetFile_error(t *testing.T) {
 	for _, testCase := range cases {
 		t.Run(testCase.Name, func(t *testing.T) {
 			log.Debug("testing file case: ", testCase.Path)
-			data, contentType, err := app.GetFile(ctx, testCase.Path)
+			data, contentType, err := app.GetFile(ctx, "localhost:8080", testCase.Path, false)
 			// writeFile(testCase.Name, data)
 			assert.Error(t, errors.New("open test_data/server_root/file-2.js: no such file or directory"), err)
 			assert.Equal(t, testCase.ExpectedContentType, contentType)
@@ -130,6 +135,132 @@ func Test_GetFile_error(t *testing.T) {
 	}
 }
 
+func Test_GetFile_shares(t *testing.T) {
+	// prep
+	ctx := context.Background()
+	cfg := Config{
+		Username:           "me",
+		LocalRootFolder:    "test_data/server_root",
+		LocalNodeHost:      "0.0.0.0",
+		LocalWebServerPort: 8080,
+	}
+	provider := local.New(cfg.LocalRootFolder, share.Share{Name: "docs", Root: "test_data/server_root/sub-path"})
+	app, err := New(ctx, cfg, provider)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		Name                string
+		Path                string
+		ExpectedContentType string
+		ExpectedBytes       []byte
+	}{
+		{
+			Name:                "home page lists shares",
+			Path:                "",
+			ExpectedContentType: htmlContent,
+			ExpectedBytes:       getFile("test_data/expected/home_shares.html"),
+		},
+		{
+			Name:                "named share of current user",
+			Path:                "me/docs/file.css",
+			ExpectedContentType: cssContent,
+			ExpectedBytes:       getFile("test_data/expected/file.css"),
+		},
+		{
+			Name:                "default share of current user",
+			Path:                "me/file.js",
+			ExpectedContentType: jsContent,
+			ExpectedBytes:       getFile("test_data/expected/file.js"),
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, contentType, err := app.GetFile(ctx, "localhost:8080", testCase.Path, false)
+			// writeFile(testCase.Name, data)
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.ExpectedContentType, contentType)
+			assert.Equal(t, testCase.ExpectedBytes, data)
+		})
+	}
+}
+
+func Test_GetFile_markdown(t *testing.T) {
+	// prep
+	app, ctx := getTestApp(t)
+
+	raw, contentType, err := app.GetFile(ctx, "localhost:8080", "me/notes.md", false)
+	assert.NoError(t, err)
+	assert.Equal(t, inferContent, contentType)
+	assert.Equal(t, getFile("test_data/server_root/notes.md"), raw)
+
+	page, contentType, err := app.GetFile(ctx, "localhost:8080", "me/notes.md", true)
+	assert.NoError(t, err)
+	assert.Equal(t, htmlContent, contentType)
+	assert.Contains(t, string(page), `<title>Notes</title>`)
+	assert.Contains(t, string(page), `<a href="sub-path/style.md?render=1">stylesheet notes</a>`)
+
+	// only markdown files are rendered
+	data, contentType, err := app.GetFile(ctx, "localhost:8080", "me/file.js", true)
+	assert.NoError(t, err)
+	assert.Equal(t, jsContent, contentType)
+	assert.Equal(t, getFile("test_data/expected/file.js"), data)
+}
+
+func Test_PutFile(t *testing.T) {
+	// prep
+	ctx := context.Background()
+	drop := t.TempDir()
+	cfg := Config{
+		Username:           "me",
+		LocalRootFolder:    "test_data/server_root",
+		Shares:             "drop=" + drop + ";rw",
+		LocalNodeHost:      "0.0.0.0",
+		LocalWebServerPort: 8080,
+		InboxFolder:        t.TempDir(),
+		InboxMaxSize:       1024,
+	}
+	app, err := New(ctx, cfg, local.New(cfg.LocalRootFolder))
+	assert.NoError(t, err)
+
+	// upload to own inbox
+	err = app.PutFile(ctx, "me", "notes.txt", strings.NewReader("some notes"), 10)
+	assert.NoError(t, err)
+
+	data, contentType, err := app.GetIncomingFile("me", "notes.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, inferContent, contentType)
+	assert.Equal(t, []byte("some notes"), data)
+
+	home, _, err := app.GetFile(ctx, "localhost:8080", "", false)
+	assert.NoError(t, err)
+	assert.Contains(t, string(home), `<li><a href="/.inbox/me/notes.txt">notes.txt</a> from me, 10 B</li>`)
+
+	// paths in writable shares are written to the share, LOCAL_ROOT_FOLDER is read only
+	err = app.PutFile(ctx, "me", "drop/notes.txt", strings.NewReader("some notes"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("some notes"), getFile(filepath.Join(drop, "notes.txt")))
+	err = app.PutFile(ctx, "me", "sub-path/notes.txt", strings.NewReader("some notes"), 10)
+	assert.EqualError(t, err, "sub-path/notes.txt is in a read only share")
+
+	// uploads to other users go through the file provider
+	err = app.PutFile(ctx, "user_2", "notes.txt", strings.NewReader("some notes"), 10)
+	assert.EqualError(t, err, "uploads to other users are not supported by the local file system")
+}
+
+func Test_Search(t *testing.T) {
+	// prep
+	app, ctx := getTestApp(t)
+
+	results := app.Search(ctx, "file.css")
+	assert.Equal(t, []share.SearchResult{{Username: "me", Path: "sub-path/file.css", Name: "file.css"}}, results)
+
+	page, contentType, err := app.SearchPage(ctx, "<b>file.css")
+	assert.NoError(t, err)
+	assert.Equal(t, htmlContent, contentType)
+	assert.Contains(t, string(page), `<p>0 results for <em>&lt;b&gt;file.css</em></p>`)
+}
+
 func getFile(path string) []byte {
 	contents, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -144,3 +275,64 @@ func getFile(path string) []byte {
 // 		log.Error(err)
 // 	}
 // }
+
+func Test_ListFolder(t *testing.T) {
+	app, ctx := getTestApp(t)
+	names := func(list []share.FileInfo) []string {
+		names := make([]string, 0)
+		for _, info := range list {
+			names = append(names, info.Name)
+		}
+		return names
+	}
+
+	users, err := app.ListFolder(ctx, "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []share.FileInfo{{Name: "me", Folder: true}, {Name: "user_2", Folder: true}, {Name: "user_3", Folder: true}}, users)
+
+	list, err := app.ListFolder(ctx, "me/sub-path/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file.css"}, names(list))
+	assert.False(t, list[0].Folder)
+
+	list, err = app.ListFolder(ctx, "me")
+	assert.NoError(t, err)
+	assert.Contains(t, names(list), "sub-path")
+
+	_, err = app.ListFolder(ctx, "me/file.js")
+	assert.EqualError(t, err, "file.js is not a folder")
+}
+
+func Test_StatFile(t *testing.T) {
+	app, ctx := getTestApp(t)
+
+	cases := []struct {
+		Name                string
+		Path                string
+		ExpectedContentType string
+	}{
+		{Name: "home page", Path: "", ExpectedContentType: htmlContent},
+		{Name: "current user page", Path: "me", ExpectedContentType: htmlContent},
+		{Name: "css content type", Path: "sub-path/file.css", ExpectedContentType: cssContent},
+		{Name: "content type detected", Path: "favicon.ico", ExpectedContentType: "image/x-icon"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, _, err := app.GetFile(ctx, "localhost:8080", testCase.Path, false)
+			assert.NoError(t, err)
+			stat, err := app.StatFile(ctx, "localhost:8080", testCase.Path)
+			assert.NoError(t, err)
+			hash := sha256.Sum256(data)
+			assert.Equal(t, int64(len(data)), stat.Size)
+			assert.Equal(t, hex.EncodeToString(hash[:]), stat.Hash)
+			assert.Equal(t, testCase.ExpectedContentType, stat.ContentType)
+		})
+	}
+
+	stat, err := app.StatFile(ctx, "localhost:8080", "me/sub-path")
+	assert.NoError(t, err)
+	assert.True(t, stat.Mode.IsDir())
+
+	_, err = app.StatFile(ctx, "localhost:8080", "me/missing.txt")
+	assert.Error(t, err)
+}
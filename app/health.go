@@ -0,0 +1,53 @@
+package app
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+// Readiness checks everything the node needs to serve files: the subsystems of the file provider,
+// that every share folder can be read and, if READY_MIN_PEERS is set, that enough peers are online
+func (s *App) Readiness() (bool, []share.Check) {
+	checks := append(s.fileProvider.Readiness(), s.shareChecks()...)
+	if s.cfg.ReadyMinPeers > 0 {
+		online := 0
+		for _, peer := range s.fileProvider.GetPeers() {
+			if peer.Online {
+				online++
+			}
+		}
+		checks = append(checks, share.Check{
+			Name:   "peers",
+			OK:     online >= s.cfg.ReadyMinPeers,
+			Detail: fmt.Sprintf("%d of %d required peers online", online, s.cfg.ReadyMinPeers),
+		})
+	}
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+	return ready, checks
+}
+
+// shareChecks checks that the folder of every share can still be listed
+func (s *App) shareChecks() []share.Check {
+	shares, err := s.cfg.AllShares()
+	if err != nil {
+		return []share.Check{{Name: "shares", Detail: err.Error()}}
+	}
+	checks := make([]share.Check, 0, len(shares))
+	for _, sh := range shares {
+		name := "share"
+		if sh.Name != share.DefaultName {
+			name += " " + sh.Name
+		}
+		check := share.Check{Name: name, OK: true, Detail: sh.Root}
+		if _, err := os.ReadDir(sh.Root); err != nil {
+			check.OK, check.Detail = false, err.Error()
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/local"
+	"github.com/mungujn/web-exp/share"
+)
+
+func Test_Readiness(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	provider := &rosterFilesystem{local.New(root), []share.Peer{
+		{Username: "alice", Online: true},
+		{Username: "bob", Online: false},
+	}}
+
+	cases := []struct {
+		Name           string
+		MinPeers       int
+		RemoveRoot     bool
+		ExpectedReady  bool
+		ExpectedChecks []share.Check
+	}{
+		{
+			Name:          "ready",
+			ExpectedReady: true,
+			ExpectedChecks: []share.Check{
+				{Name: "host", OK: true, Detail: "local file system"},
+				{Name: "share", OK: true, Detail: root},
+			},
+		},
+		{
+			Name:          "enough peers",
+			MinPeers:      1,
+			ExpectedReady: true,
+			ExpectedChecks: []share.Check{
+				{Name: "host", OK: true, Detail: "local file system"},
+				{Name: "share", OK: true, Detail: root},
+				{Name: "peers", OK: true, Detail: "1 of 1 required peers online"},
+			},
+		},
+		{
+			Name:          "too few peers",
+			MinPeers:      2,
+			ExpectedReady: false,
+			ExpectedChecks: []share.Check{
+				{Name: "host", OK: true, Detail: "local file system"},
+				{Name: "share", OK: true, Detail: root},
+				{Name: "peers", OK: false, Detail: "1 of 2 required peers online"},
+			},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			app, err := New(ctx, Config{Username: "me", LocalRootFolder: root, ReadyMinPeers: testCase.MinPeers}, provider)
+			assert.NoError(t, err)
+			ready, checks := app.Readiness()
+			assert.Equal(t, testCase.ExpectedReady, ready)
+			assert.Equal(t, testCase.ExpectedChecks, checks)
+		})
+	}
+
+	t.Run("unreadable share", func(t *testing.T) {
+		missing := filepath.Join(root, "gone")
+		assert.NoError(t, os.Mkdir(missing, 0755))
+		app, err := New(ctx, Config{Username: "me", LocalRootFolder: missing}, provider)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Remove(missing))
+
+		ready, checks := app.Readiness()
+		assert.False(t, ready)
+		assert.Equal(t, "share", checks[1].Name)
+		assert.False(t, checks[1].OK)
+	})
+}
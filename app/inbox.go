@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+// PutFile uploads a file to the inbox of a user, the current user included, or to a path in one of their
+// writable shares when filename holds a folder
+func (s *App) PutFile(ctx context.Context, username, filename string, content io.Reader, size int64) error {
+	log.Infof("uploading %s of %d bytes to user %s", filename, size, username)
+	if username == s.cfg.Username && share.IsSharePath(filename) {
+		shares, err := s.cfg.AllShares()
+		if err != nil {
+			return err
+		}
+		return shares.WriteFile(share.Self, filename, content, size)
+	}
+	if username == s.cfg.Username {
+		_, err := s.inbox.Save(s.cfg.Username, filename, content, size)
+		return err
+	}
+	return s.fileProvider.PutFile(ctx, username, filename, content, size)
+}
+
+// GetIncomingFile returns a file uploaded to the current users inbox
+func (s *App) GetIncomingFile(uploader, filename string) ([]byte, string, error) {
+	file, err := s.inbox.ReadFile(uploader, filename)
+	if err != nil {
+		log.Error(err)
+		return []byte(err.Error()), plainTextContent, err
+	}
+	return file, inferContentType(filename), nil
+}
+
+// incomingFiles lists the files in the current users inbox for display
+func (s *App) incomingFiles() []share.Incoming {
+	incoming, err := s.inbox.List()
+	if err != nil {
+		log.Error("error listing inbox: ", err)
+		return nil
+	}
+	return incoming
+}
+
+// formatSize formats a byte count for display
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,380 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+const (
+	// mirrorCheckInterval is how often pins are checked for a sync that is due
+	mirrorCheckInterval = 10 * time.Second
+	// mirrorSyncTimeout is how long a sync of one pin may take
+	mirrorSyncTimeout = 5 * time.Minute
+	// mirrorListTimeout is how long the owner of a pin is given to list its files, nodes predating pins never do
+	mirrorListTimeout = 30 * time.Second
+	// mirrorStateExt is the extension of the files recording what was synced from each user
+	mirrorStateExt = ".json"
+)
+
+// Pin is a share of another user, or a folder or file within it, kept in the mirror folder for offline access
+type Pin struct {
+	Username string
+	// Path is the request path pinned, share name included, empty to pin every file of the user
+	Path string
+}
+
+// String returns the pin as it is written in PINS
+func (p Pin) String() string {
+	if p.Path == "" {
+		return p.Username
+	}
+	return p.Username + "/" + p.Path
+}
+
+// covers reports whether the pin includes the file at path
+func (p Pin) covers(path string) bool {
+	path = strings.Trim(path, "/")
+	return p.Path == "" || path == p.Path || strings.HasPrefix(path, p.Path+"/")
+}
+
+// ParsePins parses a comma separated list of pins of the form username[/path]
+func ParsePins(spec string) ([]Pin, error) {
+	pins := make([]Pin, 0)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "/", 2)
+		if err := ValidateUserReference(parts[0]); err != nil {
+			return nil, fmt.Errorf("pin %q: username %s", item, err)
+		}
+		pin := Pin{Username: parts[0]}
+		if len(parts) == 2 {
+			pin.Path = strings.TrimPrefix(slashpath.Clean("/"+parts[1]), "/")
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// StaleError is returned along with the mirrored copy of a file served while its owner is offline
+type StaleError struct {
+	Username string
+	// SyncedAt is when the copy was last synced, zero if unknown
+	SyncedAt time.Time
+}
+
+func (e *StaleError) Error() string {
+	if e.SyncedAt.IsZero() {
+		return fmt.Sprintf("user %s is offline, this is an offline copy", e.Username)
+	}
+	return fmt.Sprintf("user %s is offline, this is an offline copy synced %s", e.Username, e.SyncedAt.Format(time.RFC1123))
+}
+
+// SyncedTime returns when the copy was last synced, zero if unknown
+func (e *StaleError) SyncedTime() time.Time {
+	return e.SyncedAt
+}
+
+// mirrorState records the files synced from a user, so that unchanged files are not fetched again
+type mirrorState struct {
+	SyncedAt time.Time `json:"synced_at"`
+	// Files maps the request path of every synced file to its hash
+	Files map[string]string `json:"files"`
+}
+
+// mirror keeps copies of pinned files of other users in a local folder,
+// in a folder per user next to a file recording their state
+type mirror struct {
+	root     string
+	pins     []Pin
+	interval time.Duration
+
+	mu     sync.Mutex
+	states map[string]*mirrorState
+	// lastSync is when each pin was last synced, or attempted to be
+	lastSync map[Pin]time.Time
+	// pending holds the pins whose owner announced a change since they were synced
+	pending map[Pin]bool
+}
+
+func newMirror(root string, pins []Pin, interval time.Duration) *mirror {
+	return &mirror{
+		root:     root,
+		pins:     pins,
+		interval: interval,
+		states:   make(map[string]*mirrorState),
+		lastSync: make(map[Pin]time.Time),
+		pending:  make(map[Pin]bool),
+	}
+}
+
+// filePath returns the local path of the copy of a file of a user, never leaving the users folder
+func (m *mirror) filePath(username, path string) string {
+	return filepath.Join(m.root, username, filepath.FromSlash(slashpath.Clean("/"+path)))
+}
+
+// state returns the state of the mirror of a user, loading it from disk the first time, with m.mu held
+func (m *mirror) state(username string) *mirrorState {
+	if state, ok := m.states[username]; ok {
+		return state
+	}
+	state := &mirrorState{Files: make(map[string]string)}
+	data, err := ioutil.ReadFile(filepath.Join(m.root, username+mirrorStateExt))
+	if err == nil {
+		err = json.Unmarshal(data, state)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Errorf("error reading mirror state of user %s, syncing everything again: %s", username, err)
+		state = &mirrorState{Files: make(map[string]string)}
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]string)
+	}
+	m.states[username] = state
+	return state
+}
+
+// saveState writes the state of the mirror of a user to disk, with m.mu held
+func (m *mirror) saveState(username string) error {
+	data, err := json.Marshal(m.state(username))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(m.root, username+mirrorStateExt), data)
+}
+
+// pinned reports whether a file of a user is covered by any pin
+func (m *mirror) pinned(username, path string) bool {
+	for _, pin := range m.pins {
+		if pin.Username == username && pin.covers(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// usernames returns the users with pins, each once
+func (m *mirror) usernames() []string {
+	usernames := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pin := range m.pins {
+		if !seen[pin.Username] {
+			seen[pin.Username] = true
+			usernames = append(usernames, pin.Username)
+		}
+	}
+	return usernames
+}
+
+// syncedAt returns when the mirror of a user was last synced, zero if never
+func (m *mirror) syncedAt(username string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state(username).SyncedAt
+}
+
+// changed marks the pins covering a changed file as due for a sync
+func (m *mirror) changed(change share.Change) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pin := range m.pins {
+		if pin.Username == change.Username && pin.covers(change.Path) {
+			m.pending[pin] = true
+		}
+	}
+}
+
+// due returns the pins of online users that have changed or were not synced for an interval, marking them as synced
+func (m *mirror) due(online []string) []Pin {
+	isOnline := make(map[string]bool)
+	for _, username := range online {
+		isOnline[username] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	due := make([]Pin, 0)
+	for _, pin := range m.pins {
+		if !isOnline[pin.Username] {
+			continue
+		}
+		if m.pending[pin] || time.Since(m.lastSync[pin]) >= m.interval {
+			due = append(due, pin)
+			m.lastSync[pin] = time.Now()
+			delete(m.pending, pin)
+		}
+	}
+	return due
+}
+
+// read returns the copy of a pinned file, or of the index.html of a pinned folder
+func (m *mirror) read(username, path string) ([]byte, *StaleError, error) {
+	if !m.pinned(username, path) {
+		return nil, nil, fmt.Errorf("file %s of user %s is not pinned", path, username)
+	}
+	localPath := m.filePath(username, path)
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, "index.html")
+	}
+	data, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &StaleError{Username: username, SyncedAt: m.syncedAt(username)}, nil
+}
+
+// runMirror syncs the pins of online users whenever they are due, until ctx is done
+func (s *App) runMirror(ctx context.Context) {
+	changes, cancel := s.SubscribeChanges()
+	defer cancel()
+	ticker := time.NewTicker(mirrorCheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, pin := range s.mirror.due(s.GetOnlineNodes()) {
+			if err := s.syncPin(ctx, pin); err != nil {
+				log.Errorf("error syncing pin %s: %s", pin, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-changes:
+			s.mirror.changed(change)
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncPin brings the copy of a pin up to date with the files of its owner,
+// fetching the files whose hash changed and removing those that are gone
+func (s *App) syncPin(ctx context.Context, pin Pin) error {
+	ctx, cancel := context.WithTimeout(ctx, mirrorSyncTimeout)
+	defer cancel()
+	m := s.mirror
+	listCtx, cancelList := context.WithTimeout(ctx, mirrorListTimeout)
+	entries, err := s.fileProvider.Manifest(listCtx, pin.Username, pin.Path)
+	cancelList()
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool)
+	fetched := 0
+	for _, entry := range entries {
+		if !pin.covers(entry.Path) {
+			log.Warnf("ignoring file %s listed by user %s outside of pin %s", entry.Path, pin.Username, pin)
+			continue
+		}
+		listed[entry.Path] = true
+		localPath := m.filePath(pin.Username, entry.Path)
+		m.mu.Lock()
+		synced := m.state(pin.Username).Files[entry.Path] == entry.Hash
+		m.mu.Unlock()
+		if _, err := os.Stat(localPath); synced && err == nil {
+			continue
+		}
+
+		data, err := s.fileProvider.GetFile(ctx, pin.Username, entry.Path)
+		if err != nil {
+			// the files fetched so far are kept, the rest are fetched by the next sync
+			s.saveMirrorState(pin.Username, false)
+			return fmt.Errorf("error fetching %s: %w", entry.Path, err)
+		}
+		if err = os.MkdirAll(filepath.Dir(localPath), 0755); err == nil {
+			err = writeFileAtomic(localPath, data)
+		}
+		if err != nil {
+			s.saveMirrorState(pin.Username, false)
+			return err
+		}
+		m.mu.Lock()
+		m.state(pin.Username).Files[entry.Path] = entry.Hash
+		m.mu.Unlock()
+		fetched++
+	}
+
+	removed := 0
+	m.mu.Lock()
+	state := m.state(pin.Username)
+	for path := range state.Files {
+		if pin.covers(path) && !listed[path] {
+			if err := os.Remove(m.filePath(pin.Username, path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Error("error removing mirrored file: ", err)
+				continue
+			}
+			delete(state.Files, path)
+			removed++
+		}
+	}
+	m.mu.Unlock()
+	s.saveMirrorState(pin.Username, true)
+	log.Infof("synced pin %s, %d files fetched and %d removed", pin, fetched, removed)
+	return nil
+}
+
+// saveMirrorState records the state of the mirror of a user, as synced now if complete is set
+func (s *App) saveMirrorState(username string, complete bool) {
+	m := s.mirror
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if complete {
+		m.state(username).SyncedAt = time.Now()
+	}
+	if err := m.saveState(username); err != nil {
+		log.Errorf("error saving mirror state of user %s: %s", username, err)
+	}
+}
+
+// mirroredFile returns the copy of a file of an offline user, if it is pinned and was synced.
+// err is why the file could not be fetched, the user is offline if it is not online or could not be reached.
+func (s *App) mirroredFile(username, path string, err error) ([]byte, *StaleError) {
+	if s.mirror == nil || username == "" {
+		return nil, nil
+	}
+	var peerErr interface{ Unreachable() bool }
+	if !errors.As(err, &peerErr) || !peerErr.Unreachable() {
+		for _, online := range s.GetOnlineNodes() {
+			if online == username {
+				return nil, nil
+			}
+		}
+	}
+	data, stale, err := s.mirror.read(username, path)
+	if err != nil {
+		log.Debug("no offline copy: ", err)
+		return nil, nil
+	}
+	return data, stale
+}
+
+// writeFileAtomic writes a file through a temporary file, so that readers never see it half written
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".mirror-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/local"
+	"github.com/mungujn/web-exp/share"
+)
+
+// pinnedFilesystem is a local file system where alice shares the files set by the test, while online
+type pinnedFilesystem struct {
+	*local.LocalFilesystem
+	mu     sync.Mutex
+	online bool
+	// crashed leaves alice listed as online while her node can not be reached
+	crashed bool
+	files   fstest.MapFS
+	fetched []string
+}
+
+// unreachableError is returned by a peer whose node can not be reached
+type unreachableError struct{}
+
+func (unreachableError) Error() string {
+	return "error opening stream to peer alice: connection refused"
+}
+func (unreachableError) Unreachable() bool { return true }
+
+func (pfs *pinnedFilesystem) shares() share.Shares {
+	return share.Shares{{Name: share.DefaultName, Files: pfs.files}, {Name: "docs", Files: fstest.MapFS{}}}
+}
+
+func (pfs *pinnedFilesystem) GetOnlineNodes() []string {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	if pfs.online {
+		return []string{"alice"}
+	}
+	return []string{}
+}
+
+func (pfs *pinnedFilesystem) GetPeers() []share.Peer {
+	return []share.Peer{}
+}
+
+func (pfs *pinnedFilesystem) GetFile(ctx context.Context, username, path string) ([]byte, error) {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	if !pfs.online {
+		return nil, errors.New("username alice is not assciated with a peer id")
+	}
+	if pfs.crashed {
+		return nil, unreachableError{}
+	}
+	pfs.fetched = append(pfs.fetched, path)
+	return pfs.shares().ReadFile("me", path)
+}
+
+func (pfs *pinnedFilesystem) Manifest(ctx context.Context, username, prefix string) ([]share.ManifestEntry, error) {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	return pfs.shares().Manifest("me", prefix)
+}
+
+func Test_ParsePins(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Spec          string
+		Expected      []Pin
+		ExpectedError string
+	}{
+		{Name: "empty", Spec: "", Expected: []Pin{}},
+		{
+			Name:     "users and paths",
+			Spec:     "alice, bob/docs/, carol/../notes/a.md",
+			Expected: []Pin{{Username: "alice"}, {Username: "bob", Path: "docs"}, {Username: "carol", Path: "notes/a.md"}},
+		},
+		{Name: "bad username", Spec: "al ice/docs", ExpectedError: `pin "al ice/docs": username "al ice" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit`},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			pins, err := ParsePins(testCase.Spec)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, pins)
+		})
+	}
+}
+
+func Test_mirror(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	root := t.TempDir()
+	provider := &pinnedFilesystem{
+		LocalFilesystem: local.New("test_data/server_root"),
+		online:          true,
+		files: fstest.MapFS{
+			"index.html":       {Data: []byte("<html><body>home</body></html>")},
+			"notes/a.md":       {Data: []byte("a")},
+			"notes/b.md":       {Data: []byte("b")},
+			"private/plan.txt": {Data: []byte("plan")},
+		},
+	}
+	// the mirror is set up by hand, so that it is only synced by the test
+	newApp := func(pins ...Pin) *App {
+		app, err := New(ctx, Config{Username: "me"}, provider)
+		assert.NoError(t, err)
+		app.mirror = newMirror(root, pins, time.Hour)
+		return app
+	}
+	pins := []Pin{{Username: "alice", Path: "notes"}, {Username: "alice", Path: "index.html"}}
+	app := newApp(pins...)
+
+	mirrored := func(path string) string {
+		data, err := ioutil.ReadFile(filepath.Join(root, "alice", filepath.FromSlash(path)))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	t.Run("sync", func(t *testing.T) {
+		for _, pin := range pins {
+			assert.NoError(t, app.syncPin(ctx, pin))
+		}
+		assert.Equal(t, "a", mirrored("notes/a.md"))
+		assert.Equal(t, "b", mirrored("notes/b.md"))
+		assert.Equal(t, "<html><body>home</body></html>", mirrored("index.html"))
+		assert.Equal(t, "", mirrored("private/plan.txt"))
+		assert.ElementsMatch(t, []string{"notes/a.md", "notes/b.md", "index.html"}, provider.fetched)
+	})
+
+	t.Run("sync changes only", func(t *testing.T) {
+		provider.mu.Lock()
+		provider.files["notes/a.md"] = &fstest.MapFile{Data: []byte("a2")}
+		delete(provider.files, "notes/b.md")
+		provider.fetched = nil
+		provider.mu.Unlock()
+
+		assert.NoError(t, app.syncPin(ctx, pins[0]))
+		assert.Equal(t, "a2", mirrored("notes/a.md"))
+		_, err := ioutil.ReadFile(filepath.Join(root, "alice", "notes", "b.md"))
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+		assert.Equal(t, []string{"notes/a.md"}, provider.fetched)
+	})
+
+	t.Run("crashed owner", func(t *testing.T) {
+		provider.mu.Lock()
+		provider.crashed = true
+		provider.mu.Unlock()
+		defer func() {
+			provider.mu.Lock()
+			provider.crashed = false
+			provider.mu.Unlock()
+		}()
+		data, _, err := app.GetFile(ctx, "localhost:8080", "alice/index.html", false)
+		assert.Equal(t, "<html><body>home</body></html>", string(data))
+		var stale *StaleError
+		assert.True(t, errors.As(err, &stale))
+	})
+
+	provider.mu.Lock()
+	provider.online = false
+	provider.mu.Unlock()
+
+	t.Run("offline copy", func(t *testing.T) {
+		data, _, err := app.GetFile(ctx, "localhost:8080", "alice/notes/a.md", false)
+		assert.Equal(t, "a2", string(data))
+		var stale *StaleError
+		if assert.True(t, errors.As(err, &stale)) {
+			assert.Equal(t, "alice", stale.Username)
+			assert.False(t, stale.SyncedAt.IsZero())
+		}
+	})
+
+	t.Run("unpinned file", func(t *testing.T) {
+		_, _, err := app.GetFile(ctx, "localhost:8080", "alice/private/plan.txt", false)
+		assert.EqualError(t, err, "username alice is not assciated with a peer id")
+	})
+
+	t.Run("state survives a restart", func(t *testing.T) {
+		restarted := newApp(pins[0])
+		data, _, err := restarted.GetFile(ctx, "localhost:8080", "alice/notes/a.md", false)
+		assert.Equal(t, "a2", string(data))
+		var stale *StaleError
+		if assert.True(t, errors.As(err, &stale)) {
+			assert.Equal(t, app.mirror.syncedAt("alice").Unix(), stale.SyncedAt.Unix())
+		}
+	})
+
+	t.Run("due", func(t *testing.T) {
+		m := newMirror(root, pins, time.Hour)
+		assert.Equal(t, []Pin{}, m.due([]string{"bob"}))
+		assert.Equal(t, pins, m.due([]string{"alice"}))
+		assert.Equal(t, []Pin{}, m.due([]string{"alice"}))
+		m.changed(share.Change{Username: "alice", Path: "notes/a.md"})
+		m.changed(share.Change{Username: "alice", Path: "private/plan.txt"})
+		assert.Equal(t, pins[:1], m.due([]string{"alice"}))
+	})
+
+	t.Run("home page", func(t *testing.T) {
+		page, _, err := app.GetFile(ctx, "localhost:8080", "", false)
+		assert.NoError(t, err)
+		assert.Contains(t, string(page), "alice</a></strong>")
+		assert.Contains(t, string(page), "offline, pinned, offline copy synced")
+	})
+}
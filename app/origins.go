@@ -0,0 +1,87 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// isolatedOriginDomain is the domain each user gets a sub domain of when origins are isolated.
+// Browsers resolve every sub domain of localhost to the local machine.
+const isolatedOriginDomain = ".localhost"
+
+// maxLabelLength is the longest label a host name may have
+const maxLabelLength = 63
+
+// maxQualifierLabelLength is how long the qualification of a username by the end of a peer ID gets in a label
+const maxQualifierLabelLength = 8
+
+// labelEscapes writes the characters of user names that host names may not have as a dash followed by a digit
+var labelEscapes = strings.NewReplacer("-", "-0", ".", "-1", "_", "-2", UsernameQualifier, "-3")
+
+// labelUnescapes reads back the characters written by labelEscapes
+var labelUnescapes = strings.NewReplacer("-0", "-", "-1", ".", "-2", "_", "-3", UsernameQualifier)
+
+// labelPattern matches the labels written by originLabel
+var labelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9]|-[0-3])*$`)
+
+// originLabel is the host name label of the isolated origin of a user. Browsers send host names in lower case, so
+// the case of a name is dropped, and recovered by OriginUsername from the names of the users it could be.
+func originLabel(username string) string {
+	return labelEscapes.Replace(strings.ToLower(username))
+}
+
+// OriginUsername returns the user whose isolated origin host names, false for the main origin
+func (s *App) OriginUsername(host string) (string, bool) {
+	if !s.cfg.IsolateOrigins {
+		return "", false
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.ToLower(hostname)
+	if !strings.HasSuffix(hostname, isolatedOriginDomain) || len(hostname) == len(isolatedOriginDomain) {
+		return "", false
+	}
+	label := hostname[:len(hostname)-len(isolatedOriginDomain)]
+	name := label
+	if labelPattern.MatchString(label) {
+		name = labelUnescapes.Replace(label)
+	}
+	for _, username := range append([]string{s.cfg.Username}, s.GetOnlineNodes()...) {
+		if strings.EqualFold(username, name) {
+			return username, true
+		}
+	}
+	return name, true
+}
+
+// userUrl is the address of the files of a user, on their own origin when origins are isolated
+func (s *App) userUrl(username string) string {
+	if s.cfg.IsolateOrigins {
+		return fmt.Sprintf("http://%s%s:%d", originLabel(username), isolatedOriginDomain, s.cfg.LocalWebServerPort)
+	}
+	return s.baseUrl() + "/" + url.PathEscape(username)
+}
+
+// IsolatesOrigins reports whether the files of each user are served from an origin of their own
+func (s *App) IsolatesOrigins() bool {
+	return s.cfg.IsolateOrigins
+}
+
+// OriginRedirect returns the isolated origin url that a request for path on host has to be sent to,
+// empty if the request is served where it is. With origins isolated, files are only served from
+// their owners origin so that they can not read the files of other users or the nodes own pages.
+func (s *App) OriginRedirect(host, path string) string {
+	if !s.cfg.IsolateOrigins || path == "" {
+		return ""
+	}
+	if _, isolated := s.OriginUsername(host); isolated {
+		return ""
+	}
+	username, filename := s.parsePath(path)
+	return s.userUrl(username) + "/" + escapePath(filename)
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/local"
+)
+
+func Test_GetFile_isolatedOrigins(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		Username:           "Me",
+		LocalRootFolder:    "test_data/server_root",
+		LocalNodeHost:      "0.0.0.0",
+		LocalWebServerPort: 8080,
+		IsolateOrigins:     true,
+	}
+	app, err := New(ctx, cfg, local.New(cfg.LocalRootFolder))
+	assert.NoError(t, err)
+
+	cases := []struct {
+		Name                string
+		Host                string
+		Path                string
+		ExpectedContentType string
+		ExpectedBytes       []byte
+	}{
+		{
+			Name:                "index of own origin",
+			Host:                "me.localhost:8080",
+			Path:                "",
+			ExpectedContentType: htmlContent,
+			ExpectedBytes:       getFile("test_data/expected/file.html"),
+		},
+		{
+			Name:                "file of own origin",
+			Host:                "me.localhost:8080",
+			Path:                "sub-path/file.css",
+			ExpectedContentType: cssContent,
+			ExpectedBytes:       getFile("test_data/expected/file.css"),
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, contentType, err := app.GetFile(ctx, testCase.Host, testCase.Path, false)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.ExpectedContentType, contentType)
+			assert.Equal(t, testCase.ExpectedBytes, data)
+		})
+	}
+
+	home, _, err := app.GetFile(ctx, "localhost:8080", "", false)
+	assert.NoError(t, err)
+	assert.Contains(t, string(home), `<a href="http://me.localhost:8080/index.html">Me</a>`)
+	assert.Contains(t, string(home), `<a href="http://user-22.localhost:8080/index.html">user_2</a>`)
+}
+
+func Test_OriginRedirect(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Username: "me", LocalRootFolder: "test_data/server_root", LocalWebServerPort: 8080, IsolateOrigins: true}
+	isolated, err := New(ctx, cfg, local.New(cfg.LocalRootFolder))
+	assert.NoError(t, err)
+	cfg.IsolateOrigins = false
+	shared, err := New(ctx, cfg, local.New(cfg.LocalRootFolder))
+	assert.NoError(t, err)
+
+	cases := []struct {
+		Name     string
+		App      *App
+		Host     string
+		Path     string
+		Expected string
+	}{
+		{Name: "peer file", App: isolated, Host: "localhost:8080", Path: "user_2/docs/a b.html", Expected: "http://user-22.localhost:8080/docs/a%20b.html"},
+		{Name: "own file", App: isolated, Host: "localhost:8080", Path: "file.js", Expected: "http://me.localhost:8080/file.js"},
+		{Name: "home page", App: isolated, Host: "localhost:8080", Path: "", Expected: ""},
+		{Name: "already isolated", App: isolated, Host: "user-22.localhost:8080", Path: "docs/a.html", Expected: ""},
+		{Name: "isolation disabled", App: shared, Host: "localhost:8080", Path: "user_2/docs/a.html", Expected: ""},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.Equal(t, testCase.Expected, testCase.App.OriginRedirect(testCase.Host, testCase.Path))
+		})
+	}
+}
+
+func Test_OriginUsername(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Username: "Me.Too", LocalRootFolder: "test_data/server_root", LocalWebServerPort: 8080, IsolateOrigins: true}
+	app, err := New(ctx, cfg, local.New(cfg.LocalRootFolder))
+	assert.NoError(t, err)
+
+	cases := []struct {
+		Name             string
+		Host             string
+		ExpectedUsername string
+		ExpectedIsolated bool
+	}{
+		{Name: "main origin", Host: "localhost:8080"},
+		{Name: "own origin", Host: "me-1too.localhost:8080", ExpectedUsername: "Me.Too", ExpectedIsolated: true},
+		{Name: "peer origin", Host: "user-22.localhost:8080", ExpectedUsername: "user_2", ExpectedIsolated: true},
+		{Name: "qualified name", Host: "bob-3ab12cd.localhost", ExpectedUsername: "bob~ab12cd", ExpectedIsolated: true},
+		{Name: "dash", Host: "a-0b.localhost:8080", ExpectedUsername: "a-b", ExpectedIsolated: true},
+		{Name: "unescaped label", Host: "a-b.localhost:8080", ExpectedUsername: "a-b", ExpectedIsolated: true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			username, isolated := app.OriginUsername(testCase.Host)
+			assert.Equal(t, testCase.ExpectedUsername, username)
+			assert.Equal(t, testCase.ExpectedIsolated, isolated)
+		})
+	}
+}
+
+func Test_originLabel(t *testing.T) {
+	cases := []struct {
+		Username string
+		Expected string
+	}{
+		{Username: "me", Expected: "me"},
+		{Username: "Me.Too", Expected: "me-1too"},
+		{Username: "user_2", Expected: "user-22"},
+		{Username: "a-b-", Expected: "a-0b-0"},
+		{Username: "bob~Ab12cd", Expected: "bob-3ab12cd"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Username, func(t *testing.T) {
+			label := originLabel(testCase.Username)
+			assert.Equal(t, testCase.Expected, label)
+			assert.Regexp(t, labelPattern, label)
+			assert.LessOrEqual(t, len(label), maxLabelLength)
+		})
+	}
+}
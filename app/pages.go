@@ -1,58 +1,120 @@
 package app
 
 import (
+	"context"
 	"fmt"
+	"net/url"
 	"strings"
+	"time"
+
+	"github.com/mungujn/web-exp/share"
 )
 
-func (s *App) renderedHomePage(onlineNodes []string) ([]byte, string, error) {
-	html := renderHeader() + s.renderOnlineNodes(onlineNodes) + renderFooter()
-	return []byte(html), htmlContent, nil
+// homePage is the data the home.html template is rendered with
+type homePage struct {
+	Heading      string
+	Self         peerView
+	Peers        []peerView
+	InboxEnabled bool
+	Incoming     []share.Incoming
+}
+
+// searchPage is the data the search.html template is rendered with
+type searchPage struct {
+	Heading string
+	Query   string
+	Results []searchResultView
+}
+
+// searchResultView is a search result as shown on the search page
+type searchResultView struct {
+	share.SearchResult
+	// URL is the address of the file found
+	URL string
 }
 
-func (s *App) renderOnlineNodes(nodes []string) string {
-	nodesHtml := "<ul>"
+// peerView is a peer as shown on the home page
+type peerView struct {
+	share.Peer
+	// URL is the address of the users files
+	URL  string
+	Self bool
+	// Pinned is set for users whose files are mirrored, SyncedAt being when they last were
+	Pinned   bool
+	SyncedAt time.Time
+}
+
+func (s *App) renderedHomePage() ([]byte, string, error) {
+	page := homePage{
+		Heading: "Online Users",
+		Self: peerView{
+			Peer: share.Peer{Username: s.cfg.Username, Claimed: s.cfg.Username, Online: true, Shares: s.fileProvider.GetShares("")},
+			URL:  s.userUrl(s.cfg.Username),
+			Self: true,
+		},
+		Peers:        make([]peerView, 0),
+		InboxEnabled: s.inbox != nil,
+	}
+	for _, peer := range s.fileProvider.GetPeers() {
+		page.Peers = append(page.Peers, peerView{Peer: peer, URL: s.userUrl(peer.Username)})
+		// another node claiming the username of the current user is listed qualified, the current user is not
+		if peer.Claimed == s.cfg.Username {
+			page.Self.Conflict = true
+		}
+	}
+	if s.mirror != nil {
+		page.Peers = s.withPinnedUsers(page.Peers)
+	}
+	if s.inbox != nil {
+		page.Incoming = s.incomingFiles()
+	}
+	return s.renderPage("home.html", page)
+}
+
+// withPinnedUsers marks the pinned users among peers, adding those the node does not know of yet as offline
+func (s *App) withPinnedUsers(peers []peerView) []peerView {
+	for _, username := range s.mirror.usernames() {
+		i := 0
+		for i < len(peers) && peers[i].Username != username {
+			i++
+		}
+		if i == len(peers) {
+			peers = append(peers, peerView{Peer: share.Peer{Username: username}, URL: s.userUrl(username)})
+		}
+		peers[i].Pinned = true
+		peers[i].SyncedAt = s.mirror.syncedAt(username)
+	}
+	return peers
+}
+
+// baseUrl is the address of the local web server
+func (s *App) baseUrl() string {
 	rootHost := s.cfg.LocalNodeHost
 	if rootHost == "0.0.0.0" {
 		rootHost = "localhost"
 	}
-	nodesHtml += fmt.Sprintf(`<li><strong><a href="http://%s:%d/%s/index.html">%s</a></strong></li>`,
-		rootHost,
-		s.cfg.LocalWebServerPort,
-		s.cfg.Username,
-		s.cfg.Username,
-	)
-	for _, node := range nodes {
-		nodesHtml += fmt.Sprintf(`<li><strong><a href="http://%s:%d/%s/index.html">%s</a></strong></li>`,
-			rootHost,
-			s.cfg.LocalWebServerPort,
-			node,
-			node,
-		)
-	}
-	nodesHtml += "</ul>"
-	return nodesHtml
+	return fmt.Sprintf("http://%s:%d", rootHost, s.cfg.LocalWebServerPort)
 }
 
-func renderHeader() string {
-	return `
-	<!DOCTYPE html>
-	<html>
-	<head>
-		<meta charset="UTF-8">
-		<meta name="viewport" content="user-scalable=0, width=device-width, initial-scale=1.0, maximum-scale=1.0, minimum-scale=1.0">
-		<title>Localhosts</title>
-	<head>
-	<body>
-		<p><strong>Online Users</strong></p>
-	`
+// SearchPage renders the results of searching the shares of every online user
+func (s *App) SearchPage(ctx context.Context, query string) ([]byte, string, error) {
+	page := searchPage{Heading: "Search", Query: query, Results: make([]searchResultView, 0)}
+	for _, result := range s.Search(ctx, query) {
+		page.Results = append(page.Results, searchResultView{
+			SearchResult: result,
+			URL:          s.userUrl(result.Username) + "/" + escapePath(result.Path),
+		})
+	}
+	return s.renderPage("search.html", page)
 }
 
-func renderFooter() string {
-	return `
-	</body>
-	</html>
-	`
+// escapePath escapes each element of a slash separated path for use in a url
+func escapePath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
 }
 
 func inferContentType(path string) string {
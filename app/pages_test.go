@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/local"
+	"github.com/mungujn/web-exp/share"
+)
+
+// rosterFilesystem is a local file system reporting the peers set by the test
+type rosterFilesystem struct {
+	*local.LocalFilesystem
+	peers []share.Peer
+}
+
+func (rfs *rosterFilesystem) GetPeers() []share.Peer {
+	return rfs.peers
+}
+
+func Test_HomePage_peers(t *testing.T) {
+	ctx := context.Background()
+	provider := &rosterFilesystem{local.New("test_data/server_root"), []share.Peer{
+		{Username: "alice", Online: true, Shares: []string{"docs"}, LastSeen: time.Now().Add(-2 * time.Minute), Latency: 12 * time.Millisecond},
+		{Username: "bob", Online: false},
+		{Username: `<script>alert("x")</script>`, Online: true},
+		{Username: "me~Ab12cd", PeerId: "12D3KooWAb12cd", Claimed: "me", Conflict: true, Online: true},
+	}}
+	app, err := New(ctx, Config{Username: "me", LocalWebServerPort: 8080, LocalNodeHost: "0.0.0.0"}, provider)
+	assert.NoError(t, err)
+
+	page, contentType, err := app.GetFile(ctx, "localhost:8080", "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, htmlContent, contentType)
+
+	cases := []struct {
+		Name     string
+		Expected string
+	}{
+		{Name: "online peer", Expected: `<span class="status"><span class="online">online</span>, last seen 2m0s ago, 12 ms</span>`},
+		{Name: "peer shares", Expected: `<li><a href="http://localhost:8080/alice/docs/">docs</a></li>`},
+		{Name: "offline peer", Expected: `<span class="status">offline</span>`},
+		{Name: "escaped username link", Expected: `<a href="http://localhost:8080/%3Cscript%3Ealert%28%22x%22%29%3C%2Fscript%3E/index.html">&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</a>`},
+		{Name: "escaped username option", Expected: `<option value="&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;">`},
+		{Name: "qualified peer", Expected: `<a href="http://localhost:8080/me~Ab12cd/index.html">me~Ab12cd</a>`},
+		{Name: "conflicting peer", Expected: `, <span class="conflict" title="peer 12D3KooWAb12cd">me is claimed by more than one node</span></span>`},
+		{Name: "conflicting self", Expected: `this node, <span class="conflict">me is claimed by more than one node</span></span>`},
+		{Name: "closed head", Expected: "</style>\n</head>\n<body>"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.Contains(t, string(page), testCase.Expected)
+		})
+	}
+	assert.NotContains(t, string(page), "<script>")
+}
+
+func Test_HomePage_theme(t *testing.T) {
+	ctx := context.Background()
+	theme := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(theme, "style.html"), []byte(`{{define "style"}}<link rel="stylesheet" href="/theme.css">{{end}}`), 0644)
+	assert.NoError(t, err)
+
+	app, err := New(ctx, Config{Username: "me", ThemeFolder: theme}, local.New("test_data/server_root"))
+	assert.NoError(t, err)
+
+	page, _, err := app.GetFile(ctx, "localhost:8080", "", false)
+	assert.NoError(t, err)
+	assert.Contains(t, string(page), `<title>Localhosts</title><link rel="stylesheet" href="/theme.css">`)
+	assert.Contains(t, string(page), `<p><strong>Online Users</strong></p>`)
+
+	// themes that do not parse are reported when the app is created
+	err = ioutil.WriteFile(filepath.Join(theme, "home.html"), []byte(`{{template "header" .}`), 0644)
+	assert.NoError(t, err)
+	_, err = New(ctx, Config{Username: "me", ThemeFolder: theme}, local.New("test_data/server_root"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+// searchTimeout is how long each user is given to answer a search
+const searchTimeout = 3 * time.Second
+
+// Search searches the shares of every online user, the current one included, in parallel.
+// Users that fail or do not answer in time are left out of the results.
+func (s *App) Search(ctx context.Context, query string) []share.SearchResult {
+	usernames := append([]string{s.cfg.Username}, s.GetOnlineNodes()...)
+	resultsByUser := make([][]share.SearchResult, len(usernames))
+
+	var wg sync.WaitGroup
+	for i, username := range usernames {
+		wg.Add(1)
+		go func(i int, username string) {
+			defer wg.Done()
+			userCtx, cancel := context.WithTimeout(ctx, searchTimeout)
+			defer cancel()
+			providerUsername := username
+			if username == s.cfg.Username {
+				providerUsername = ""
+			}
+			results, err := s.fileProvider.Search(userCtx, providerUsername, query)
+			if err != nil {
+				log.Errorf("error searching files of user %s: %s", username, err)
+				return
+			}
+			for j := range results {
+				results[j].Username = username
+			}
+			resultsByUser[i] = results
+		}(i, username)
+	}
+	wg.Wait()
+
+	merged := make([]share.SearchResult, 0)
+	for _, results := range resultsByUser {
+		merged = append(merged, results...)
+	}
+	sort.SliceStable(merged, func(a, b int) bool { return merged[a].Username < merged[b].Username })
+	return merged
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+var templateFuncs = template.FuncMap{
+	"pathEscape": url.PathEscape,
+	"escapePath": escapePath,
+	"formatSize": formatSize,
+	"since": func(t time.Time) time.Duration {
+		return time.Since(t).Round(time.Second)
+	},
+	"milliseconds": func(d time.Duration) int64 {
+		return d.Milliseconds()
+	},
+}
+
+// loadTemplates parses the default page templates, then any .html files in themeFolder,
+// whose templates replace the default ones of the same name
+func loadTemplates(themeFolder string) (*template.Template, error) {
+	templates, err := template.New("pages").Funcs(templateFuncs).ParseFS(defaultTemplates, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing default templates: %s", err)
+	}
+	if themeFolder == "" {
+		return templates, nil
+	}
+	themeFiles, err := filepath.Glob(filepath.Join(themeFolder, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(themeFiles) == 0 {
+		return templates, nil
+	}
+	templates, err = templates.ParseFiles(themeFiles...)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing theme templates: %s", err)
+	}
+	return templates, nil
+}
+
+// renderPage executes the named page template
+func (s *App) renderPage(name string, data interface{}) ([]byte, string, error) {
+	var page bytes.Buffer
+	if err := s.templates.ExecuteTemplate(&page, name, data); err != nil {
+		log.Error(err)
+		return []byte(err.Error()), plainTextContent, err
+	}
+	return page.Bytes(), htmlContent, nil
+}
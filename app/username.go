@@ -0,0 +1,90 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// maxUsernameLength is the longest username a node may use
+const maxUsernameLength = 32
+
+// usernamePattern allows letters, digits, dots, dashes and underscores, starting with a letter or digit.
+// Usernames are part of every url and page that refers to the user, so nothing else is accepted.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// UsernameQualifier separates a username from the end of the peer ID qualifying it, as users are listed by while more
+// than one node claims their username. It is never part of a username.
+const UsernameQualifier = "~"
+
+// peerIdSuffixPattern matches the end of a peer ID qualifying a username
+var peerIdSuffixPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// reservedUsernames collide with the paths the web server uses for its own pages
+var reservedUsernames = map[string]bool{
+	"search":  true,
+	"metrics": true,
+	"healthz": true,
+	"readyz":  true,
+	"dav":     true,
+	"api":     true,
+}
+
+// ValidateUsername reports why a username can not be used, nil if it can
+func ValidateUsername(username string) error {
+	switch {
+	case username == "":
+		return fmt.Errorf("must not be empty")
+	case len(username) > maxUsernameLength:
+		return fmt.Errorf("%q is longer than %d characters", username, maxUsernameLength)
+	case !usernamePattern.MatchString(username):
+		return fmt.Errorf("%q may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit", username)
+	case reservedUsernames[username]:
+		return fmt.Errorf("%q is reserved", username)
+	case len(originLabel(username)) > maxLabelLength-maxQualifierLabelLength:
+		return fmt.Errorf("%q is too long to name an origin once its '.', '-' and '_' are escaped", username)
+	}
+	return nil
+}
+
+// ValidateUserReference reports why a name can not address a user, nil if it can. Besides usernames, users can be
+// addressed by their names qualified by the end of their peer ID, such as me~Ab12cd.
+func ValidateUserReference(name string) error {
+	username, suffix, qualified := strings.Cut(name, UsernameQualifier)
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	if qualified && !peerIdSuffixPattern.MatchString(suffix) {
+		return fmt.Errorf("%q is not qualified by the end of a peer ID", name)
+	}
+	return nil
+}
+
+// ParseKnownPeers parses a comma separated list of username=peerID pairs, pinning each username to the peer ID of the
+// node that owns it. Other nodes claiming a pinned username are always listed by their qualified names.
+func ParseKnownPeers(spec string) (map[string]string, error) {
+	known := make(map[string]string)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		username, peerId, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("known peer %q is not of the form username=peerID", item)
+		}
+		if err := ValidateUsername(username); err != nil {
+			return nil, fmt.Errorf("known peer %q: username %s", item, err)
+		}
+		if _, err := peer.Decode(peerId); err != nil {
+			return nil, fmt.Errorf("known peer %q: %q is not a peer ID", item, peerId)
+		}
+		if _, pinned := known[username]; pinned {
+			return nil, fmt.Errorf("username %s is pinned more than once", username)
+		}
+		known[username] = peerId
+	}
+	return known, nil
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ValidateUsername(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Username      string
+		ExpectedError string
+	}{
+		{Name: "plain", Username: "user_2"},
+		{Name: "dots and dashes", Username: "j.doe-laptop"},
+		{Name: "empty", Username: "", ExpectedError: "must not be empty"},
+		{Name: "markup", Username: "<script>alert(1)</script>", ExpectedError: `"<script>alert(1)</script>" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit`},
+		{Name: "path", Username: "a/b", ExpectedError: `"a/b" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit`},
+		{Name: "hidden", Username: ".inbox", ExpectedError: `".inbox" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit`},
+		{Name: "too long", Username: strings.Repeat("a", 33), ExpectedError: `"` + strings.Repeat("a", 33) + `" is longer than 32 characters`},
+		{Name: "reserved", Username: "search", ExpectedError: `"search" is reserved`},
+		{Name: "reserved metrics", Username: "metrics", ExpectedError: `"metrics" is reserved`},
+		{Name: "reserved dav", Username: "dav", ExpectedError: `"dav" is reserved`},
+		{Name: "reserved api", Username: "api", ExpectedError: `"api" is reserved`},
+		{Name: "too long as an origin", Username: "a" + strings.Repeat(".", 30), ExpectedError: `"a` + strings.Repeat(".", 30) + `" is too long to name an origin once its '.', '-' and '_' are escaped`},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := ValidateUsername(testCase.Username)
+			if testCase.ExpectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, testCase.ExpectedError)
+		})
+	}
+}
+
+func Test_ValidateUserReference(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Reference     string
+		ExpectedError string
+	}{
+		{Name: "username", Reference: "user_2"},
+		{Name: "qualified", Reference: "me~Ab12cd"},
+		{Name: "bad username", Reference: "a/b~Ab12cd", ExpectedError: `"a/b" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit`},
+		{Name: "empty qualifier", Reference: "me~", ExpectedError: `"me~" is not qualified by the end of a peer ID`},
+		{Name: "bad qualifier", Reference: "me~a.b", ExpectedError: `"me~a.b" is not qualified by the end of a peer ID`},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := ValidateUserReference(testCase.Reference)
+			if testCase.ExpectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, testCase.ExpectedError)
+		})
+	}
+}
+
+func Test_ParseKnownPeers(t *testing.T) {
+	const peerId = "QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ"
+	cases := []struct {
+		Name          string
+		Spec          string
+		Expected      map[string]string
+		ExpectedError string
+	}{
+		{Name: "empty", Spec: "", Expected: map[string]string{}},
+		{Name: "pinned", Spec: "bob=" + peerId + ", carol=" + peerId, Expected: map[string]string{"bob": peerId, "carol": peerId}},
+		{Name: "no peer ID", Spec: "bob", ExpectedError: `known peer "bob" is not of the form username=peerID`},
+		{Name: "bad username", Spec: "a/b=" + peerId, ExpectedError: `known peer "a/b=` + peerId + `": username "a/b" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit`},
+		{Name: "bad peer ID", Spec: "bob=bob", ExpectedError: `known peer "bob=bob": "bob" is not a peer ID`},
+		{Name: "pinned twice", Spec: "bob=" + peerId + ",bob=" + peerId, ExpectedError: "username bob is pinned more than once"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			known, err := ParseKnownPeers(testCase.Spec)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, known)
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/mungujn/web-exp/app"
+	"github.com/mungujn/web-exp/config"
+	"github.com/mungujn/web-exp/remote"
+	serverHTTP "github.com/mungujn/web-exp/server"
+	"github.com/mungujn/web-exp/share"
+	"github.com/mungujn/web-exp/tracing"
+)
+
+const (
+	textOutput = "text"
+	jsonOutput = "json"
+
+	// downloadPollInterval is how often the download command asks the node for progress
+	downloadPollInterval = 500 * time.Millisecond
+)
+
+// command is a cli subcommand
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commandNames = []string{"serve", "bridge", "peers", "get", "download", "id"}
+
+var commands = map[string]command{
+	"serve": {
+		usage:       "serve",
+		description: "start a node sharing LOCAL_ROOT_FOLDER and its web server (default)",
+		run:         runServe,
+	},
+	"bridge": {
+		usage:       "bridge",
+		description: "start a global node other nodes can use as CUSTOM_BOOTSTRAP_PEER",
+		run:         runBridge,
+	},
+	"peers": {
+		usage:       "peers",
+		description: "list the online peers of a running node",
+		run:         runPeers,
+	},
+	"get": {
+		usage:       "get <user>/<path>",
+		description: "fetch a file from a peer through a running node",
+		run:         runGet,
+	},
+	"download": {
+		usage:       "download <user>/<path>",
+		description: "download a file from a peer to the DOWNLOAD_FOLDER of a running node, resuming an earlier attempt",
+		run:         runDownload,
+	},
+	"id": {
+		usage:       "id",
+		description: "print the peer ID of the node, creating KEY_FILE if needed",
+		run:         runId,
+	},
+}
+
+// parseFlags parses the config override flags, plus any command specific ones, and loads the config
+func parseFlags(name string, args []string, validate bool, define func(flags *pflag.FlagSet)) (config.Config, *pflag.FlagSet, error) {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	if define != nil {
+		define(flags)
+	}
+	if err := config.DefineFlags(flags); err != nil {
+		return config.Config{}, nil, err
+	}
+	if err := flags.Parse(args); err != nil {
+		return config.Config{}, nil, err
+	}
+	load := config.Load
+	if validate {
+		load = config.Read
+	}
+	cfg, err := load(flags)
+	if err != nil {
+		return cfg, nil, err
+	}
+	initLogger(cfg.LogLevel)
+	return cfg, flags, nil
+}
+
+// runServe starts a full node, todays default behaviour
+func runServe(args []string) error {
+	cfg, _, err := parseFlags("serve", args, true, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Info("service starting...")
+
+	// prepare main context
+	ctx, cancel := context.WithCancel(context.Background())
+	setupGracefulShutdown(cancel)
+
+	// init tracing
+	dcfg := cfg.DistributedSystem
+	if cfg.TracingEndpoint != "" {
+		stopTracing, err := tracing.Start(ctx, cfg.TracingEndpoint, dcfg.Username)
+		if err != nil {
+			log.WithError(err).Error("tracing init error, spans will not be exported")
+		} else {
+			defer func() {
+				if err := stopTracing(context.Background()); err != nil {
+					log.WithError(err).Error("error flushing spans")
+				}
+			}()
+		}
+	}
+
+	// init distributed capabilites provider
+	provider := remote.New(dcfg)
+	err = provider.StartHost(ctx)
+	if err != nil {
+		log.WithError(err).Fatal("host init error")
+	}
+
+	// init distributed system
+	app, err := app.New(ctx, dcfg, provider)
+	if err != nil {
+		log.WithError(err).Fatal("app init error")
+	}
+
+	// init http server
+	httpSrv, err := serverHTTP.New(
+		cfg.HTTPServer,
+		app,
+	)
+	if err != nil {
+		log.WithError(err).Error("http server init error, http web server will not be available")
+	}
+
+	var wg = &sync.WaitGroup{}
+
+	// run srv
+	httpSrv.Run(ctx, wg)
+
+	// wait while services work
+	wg.Wait()
+	log.Info("service stopped")
+	return nil
+}
+
+// runBridge starts a global node without a web server and prints the addresses to bootstrap from
+func runBridge(args []string) error {
+	var output string
+	cfg, _, err := parseFlags("bridge", args, false, func(flags *pflag.FlagSet) {
+		flags.StringVarP(&output, "output", "o", textOutput, "output format, text or json")
+	})
+	if err != nil {
+		return err
+	}
+	cfg.DistributedSystem.RunBridge = true
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	setupGracefulShutdown(cancel)
+
+	provider := remote.New(cfg.DistributedSystem)
+	if err = provider.StartHost(ctx); err != nil {
+		return err
+	}
+
+	addrs := provider.Addrs()
+	if output == jsonOutput {
+		err = json.NewEncoder(os.Stdout).Encode(map[string][]string{"addrs": addrs})
+	} else {
+		_, err = fmt.Println(strings.Join(addrs, "\n"))
+	}
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	log.Info("bridge stopped")
+	return nil
+}
+
+// runPeers lists the online peers of a running node
+func runPeers(args []string) error {
+	var output, api string
+	cfg, _, err := parseFlags("peers", args, false, func(flags *pflag.FlagSet) {
+		flags.StringVarP(&output, "output", "o", textOutput, "output format, text or json")
+		flags.StringVar(&api, "api", "", "api address of the running node, defaults to the local web server")
+	})
+	if err != nil {
+		return err
+	}
+
+	body, err := callAPI(http.MethodGet, apiAddress(cfg, api)+"/peers")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var peers serverHTTP.PeersResponse
+	if err = json.NewDecoder(body).Decode(&peers); err != nil {
+		return fmt.Errorf("error decoding peers: %s", err)
+	}
+	if output == jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(peers)
+	}
+	for _, peer := range peers.Peers {
+		fmt.Println(peer)
+	}
+	return nil
+}
+
+// runGet fetches a file from a peer through a running node, writing it to stdout or a file
+func runGet(args []string) error {
+	var outFile, api string
+	cfg, flags, err := parseFlags("get", args, false, func(flags *pflag.FlagSet) {
+		flags.StringVarP(&outFile, "out", "O", "", "file to write to, defaults to stdout")
+		flags.StringVar(&api, "api", "", "api address of the running node, defaults to the local web server")
+	})
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || !strings.Contains(flags.Arg(0), "/") {
+		return fmt.Errorf("usage: get <user>/<path>")
+	}
+
+	body, err := callAPI(http.MethodGet, apiAddress(cfg, api)+"/files/"+(&url.URL{Path: flags.Arg(0)}).EscapedPath())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		file, err := os.Create(outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	_, err = io.Copy(out, body)
+	return err
+}
+
+// runDownload has a running node download a file from a peer, printing its progress and then where it was saved
+func runDownload(args []string) error {
+	var api string
+	cfg, flags, err := parseFlags("download", args, false, func(flags *pflag.FlagSet) {
+		flags.StringVar(&api, "api", "", "api address of the running node, defaults to the local web server")
+	})
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || !strings.Contains(flags.Arg(0), "/") {
+		return fmt.Errorf("usage: download <user>/<path>")
+	}
+
+	base := apiAddress(cfg, api)
+	body, err := callAPI(http.MethodPost, base+"/downloads/"+(&url.URL{Path: flags.Arg(0)}).EscapedPath())
+	if err != nil {
+		return err
+	}
+	var download share.Download
+	err = json.NewDecoder(body).Decode(&download)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("error decoding download: %s", err)
+	}
+
+	for download.State == share.DownloadRunning {
+		if download.Size > 0 {
+			fmt.Fprintf(os.Stderr, "\r%s: %3d%% of %d bytes", download.Path, download.Done*100/download.Size, download.Size)
+		}
+		time.Sleep(downloadPollInterval)
+		if download, err = getDownload(base, download.Path); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+	switch download.State {
+	case share.DownloadComplete:
+		_, err = fmt.Println(download.File)
+		return err
+	case share.DownloadCancelled:
+		return fmt.Errorf("download of %s was cancelled, run download again to resume it", download.Path)
+	default:
+		return fmt.Errorf("download of %s failed: %s", download.Path, download.Error)
+	}
+}
+
+// getDownload returns the progress of a download started on a running node
+func getDownload(base, path string) (share.Download, error) {
+	body, err := callAPI(http.MethodGet, base+"/downloads")
+	if err != nil {
+		return share.Download{}, err
+	}
+	defer body.Close()
+	var downloads serverHTTP.DownloadsResponse
+	if err = json.NewDecoder(body).Decode(&downloads); err != nil {
+		return share.Download{}, fmt.Errorf("error decoding downloads: %s", err)
+	}
+	for _, download := range downloads.Downloads {
+		if download.Path == path {
+			return download, nil
+		}
+	}
+	return share.Download{}, fmt.Errorf("the node no longer knows of the download of %s, was it restarted?", path)
+}
+
+// runId prints the peer ID of the node
+func runId(args []string) error {
+	var output string
+	cfg, _, err := parseFlags("id", args, false, func(flags *pflag.FlagSet) {
+		flags.StringVarP(&output, "output", "o", textOutput, "output format, text or json")
+	})
+	if err != nil {
+		return err
+	}
+
+	dcfg := cfg.DistributedSystem
+	if dcfg.KeyFile == "" && !dcfg.Debug {
+		fmt.Fprintln(os.Stderr, "warning: neither KEY_FILE nor DEBUG is set, the node gets a new peer ID on every start")
+	}
+	prvKey, err := remote.Identity(dcfg)
+	if err != nil {
+		return err
+	}
+	peerId, err := remote.PeerId(prvKey)
+	if err != nil {
+		return err
+	}
+
+	if output == jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(map[string]string{"peer_id": peerId, "key_file": dcfg.KeyFile})
+	}
+	_, err = fmt.Println(peerId)
+	return err
+}
+
+// apiAddress returns the base api url of the node described by cfg, unless overridden
+func apiAddress(cfg config.Config, override string) string {
+	if override != "" {
+		return strings.TrimSuffix(override, "/")
+	}
+	return fmt.Sprintf("http://localhost:%d%s", cfg.DistributedSystem.LocalWebServerPort, cfg.HTTPServer.URLPrefix)
+}
+
+// callAPI makes a request to a running node, turning api errors into go errors
+func callAPI(method, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req) // nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("error calling node api, is the node running? %s", err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	var apiErr serverHTTP.ErrorResponse
+	if err = json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return nil, fmt.Errorf("node api returned status %s", resp.Status)
+	}
+	return nil, fmt.Errorf("node api error: %s", apiErr.Error)
+}
@@ -1,13 +1,37 @@
 package config
 
 import (
+	"net"
+	"strings"
+
 	"github.com/mungujn/web-exp/app"
+	"github.com/mungujn/web-exp/config/validate"
 	"github.com/mungujn/web-exp/server"
 )
 
 // Config houses all the configurations for the application
 type Config struct {
 	LogLevel          string        `mapstructure:"LOG_LEVEL" default:"DEBUG"`
+	TracingEndpoint   string        `mapstructure:"TRACING_ENDPOINT" default:""`
 	HTTPServer        server.Config `mapstructure:"HTTP_SERVER"`
 	DistributedSystem app.Config    `mapstructure:"DISTRIBUTED_SYSTEM"`
 }
+
+// Validate checks the whole configuration and reports every problem found.
+// Problems in nested configurations are named by their full environment variable.
+func (c Config) Validate() error {
+	var errs validate.Errors
+	switch strings.ToLower(c.LogLevel) {
+	case "error", "info", "trace", "debug":
+	default:
+		errs.Add("LOG_LEVEL", "%q is not one of ERROR, INFO, TRACE or DEBUG", c.LogLevel)
+	}
+	if c.TracingEndpoint != "" {
+		if _, _, err := net.SplitHostPort(c.TracingEndpoint); err != nil {
+			errs.Add("TRACING_ENDPOINT", "%q is not a host:port address: %s", c.TracingEndpoint, err)
+		}
+	}
+	errs.Merge("HTTP_SERVER_", c.HTTPServer.Validate())
+	errs.Merge("DISTRIBUTED_SYSTEM_", c.DistributedSystem.Validate())
+	return errs.Err()
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/app"
+	"github.com/mungujn/web-exp/config/validate"
+	"github.com/mungujn/web-exp/server"
+)
+
+func getTestConfig(t *testing.T) Config {
+	return Config{
+		LogLevel: "INFO",
+		HTTPServer: server.Config{
+			Port:            8080,
+			URLPrefix:       "/api",
+			CORSAllowedHost: "*",
+		},
+		DistributedSystem: app.Config{
+			Username:           "me",
+			LocalRootFolder:    t.TempDir(),
+			LocalWebServerPort: 8080,
+			LocalNodeHost:      "0.0.0.0",
+			LocalNodePort:      4040,
+			NetworkName:        "local",
+			ProtocolId:         "localfiles",
+			ProtocolVersion:    "0.1",
+			MaxFrameSize:       1 << 20,
+		},
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	cases := []struct {
+		Name             string
+		Modify           func(cfg *Config)
+		ExpectedProblems validate.Errors
+	}{
+		{
+			Name:   "valid config",
+			Modify: func(cfg *Config) {},
+		},
+		{
+			Name:   "unknown log level",
+			Modify: func(cfg *Config) { cfg.LogLevel = "loud" },
+			ExpectedProblems: validate.Errors{
+				`LOG_LEVEL: "loud" is not one of ERROR, INFO, TRACE or DEBUG`,
+			},
+		},
+		{
+			Name:   "empty username",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.Username = "" },
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_USERNAME: must not be empty",
+			},
+		},
+		{
+			Name:   "markup in username",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.Username = "<script>" },
+			ExpectedProblems: validate.Errors{
+				`DISTRIBUTED_SYSTEM_USERNAME: "<script>" may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit`,
+			},
+		},
+		{
+			Name:   "isolated origins",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.IsolateOrigins = true },
+		},
+		{
+			Name:   "missing root folder",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.LocalRootFolder = "" },
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_LOCAL_ROOT_FOLDER: must not be empty unless SHARES is set",
+			},
+		},
+		{
+			Name: "named shares only",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.Shares = "docs=" + cfg.DistributedSystem.LocalRootFolder
+				cfg.DistributedSystem.LocalRootFolder = ""
+			},
+		},
+		{
+			Name: "bad shares",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.Shares = "docs=does_not_exist, docs=" + cfg.DistributedSystem.LocalRootFolder
+			},
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_SHARES: folder does_not_exist can not be read: " +
+					"stat does_not_exist: no such file or directory",
+				"DISTRIBUTED_SYSTEM_SHARES: share docs is defined more than once",
+			},
+		},
+		{
+			Name: "access list of users claiming any peer ID",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.Shares = "docs=" + cfg.DistributedSystem.LocalRootFolder + ";allow=bob"
+				cfg.DistributedSystem.InboxFolder = cfg.DistributedSystem.LocalRootFolder
+				cfg.DistributedSystem.InboxMaxSize = 1
+				cfg.DistributedSystem.InboxAllowed = "carol"
+			},
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_SHARES: share docs allows bob, who has to be pinned to a peer ID in KNOWN_PEERS",
+				"DISTRIBUTED_SYSTEM_INBOX_ALLOWED_UPLOADERS: carol has to be pinned to a peer ID in KNOWN_PEERS",
+			},
+		},
+		{
+			Name: "access list of pinned users",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.Shares = "docs=" + cfg.DistributedSystem.LocalRootFolder + ";allow=bob"
+				cfg.DistributedSystem.KnownPeers = "bob=QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ"
+			},
+		},
+		{
+			Name:   "malformed known peers",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.KnownPeers = "bob=nobody" },
+			ExpectedProblems: validate.Errors{
+				`DISTRIBUTED_SYSTEM_KNOWN_PEERS: known peer "bob=nobody": "nobody" is not a peer ID`,
+			},
+		},
+		{
+			Name:   "malformed shares",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.Shares = "docs" },
+			ExpectedProblems: validate.Errors{
+				`DISTRIBUTED_SYSTEM_SHARES: share "docs" is not of the form name=path`,
+			},
+		},
+		{
+			Name:   "root folder does not exist",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.LocalRootFolder = "does_not_exist" },
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_LOCAL_ROOT_FOLDER: folder does_not_exist can not be read: " +
+					"stat does_not_exist: no such file or directory",
+			},
+		},
+		{
+			Name: "bridge without root folder",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.RunBridge = true
+				cfg.DistributedSystem.LocalRootFolder = "does_not_exist"
+			},
+		},
+		{
+			Name: "bridge with bad bootstrap peer",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.RunBridge = true
+				cfg.DistributedSystem.LocalRootFolder = ""
+				cfg.DistributedSystem.CustomBootstrapPeer = "not-a-multiaddr"
+			},
+			ExpectedProblems: validate.Errors{
+				`DISTRIBUTED_SYSTEM_CUSTOM_BOOTSTRAP_PEER: "not-a-multiaddr" is not a valid multiaddr: ` +
+					"failed to parse multiaddr \"not-a-multiaddr\": must begin with /",
+			},
+		},
+		{
+			Name:   "duplicate ports",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.LocalNodePort = 8080 },
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_LOCAL_NODE_PORT: port 8080 is already used by LOCAL_WEB_SERVER_PORT",
+			},
+		},
+		{
+			Name:   "no frame size",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.MaxFrameSize = 0 },
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_MAX_FRAME_SIZE: must be greater than 0",
+			},
+		},
+		{
+			Name: "pins without mirror folder",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.Pins = "alice/docs, me"
+				cfg.DistributedSystem.MirrorInterval = 300
+			},
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_PINS: needs MIRROR_FOLDER to keep the pinned files in",
+				"DISTRIBUTED_SYSTEM_PINS: pin me is of the current user",
+			},
+		},
+		{
+			Name: "pins",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.Pins = "alice/docs"
+				cfg.DistributedSystem.MirrorFolder = t.TempDir()
+				cfg.DistributedSystem.MirrorInterval = 300
+			},
+		},
+		{
+			Name:   "missing download folder",
+			Modify: func(cfg *Config) { cfg.DistributedSystem.DownloadFolder = "/does/not/exist" },
+			ExpectedProblems: validate.Errors{
+				"DISTRIBUTED_SYSTEM_DOWNLOAD_FOLDER: folder /does/not/exist can not be read: stat /does/not/exist: no such file or directory",
+			},
+		},
+		{
+			Name:   "tracing endpoint without port",
+			Modify: func(cfg *Config) { cfg.TracingEndpoint = "localhost" },
+			ExpectedProblems: validate.Errors{
+				`TRACING_ENDPOINT: "localhost" is not a host:port address: address localhost: missing port in address`,
+			},
+		},
+		{
+			Name:   "metrics on the web server port",
+			Modify: func(cfg *Config) { cfg.HTTPServer.MetricsPort = cfg.HTTPServer.Port },
+			ExpectedProblems: validate.Errors{
+				"HTTP_SERVER_METRICS_PORT: port 8080 is already used by the web server, set 0 to serve metrics on it",
+			},
+		},
+		{
+			Name:   "writable webdav without webdav",
+			Modify: func(cfg *Config) { cfg.HTTPServer.WebDAVWritable = true },
+			ExpectedProblems: validate.Errors{
+				"HTTP_SERVER_WEBDAV_WRITABLE: needs WEBDAV to be set",
+			},
+		},
+		{
+			Name: "bad bootstrap peer",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.RunGlobal = true
+				cfg.DistributedSystem.CustomBootstrapPeer = "not-a-multiaddr"
+			},
+			ExpectedProblems: validate.Errors{
+				`DISTRIBUTED_SYSTEM_CUSTOM_BOOTSTRAP_PEER: "not-a-multiaddr" is not a valid multiaddr: ` +
+					"failed to parse multiaddr \"not-a-multiaddr\": must begin with /",
+			},
+		},
+		{
+			Name: "every problem is reported",
+			Modify: func(cfg *Config) {
+				cfg.DistributedSystem.LocalWebServerPort = 0
+				cfg.HTTPServer.URLPrefix = "api"
+				cfg.DistributedSystem.LocalNodeHost = "localhost"
+				cfg.DistributedSystem.LocalNodePort = 70000
+				cfg.DistributedSystem.NetworkName = ""
+			},
+			ExpectedProblems: validate.Errors{
+				`HTTP_SERVER_URL_PREFIX: "api" must start with /`,
+				"DISTRIBUTED_SYSTEM_NETWORK_NAME: must not be empty",
+				"DISTRIBUTED_SYSTEM_LOCAL_NODE_PORT: port 70000 is out of range, must be between 1 and 65535",
+				`DISTRIBUTED_SYSTEM_LOCAL_NODE_HOST: "localhost" is not an IP address`,
+				"DISTRIBUTED_SYSTEM_LOCAL_WEB_SERVER_PORT: port 0 is out of range, must be between 1 and 65535",
+			},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			cfg := getTestConfig(t)
+			testCase.Modify(&cfg)
+			err := cfg.Validate()
+			if testCase.ExpectedProblems == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, testCase.ExpectedProblems, err)
+		})
+	}
+}
@@ -1,11 +1,31 @@
 package config
 
 import (
+	"github.com/spf13/pflag"
+
 	"github.com/mungujn/web-exp/config/reader"
 )
 
-func Read() (Config, error) {
+// Read reads the configuration from the environment and flags and validates it
+func Read(flags *pflag.FlagSet) (Config, error) {
+	cfg, err := Load(flags)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// Load reads the configuration from the environment and flags without validating it.
+// Flags must have been defined with DefineFlags, flags may be nil.
+func Load(flags *pflag.FlagSet) (Config, error) {
 	var cfg Config
-	err := reader.Read(&cfg)
+	err := reader.ReadWithFlags(&cfg, flags)
+	// the web server listens on the port its pages link to
+	cfg.HTTPServer.Port = cfg.DistributedSystem.LocalWebServerPort
 	return cfg, err
 }
+
+// DefineFlags defines a command line flag overriding each configuration field
+func DefineFlags(flags *pflag.FlagSet) error {
+	return reader.DefineFlags(flags, &Config{})
+}
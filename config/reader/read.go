@@ -2,9 +2,11 @@ package reader
 
 import (
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -13,10 +15,18 @@ const (
 	defaultTagName        = "default"
 	squashTagValue        = ",squash"
 	mapStructureTagName   = "mapstructure"
+	flagKeyAnnotation     = "config_key"
+	skipTagValue          = "-"
 )
 
 // Read reads configs to use during run
 func Read(config interface{}, opts ...viper.DecoderConfigOption) error {
+	return ReadWithFlags(config, nil, opts...)
+}
+
+// ReadWithFlags reads configs to use during run, letting command line flags
+// defined by DefineFlags override the environment
+func ReadWithFlags(config interface{}, flags *pflag.FlagSet, opts ...viper.DecoderConfigOption) error {
 	v := viper.New()
 	v.SetEnvKeyReplacer(strings.NewReplacer(viperDefaultDelimiter, "_")) // replace default viper delimiter for env vars
 	v.AutomaticEnv()
@@ -25,6 +35,12 @@ func Read(config interface{}, opts ...viper.DecoderConfigOption) error {
 	if err != nil {
 		return errors.WithMessage(err, "failed to apply defaults")
 	}
+	if flags != nil {
+		err = bindFlags(v, flags)
+		if err != nil {
+			return errors.WithMessage(err, "failed to bind flags")
+		}
+	}
 	err = v.Unmarshal(config, opts...)
 	if err != nil {
 		return errors.WithMessage(err, "failed to parse configuration")
@@ -32,17 +48,31 @@ func Read(config interface{}, opts ...viper.DecoderConfigOption) error {
 	return nil
 }
 
+// DefineFlags defines a command line flag for every config field, named after
+// its mapstructure tag, e.g. LOCAL_ROOT_FOLDER becomes --local-root-folder.
+// Fields whose flag name is already taken are reported rather than left without a flag.
+func DefineFlags(flags *pflag.FlagSet, config interface{}) error {
+	return defineFlags("", flags, reflect.StructField{}, reflect.ValueOf(config).Elem())
+}
+
+// bindFlags binds every flag defined by DefineFlags to its config key
+func bindFlags(vip *viper.Viper, flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		keys, ok := flag.Annotations[flagKeyAnnotation]
+		if !ok || err != nil {
+			return
+		}
+		err = vip.BindPFlag(keys[0], flag)
+	})
+	return err
+}
+
 // setDefaults sets default values for struct fields based using value from default tag
 // nolint:gocyclo
 func setDefaults(parentName string, vip *viper.Viper, t reflect.StructField, v reflect.Value) error {
 	if v.Kind() == reflect.Struct {
-		value, ok := t.Tag.Lookup(mapStructureTagName)
-		if ok && value != squashTagValue {
-			if parentName != "" {
-				parentName += viperDefaultDelimiter
-			}
-			parentName += strings.ToUpper(value)
-		}
+		parentName = nestedName(parentName, t)
 		for i := 0; i < v.NumField(); i++ {
 			if err := setDefaults(parentName, vip, v.Type().Field(i), v.Field(i)); err != nil {
 				return err
@@ -52,7 +82,7 @@ func setDefaults(parentName string, vip *viper.Viper, t reflect.StructField, v r
 	}
 	value, _ := t.Tag.Lookup(defaultTagName)
 	fieldName, ok := t.Tag.Lookup(mapStructureTagName)
-	if ok && fieldName != squashTagValue {
+	if ok && fieldName != squashTagValue && fieldName != skipTagValue {
 		if parentName != "" {
 			fieldName = parentName + viperDefaultDelimiter + strings.ToUpper(fieldName)
 		}
@@ -60,3 +90,57 @@ func setDefaults(parentName string, vip *viper.Viper, t reflect.StructField, v r
 	}
 	return nil
 }
+
+// defineFlags defines a typed flag for every struct field, annotated with the fields config key
+func defineFlags(parentName string, flags *pflag.FlagSet, t reflect.StructField, v reflect.Value) error {
+	if v.Kind() == reflect.Struct {
+		parentName = nestedName(parentName, t)
+		for i := 0; i < v.NumField(); i++ {
+			if err := defineFlags(parentName, flags, v.Type().Field(i), v.Field(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fieldName, ok := t.Tag.Lookup(mapStructureTagName)
+	if !ok || fieldName == squashTagValue || fieldName == skipTagValue {
+		return nil
+	}
+	key := strings.ToUpper(fieldName)
+	if parentName != "" {
+		key = parentName + viperDefaultDelimiter + key
+	}
+	name := strings.ReplaceAll(strings.ToLower(fieldName), "_", "-")
+	env := strings.ReplaceAll(key, viperDefaultDelimiter, "_")
+	if flags.Lookup(name) != nil {
+		return errors.Errorf("flag --%s of %s is already defined", name, env)
+	}
+	value, _ := t.Tag.Lookup(defaultTagName)
+	usage := "overrides " + env
+	switch v.Kind() {
+	case reflect.Bool:
+		b, _ := strconv.ParseBool(value)
+		flags.Bool(name, b, usage)
+	case reflect.Int:
+		i, _ := strconv.Atoi(value)
+		flags.Int(name, i, usage)
+	case reflect.Int64:
+		i, _ := strconv.ParseInt(value, 10, 64)
+		flags.Int64(name, i, usage)
+	default:
+		flags.String(name, value, usage)
+	}
+	return flags.SetAnnotation(name, flagKeyAnnotation, []string{key})
+}
+
+// nestedName returns the config key prefix for the fields of a nested struct
+func nestedName(parentName string, t reflect.StructField) string {
+	value, ok := t.Tag.Lookup(mapStructureTagName)
+	if ok && value != squashTagValue {
+		if parentName != "" {
+			parentName += viperDefaultDelimiter
+		}
+		parentName += strings.ToUpper(value)
+	}
+	return parentName
+}
@@ -0,0 +1,109 @@
+package reader
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+type nestedConfig struct {
+	Name  string `mapstructure:"NAME"  default:"nested"`
+	Count int    `mapstructure:"COUNT"  default:"1"`
+}
+
+type testConfig struct {
+	Enabled bool         `mapstructure:"ENABLED"  default:"false"`
+	Nested  nestedConfig `mapstructure:"NESTED"`
+}
+
+func Test_ReadWithFlags(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Env      map[string]string
+		Args     []string
+		Expected testConfig
+	}{
+		{
+			Name:     "defaults",
+			Expected: testConfig{Nested: nestedConfig{Name: "nested", Count: 1}},
+		},
+		{
+			Name:     "env overrides defaults",
+			Env:      map[string]string{"NESTED_NAME": "from-env"},
+			Expected: testConfig{Nested: nestedConfig{Name: "from-env", Count: 1}},
+		},
+		{
+			Name:     "flags override env",
+			Env:      map[string]string{"NESTED_NAME": "from-env", "ENABLED": "false"},
+			Args:     []string{"--name", "from-flag", "--count", "3", "--enabled"},
+			Expected: testConfig{Enabled: true, Nested: nestedConfig{Name: "from-flag", Count: 3}},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			for key, value := range testCase.Env {
+				t.Setenv(key, value)
+			}
+			flags := pflag.NewFlagSet(testCase.Name, pflag.ContinueOnError)
+			assert.NoError(t, DefineFlags(flags, &testConfig{}))
+			assert.NoError(t, flags.Parse(testCase.Args))
+
+			var cfg testConfig
+			err := ReadWithFlags(&cfg, flags)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, cfg)
+		})
+	}
+}
+
+type collidingConfig struct {
+	Name   string       `mapstructure:"NAME"  default:"top"`
+	Nested nestedConfig `mapstructure:"NESTED"`
+}
+
+type skippedConfig struct {
+	Port   int          `mapstructure:"-"`
+	Nested nestedConfig `mapstructure:"NESTED"`
+}
+
+func Test_DefineFlags(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Config        interface{}
+		ExpectedFlags []string
+		ExpectedError string
+	}{
+		{
+			Name:          "flag per field",
+			Config:        &testConfig{},
+			ExpectedFlags: []string{"count", "enabled", "name"},
+		},
+		{
+			Name:          "skipped fields",
+			Config:        &skippedConfig{},
+			ExpectedFlags: []string{"count", "name"},
+		},
+		{
+			Name:          "colliding names",
+			Config:        &collidingConfig{},
+			ExpectedError: "flag --name of NESTED_NAME is already defined",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			flags := pflag.NewFlagSet(testCase.Name, pflag.ContinueOnError)
+			err := DefineFlags(flags, testCase.Config)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			var names []string
+			flags.VisitAll(func(flag *pflag.Flag) { names = append(names, flag.Name) })
+			assert.Equal(t, testCase.ExpectedFlags, names)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors collects every problem found in a configuration so they can be reported together
+type Errors []string
+
+// Error lists all collected problems, one per line
+func (e Errors) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// Add records a problem with the named setting
+func (e *Errors) Add(setting, format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf("%s: %s", setting, fmt.Sprintf(format, args...)))
+}
+
+// Merge records the problems of a nested configuration, prefixing each with the nested settings name
+func (e *Errors) Merge(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	var nested Errors
+	if !errors.As(err, &nested) {
+		*e = append(*e, prefix+err.Error())
+		return
+	}
+	for _, problem := range nested {
+		*e = append(*e, prefix+problem)
+	}
+}
+
+// Err returns nil when no problems were recorded
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Port records a problem if port is not a usable TCP port
+func (e *Errors) Port(setting string, port int) {
+	if port < 1 || port > 65535 {
+		e.Add(setting, "port %d is out of range, must be between 1 and 65535", port)
+	}
+}
+
+// NotEmpty records a problem if value is empty or only whitespace
+func (e *Errors) NotEmpty(setting, value string) {
+	if strings.TrimSpace(value) == "" {
+		e.Add(setting, "must not be empty")
+	}
+}
@@ -2,20 +2,30 @@ package local
 
 import (
 	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/share"
 )
 
 type LocalFilesystem struct {
 	rootFolder string
+	shares     share.Shares
+	index      *share.Index
 }
 
-func New(rootFolder string) *LocalFilesystem {
+// New creates a local file system serving rootFolder as the default share, along with any named shares
+func New(rootFolder string, shares ...share.Share) *LocalFilesystem {
 	log.Debug("setting up local file system to serve from root folder: ", rootFolder)
-	return &LocalFilesystem{
+	lfs := &LocalFilesystem{
 		rootFolder: rootFolder,
+		shares:     append(share.Shares{{Name: share.DefaultName, Root: rootFolder, ReadOnly: true}}, shares...),
 	}
+	lfs.index = share.NewIndex(lfs.shares, true)
+	return lfs
 }
 
 func (lfs *LocalFilesystem) StartHost(ctx context.Context) error {
@@ -23,16 +33,104 @@ func (lfs *LocalFilesystem) StartHost(ctx context.Context) error {
 }
 
 func (lfs *LocalFilesystem) GetFile(ctx context.Context, username, path string) ([]byte, error) {
-	var fullPath string
 	if username == "" {
-		fullPath = lfs.rootFolder + "/" + path
-	} else {
-		fullPath = lfs.rootFolder + "/" + username + "/" + path
+		log.Debug("reading shared file: ", path)
+		return lfs.shares.ReadFile(share.Self, path)
 	}
+	fullPath := lfs.rootFolder + "/" + username + "/" + path
 	log.Debug("reading file: ", fullPath)
 	return ioutil.ReadFile(fullPath)
 }
 
+// GetRange reads part of a shared file, or of a file in the folder of another user
+func (lfs *LocalFilesystem) GetRange(ctx context.Context, username, path string, offset, length int64) ([]byte, error) {
+	if username == "" {
+		return lfs.shares.ReadRange(share.Self, path, offset, length)
+	}
+	users := share.Shares{{Name: share.DefaultName, Root: lfs.rootFolder + "/" + username}}
+	return users.ReadRange(share.Self, path, offset, length)
+}
+
+// ListFolder lists a shared folder, or a folder in the folder of another user
+func (lfs *LocalFilesystem) ListFolder(ctx context.Context, username, path string) ([]share.FileInfo, error) {
+	if username == "" {
+		return lfs.shares.List(share.Self, path)
+	}
+	users := share.Shares{{Name: share.DefaultName, Root: lfs.rootFolder + "/" + username}}
+	return users.List(share.Self, path)
+}
+
+// Stat describes a shared file, or a file in the folder of another user
+func (lfs *LocalFilesystem) Stat(ctx context.Context, username, path string) (share.FileStat, error) {
+	if username == "" {
+		return lfs.shares.Stat(share.Self, path)
+	}
+	users := share.Shares{{Name: share.DefaultName, Root: lfs.rootFolder + "/" + username}}
+	return users.Stat(share.Self, path)
+}
+
+// GetArchive writes an archive of a shared folder, or of a folder in the folder of another user
+func (lfs *LocalFilesystem) GetArchive(ctx context.Context, username, path, format string, w io.Writer) error {
+	shares := lfs.shares
+	if username != "" {
+		shares = share.Shares{{Name: share.DefaultName, Root: lfs.rootFolder + "/" + username}}
+	}
+	archive, err := shares.Archive(share.Self, path, format)
+	if err != nil {
+		return err
+	}
+	if archive.Name == "" {
+		archive.Name = username
+	}
+	return archive.Write(w)
+}
+
+func (lfs *LocalFilesystem) PutFile(ctx context.Context, username, path string, content io.Reader, size int64) error {
+	return errors.New("uploads to other users are not supported by the local file system")
+}
+
+// Readiness reports the local file system as always ready, it has no network to start
+func (lfs *LocalFilesystem) Readiness() []share.Check {
+	return []share.Check{{Name: "host", OK: true, Detail: "local file system"}}
+}
+
 func (lfs *LocalFilesystem) GetOnlineNodes() []string {
 	return []string{"user_2", "user_3"}
 }
+
+// GetPeers returns the fake users of GetOnlineNodes, always online and without shares
+func (lfs *LocalFilesystem) GetPeers() []share.Peer {
+	peers := make([]share.Peer, 0)
+	for _, username := range lfs.GetOnlineNodes() {
+		peers = append(peers, share.Peer{Username: username, Online: true, Shares: lfs.GetShares(username)})
+	}
+	return peers
+}
+
+// Search searches the shares of the current user, other users never have any matching files
+func (lfs *LocalFilesystem) Search(ctx context.Context, username, query string) ([]share.SearchResult, error) {
+	if username == "" {
+		return lfs.index.Search(query, share.Self), nil
+	}
+	return []share.SearchResult{}, nil
+}
+
+// Manifest lists the files of the current user, other users never have any files to list
+func (lfs *LocalFilesystem) Manifest(ctx context.Context, username, prefix string) ([]share.ManifestEntry, error) {
+	if username == "" {
+		return lfs.shares.Manifest(share.Self, prefix)
+	}
+	return []share.ManifestEntry{}, nil
+}
+
+// Changes never reports any change, the local file system is not watched
+func (lfs *LocalFilesystem) Changes() <-chan share.Change {
+	return nil
+}
+
+func (lfs *LocalFilesystem) GetShares(username string) []string {
+	if username == "" {
+		return lfs.shares.Names()
+	}
+	return []string{}
+}
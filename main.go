@@ -1,70 +1,44 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
-
-	"github.com/mungujn/web-exp/config"
-	"github.com/mungujn/web-exp/remote"
-	serverHTTP "github.com/mungujn/web-exp/server"
-	"github.com/mungujn/web-exp/app"
 )
 
 // main is the entry point of the application
-func main() { // nolint:funlen,gocyclo
-	// read service cfg from os env
-	cfg, err := config.Read()
-	if err != nil {
-		panic(err)
+func main() {
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	// init logger
-	initLogger(cfg.LogLevel)
-
-	log.Info("service starting...")
-
-	// prepare main context
-	ctx, cancel := context.WithCancel(context.Background())
-	setupGracefulShutdown(cancel)
-
-	// init distributed capabilites provider
-	dcfg := cfg.DistributedSystem
-	provider := remote.New(dcfg)
-	err = provider.StartHost(ctx)
-	if err != nil {
-		log.WithError(err).Fatal("host init error")
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
 	}
 
-	// init distributed system
-	app, err := app.New(ctx, dcfg, provider)
-	if err != nil {
-		log.WithError(err).Fatal("app init error")
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+}
 
-	// init http server
-	cfg.HTTPServer.Port = dcfg.LocalWebServerPort
-	httpSrv, err := serverHTTP.New(
-		cfg.HTTPServer,
-		app,
-	)
-	if err != nil {
-		log.WithError(err).Error("http server init error, http web server will not be available")
+// printUsage lists the available commands
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: locals <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range commandNames {
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", commands[name].usage, commands[name].description)
 	}
-
-	var wg = &sync.WaitGroup{}
-
-	// run srv
-	httpSrv.Run(ctx, wg)
-
-	// wait while services work
-	wg.Wait()
-	log.Info("service stopped")
+	fmt.Fprintln(os.Stderr, "\nrun locals <command> --help to list the flags of a command")
 }
 
 // initLogger initializes logger
@@ -0,0 +1,208 @@
+package markdown
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"path"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+const (
+	// ReadmeFile is served as a folders index when it has no index.html
+	ReadmeFile = "README.md"
+
+	doctype = "<!DOCTYPE html>"
+)
+
+// Page describes where a rendered markdown file is served from.
+// Both paths are relative to the owners root, that is the part of the url after /{username}/
+type Page struct {
+	// RequestPath is the path the page is served under
+	RequestPath string
+	// FilePath is the path of the markdown file, it differs from RequestPath for README.md folder indexes
+	FilePath string
+	// LinkQuery is added to links to other markdown files, so that they are rendered too
+	LinkQuery string
+}
+
+type heading struct {
+	level int
+	id    string
+	text  string
+}
+
+var converter = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+)
+
+// IsMarkdown reports whether path names a markdown file
+func IsMarkdown(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".md")
+}
+
+// IsPage reports whether data is already a rendered page rather than markdown source
+func IsPage(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(doctype))
+}
+
+// Render converts markdown source to a html page with a list of its headings.
+// Raw html in the source is dropped and links are rewritten relative to the
+// page so that they never leave the owners root.
+func Render(source []byte, page Page) ([]byte, error) {
+	doc := converter.Parser().Parse(text.NewReader(source))
+
+	headings := make([]heading, 0)
+	err := ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := node.(type) {
+		case *ast.Heading:
+			id, _ := n.AttributeString("id")
+			idBytes, _ := id.([]byte)
+			headings = append(headings, heading{level: n.Level, id: string(idBytes), text: strings.TrimSpace(string(n.Text(source)))})
+		case *ast.Link:
+			n.Destination = []byte(page.rewriteLink(string(n.Destination), true))
+		case *ast.Image:
+			n.Destination = []byte(page.rewriteLink(string(n.Destination), false))
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	if err := converter.Renderer().Render(&body, source, doc); err != nil {
+		return nil, err
+	}
+
+	title := path.Base(page.FilePath)
+	if len(headings) > 0 && headings[0].level == 1 {
+		title = headings[0].text
+	}
+
+	var out bytes.Buffer
+	out.WriteString(doctype + "\n<html>\n<head>\n")
+	out.WriteString("<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&out, "<title>%s</title>\n", html.EscapeString(title))
+	out.WriteString(style)
+	out.WriteString("</head>\n<body>\n")
+	out.WriteString(renderHeadings(headings))
+	out.WriteString("<article>\n")
+	out.Write(body.Bytes())
+	out.WriteString("</article>\n</body>\n</html>\n")
+	return out.Bytes(), nil
+}
+
+func renderHeadings(headings []heading) string {
+	if len(headings) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("<nav class=\"headings\">\n<ul>\n")
+	for _, h := range headings {
+		fmt.Fprintf(&out, "<li class=\"level-%d\"><a href=\"#%s\">%s</a></li>\n",
+			h.level, html.EscapeString(h.id), html.EscapeString(h.text))
+	}
+	out.WriteString("</ul>\n</nav>\n")
+	return out.String()
+}
+
+// rewriteLink turns a link in the markdown file into a link relative to the page,
+// leaving fragments and links to other sites alone
+func (p Page) rewriteLink(link string, followMarkdown bool) string {
+	if link == "" || strings.HasPrefix(link, "#") || strings.HasPrefix(link, "//") || hasScheme(link) {
+		return link
+	}
+
+	fragment := ""
+	if i := strings.Index(link, "#"); i >= 0 {
+		link, fragment = link[:i], link[i:]
+	}
+	query := ""
+	if i := strings.Index(link, "?"); i >= 0 {
+		link, query = link[:i], link[i:]
+	}
+
+	var target string
+	if strings.HasPrefix(link, "/") {
+		target = path.Clean(link)
+	} else {
+		target = path.Join("/", path.Dir(p.FilePath), link)
+	}
+	if strings.HasSuffix(link, "/") && target != "/" {
+		target += "/"
+	}
+
+	if followMarkdown && query == "" && p.LinkQuery != "" && IsMarkdown(target) {
+		query = "?" + p.LinkQuery
+	}
+	return relativeTo(p.baseDir(), target) + query + fragment
+}
+
+// baseDir is the folder a browser resolves relative links against when showing the page
+func (p Page) baseDir() string {
+	if strings.HasSuffix(p.RequestPath, "/") {
+		return path.Clean("/" + p.RequestPath)
+	}
+	return path.Dir("/" + p.RequestPath)
+}
+
+// relativeTo returns the relative url of target as seen from the folder base, both being absolute paths
+func relativeTo(base, target string) string {
+	baseParts := splitPath(base)
+	targetParts := splitPath(target)
+	isFolder := strings.HasSuffix(target, "/")
+	folders := len(targetParts) - 1
+	if isFolder {
+		folders = len(targetParts)
+	}
+	common := 0
+	for common < len(baseParts) && common < folders && baseParts[common] == targetParts[common] {
+		common++
+	}
+	rel := strings.Repeat("../", len(baseParts)-common) + strings.Join(targetParts[common:], "/")
+	if isFolder && rel != "" && !strings.HasSuffix(rel, "/") {
+		rel += "/"
+	}
+	if rel == "" {
+		return "./"
+	}
+	return rel
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// hasScheme reports whether link starts with a url scheme such as https: or mailto:
+func hasScheme(link string) bool {
+	i := strings.Index(link, ":")
+	return i > 0 && !strings.ContainsAny(link[:i], "/?#")
+}
+
+const style = `<style>
+body { font-family: sans-serif; max-width: 60em; margin: 0 auto; padding: 1em; display: flex; gap: 2em; }
+nav.headings { flex: 0 0 14em; font-size: 0.9em; }
+nav.headings ul { list-style: none; padding: 0; }
+nav.headings .level-2 { padding-left: 1em; }
+nav.headings .level-3, nav.headings .level-4, nav.headings .level-5, nav.headings .level-6 { padding-left: 2em; }
+article { flex: 1; min-width: 0; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; }
+</style>
+`
@@ -0,0 +1,85 @@
+package markdown
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Render(t *testing.T) {
+	source, err := ioutil.ReadFile("test_data/notes.md")
+	assert.NoError(t, err)
+	expected, err := ioutil.ReadFile("test_data/notes.html")
+	assert.NoError(t, err)
+
+	page, err := Render(source, Page{RequestPath: "docs/team/notes.md", FilePath: "docs/team/notes.md", LinkQuery: "render=1"})
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(page))
+	assert.True(t, IsPage(page))
+	assert.False(t, IsPage(source))
+}
+
+func Test_rewriteLink(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Page     Page
+		Link     string
+		Expected string
+	}{
+		{
+			Name:     "sibling file",
+			Page:     Page{RequestPath: "docs/notes.md", FilePath: "docs/notes.md"},
+			Link:     "guide.md",
+			Expected: "guide.md",
+		},
+		{
+			Name:     "absolute path stays under the owner",
+			Page:     Page{RequestPath: "docs/team/notes.md", FilePath: "docs/team/notes.md"},
+			Link:     "/index.html",
+			Expected: "../../index.html",
+		},
+		{
+			Name:     "parent folders stop at the owner",
+			Page:     Page{RequestPath: "docs/notes.md", FilePath: "docs/notes.md"},
+			Link:     "../../../secret.txt",
+			Expected: "../secret.txt",
+		},
+		{
+			Name:     "readme served for a folder",
+			Page:     Page{RequestPath: "docs", FilePath: "docs/README.md"},
+			Link:     "guide.md",
+			Expected: "docs/guide.md",
+		},
+		{
+			Name:     "readme served for a folder with a trailing slash",
+			Page:     Page{RequestPath: "docs/", FilePath: "docs/README.md"},
+			Link:     "./",
+			Expected: "./",
+		},
+		{
+			Name:     "markdown links keep rendering",
+			Page:     Page{RequestPath: "notes.md", FilePath: "notes.md", LinkQuery: "render=1"},
+			Link:     "docs/guide.md#setup",
+			Expected: "docs/guide.md?render=1#setup",
+		},
+		{
+			Name:     "fragment",
+			Page:     Page{RequestPath: "notes.md", FilePath: "notes.md"},
+			Link:     "#setup",
+			Expected: "#setup",
+		},
+		{
+			Name:     "other site",
+			Page:     Page{RequestPath: "notes.md", FilePath: "notes.md"},
+			Link:     "https://example.com/docs",
+			Expected: "https://example.com/docs",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.Equal(t, testCase.Expected, testCase.Page.rewriteLink(testCase.Link, true))
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	p2pmetrics "github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "localfiles"
+
+// Outcomes of peer requests and handshakes
+const (
+	OK       = "ok"
+	Failed   = "failed"
+	Busy     = "busy"
+	Rejected = "rejected"
+)
+
+// Directions of bytes sent to and received from peers
+const (
+	In  = "in"
+	Out = "out"
+)
+
+var (
+	// HTTPRequests counts requests to the web server by method and status code
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by method and status code.",
+	}, []string{"method", "status"})
+
+	// HTTPRequestDuration observes how long the web server takes to answer requests, by method
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to answer HTTP requests, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// PeerRequestsServed counts requests answered for other peers, by message type and outcome
+	PeerRequestsServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_requests_served_total",
+		Help:      "Requests from other peers answered, by message type and outcome.",
+	}, []string{"type", "outcome"})
+
+	// PeerRequestsMade counts requests made to other peers, by message type and outcome
+	PeerRequestsMade = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_requests_made_total",
+		Help:      "Requests made to other peers, by message type and outcome.",
+	}, []string{"type", "outcome"})
+
+	// PeerRequestDuration observes how long requests made to other peers take, by message type
+	PeerRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "peer_request_duration_seconds",
+		Help:      "Time taken by requests made to other peers, by message type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	// PeerBytes counts file and message bytes exchanged with other peers, by message type and direction
+	PeerBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_bytes_total",
+		Help:      "Bytes of messages exchanged with other peers, by message type and direction.",
+	}, []string{"type", "direction"})
+
+	// StreamErrors counts failures reading or writing peer streams, by kind of error
+	StreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_errors_total",
+		Help:      "Errors on peer streams, by kind.",
+	}, []string{"type"})
+
+	// Handshakes counts handshakes received from other peers, by outcome
+	Handshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handshakes_total",
+		Help:      "Handshakes received from other peers, by outcome.",
+	}, []string{"outcome"})
+
+	// BlocksFetched counts the file blocks fetched, by where they came from
+	BlocksFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_fetched_total",
+		Help:      "File blocks fetched, by source: the local store, a peer holding them or the owner of the file.",
+	}, []string{"source"})
+
+	// RosterSize is the number of users known to the node
+	RosterSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "roster_size",
+		Help:      "Users known to the node.",
+	})
+)
+
+var bandwidth = &bandwidthCollector{}
+
+func init() {
+	prometheus.MustRegister(bandwidth)
+}
+
+// NewBandwidthCounter returns a libp2p bandwidth reporter whose totals are exported as metrics
+func NewBandwidthCounter() *p2pmetrics.BandwidthCounter {
+	counter := p2pmetrics.NewBandwidthCounter()
+	bandwidth.add(counter)
+	return counter
+}
+
+// bandwidthCollector exports the totals of the libp2p bandwidth counters of every host in the process
+type bandwidthCollector struct {
+	mu       sync.Mutex
+	counters []*p2pmetrics.BandwidthCounter
+}
+
+var bandwidthDesc = prometheus.NewDesc(
+	namespace+"_libp2p_bandwidth_bytes_total",
+	"Bytes sent and received by the libp2p host, by protocol and direction.",
+	[]string{"protocol", "direction"}, nil,
+)
+
+func (c *bandwidthCollector) add(counter *p2pmetrics.BandwidthCounter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters = append(c.counters, counter)
+}
+
+func (c *bandwidthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bandwidthDesc
+}
+
+func (c *bandwidthCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	totals := make(map[string]p2pmetrics.Stats)
+	for _, counter := range c.counters {
+		for protocol, stats := range counter.GetBandwidthByProtocol() {
+			total := totals[string(protocol)]
+			total.TotalIn += stats.TotalIn
+			total.TotalOut += stats.TotalOut
+			totals[string(protocol)] = total
+		}
+	}
+	for protocol, stats := range totals {
+		ch <- prometheus.MustNewConstMetric(bandwidthDesc, prometheus.CounterValue, float64(stats.TotalIn), protocol, In)
+		ch <- prometheus.MustNewConstMetric(bandwidthDesc, prometheus.CounterValue, float64(stats.TotalOut), protocol, Out)
+	}
+}
+
+// Handler serves every metric in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Instrument wraps an http handler to count its requests and observe how long they take
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		HTTPRequests.WithLabelValues(r.Method, strconv.Itoa(recorder.status)).Inc()
+		HTTPRequestDuration.WithLabelValues(r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streamed responses, such as server sent events, through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
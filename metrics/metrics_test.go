@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Instrument(t *testing.T) {
+	handler := Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok")) // nolint:errcheck
+	}))
+
+	cases := []struct {
+		Name   string
+		Path   string
+		Status string
+	}{
+		{Name: "implicit ok", Path: "/", Status: "200"},
+		{Name: "written status", Path: "/missing", Status: "404"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			before := testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, testCase.Status))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, testCase.Path, nil))
+			assert.Equal(t, before+1, testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, testCase.Status)))
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/metrics"
+	"github.com/mungujn/web-exp/share"
+	"github.com/mungujn/web-exp/tracing"
+)
+
+// archiveChunkSize is the most of an archive sent in one message, small enough for any MAX_FRAME_SIZE in use
+const archiveChunkSize = 64 << 10
+
+// GetArchive writes an archive of a folder of a user to w, as the peer sends it, username is empty for the current user.
+// Denied access or a missing folder are reported before anything is written to w. The archive is sent as a series of
+// data messages ending with an empty one, and an error message in their place means the archive could not be finished.
+func (rfs *RemoteFilesystem) GetArchive(ctx context.Context, username, path, format string, w io.Writer) (err error) {
+	if username == "" {
+		folder, err := rfs.shares.Archive(share.Self, path, format)
+		if err != nil {
+			return err
+		}
+		if folder.Name == "" {
+			folder.Name = rfs.iam
+		}
+		return folder.Write(w)
+	}
+	if err = share.CheckArchiveFormat(format); err != nil {
+		return err
+	}
+	if !rfs.supports(username, capabilityArchives) {
+		return fmt.Errorf("user %s can not send archives of folders", username)
+	}
+	received := 0
+	defer func(start time.Time) {
+		observeRequest(archive, start, received, err)
+	}(time.Now())
+
+	req, err := rfs.openRequest(ctx, username, archive, archiveRequest(path, format, tracing.RequestID(ctx)))
+	if err != nil {
+		return err
+	}
+	defer req.close()
+	for {
+		data, err := req.read()
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		received += len(data)
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// serveArchive streams an archive of a folder shared with requester
+func (rfs *RemoteFilesystem) serveArchive(rw *bufio.ReadWriter, stream network.Stream, requester string, data []byte) {
+	path, format, requestID := parseArchiveRequest(data)
+	requestLog := log.WithField(tracing.RequestIDKey, requestID)
+	requestLog.Infof("user: %s is requesting a %s archive of %s", requester, format, path)
+	folder, err := rfs.shares.Archive(requester, path, format)
+	if err != nil {
+		requestLog.Error("error archiving folder: ", err)
+		observeServed(archive, metrics.Failed)
+		if err = rfs.writeData(rw, []byte(fmt.Sprintf("error archiving folder: %s", err)), remoteError); err != nil {
+			requestLog.Error("error writing archive response: ", err)
+		}
+		return
+	}
+	// the whole default share lies under the username in the archive
+	if folder.Name == "" {
+		folder.Name = rfs.iam
+	}
+
+	remotePeer := stream.Conn().RemotePeer()
+	throttled := bufio.NewReadWriter(rw.Reader, bufio.NewWriter(rfs.limits.throttle(context.Background(), remotePeer, stream)))
+	frames := &frameWriter{rfs: rfs, rw: throttled}
+	chunks := bufio.NewWriterSize(frames, archiveChunkSize)
+	err = folder.Write(chunks)
+	if err == nil {
+		err = chunks.Flush()
+	}
+	if err == nil {
+		// an empty message ends the archive
+		err = rfs.writeData(throttled, nil, remoteData)
+	}
+	observeBytes(archive, metrics.Out, frames.sent)
+	if err != nil {
+		requestLog.Error("error sending archive: ", err)
+		observeServed(archive, metrics.Failed)
+		if frames.failed {
+			metrics.StreamErrors.WithLabelValues("write").Inc()
+		} else {
+			// the archive itself failed, the stream still works to say so
+			if err = rfs.writeData(throttled, []byte(fmt.Sprintf("error archiving folder: %s", err)), remoteError); err != nil {
+				requestLog.Error("error writing archive response: ", err)
+			}
+		}
+		return
+	}
+	observeServed(archive, metrics.OK)
+	requestLog.Infof("sent archive of %s of %d bytes to user %s", path, frames.sent, requester)
+}
+
+// frameWriter sends what is written to it as data messages of at most archiveChunkSize bytes
+type frameWriter struct {
+	rfs  *RemoteFilesystem
+	rw   *bufio.ReadWriter
+	sent int
+	// failed is set once writing to the stream fails
+	failed bool
+}
+
+func (w *frameWriter) Write(data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		end := written + archiveChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := w.rfs.writeData(w.rw, data[written:end], remoteData); err != nil {
+			w.failed = true
+			return written, err
+		}
+		w.sent += end - written
+		written = end
+	}
+	return written, nil
+}
+
+// archiveRequest is the payload of an archive request, the format followed by a file request
+func archiveRequest(path, format, requestID string) []byte {
+	return append([]byte(format+"\n"), fileRequest(path, requestID)...)
+}
+
+// parseArchiveRequest splits an archive request into its path, format and request ID
+func parseArchiveRequest(data []byte) (string, string, string) {
+	lines := strings.SplitN(string(data), "\n", 2)
+	if len(lines) != 2 {
+		return "", "", ""
+	}
+	path, requestID := parseFileRequest([]byte(lines[1]))
+	return path, lines[0], requestID
+}
@@ -0,0 +1,575 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/multiformats/go-multihash"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/metrics"
+	"github.com/mungujn/web-exp/share"
+	"github.com/mungujn/web-exp/tracing"
+)
+
+const (
+	// blockSize is the size of the blocks files are split into, the last block of a file holds the rest
+	blockSize = 256 << 10
+	// blockFetchers is how many blocks of a file are fetched at once
+	blockFetchers = 8
+	// haveTimeout is how long peers are given to tell which blocks of a file they hold
+	haveTimeout = time.Second
+	// inlineSize is the size up to which files are sent in their block list rather than split into blocks, to
+	// peers announcing the inline capability, as asking around for their blocks would take longer than sending them
+	inlineSize = 4 * blockSize
+	// blockListCacheSize is how many block lists an owner keeps, so as not to split files into blocks again
+	blockListCacheSize = 1024
+
+	// sources of fetched blocks, as labelled in metrics
+	blockSourceLocal = "local"
+	blockSourcePeer  = "peer"
+	blockSourceOwner = "owner"
+)
+
+// blockList is the list of the blocks of a file, as published by its owner
+type blockList struct {
+	Size      int64 `json:"size"`
+	BlockSize int   `json:"block_size"`
+	// Blocks are the CIDs of the blocks in file order
+	Blocks []string `json:"blocks"`
+	// Public is set for files that every user may read, whose blocks may be passed on to any peer
+	Public bool `json:"public,omitempty"`
+	// Data holds the whole file in place of its blocks, for files of up to inlineSize bytes
+	Data []byte `json:"data,omitempty"`
+}
+
+// check checks that a block list describes a file in blocks of at most maxBlockSize bytes.
+// Files are fetched a block at a time, so only their blocks have to fit in a message.
+func (l blockList) check(maxBlockSize int64) error {
+	if l.Size < 0 {
+		return protocolError("invalid file size %d", l.Size)
+	}
+	if l.Data != nil {
+		if int64(len(l.Data)) != l.Size || len(l.Blocks) != 0 {
+			return protocolError("%d bytes sent along with %d blocks for a file of %d bytes", len(l.Data), len(l.Blocks), l.Size)
+		}
+		return nil
+	}
+	if l.BlockSize <= 0 {
+		return protocolError("invalid block size %d", l.BlockSize)
+	}
+	if int64(l.BlockSize) > maxBlockSize {
+		return protocolError("blocks of %d bytes are larger than the %d bytes allowed", l.BlockSize, maxBlockSize)
+	}
+	if expected := (l.Size + int64(l.BlockSize) - 1) / int64(l.BlockSize); int64(len(l.Blocks)) != expected {
+		return protocolError("%d blocks listed for a file of %d bytes", len(l.Blocks), l.Size)
+	}
+	for _, id := range l.Blocks {
+		if _, err := cid.Decode(id); err != nil {
+			return protocolError("invalid block id %q", id)
+		}
+	}
+	return nil
+}
+
+// splitBlocks splits data into blocks of size bytes
+func splitBlocks(data []byte, size int) [][]byte {
+	blocks := make([][]byte, 0, (len(data)+size-1)/size)
+	for start := 0; start < len(data); start += size {
+		end := start + size
+		if end > len(data) {
+			end = len(data)
+		}
+		blocks = append(blocks, data[start:end])
+	}
+	return blocks
+}
+
+// blockId returns the CID of a block, a raw CIDv1 of its sha2-256 hash
+func blockId(data []byte) string {
+	// Sum only fails for unknown hash functions
+	hash, _ := multihash.Sum(data, multihash.SHA2_256, -1)
+	return cid.NewCidV1(cid.Raw, hash).String()
+}
+
+// verifyBlock checks that data is the block named id
+func verifyBlock(id string, data []byte) error {
+	if blockId(data) != id {
+		return protocolError("block %s does not match its hash", id)
+	}
+	return nil
+}
+
+// blockStore is a least recently used store of blocks by CID, bounded by total size.
+// Blocks never go stale as their CID changes with their contents. Each block records who may be sent it: any peer
+// for the blocks of public files, or the peers able to read one of the files of the node the block is part of.
+type blockStore struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List
+	blocks  map[string]*list.Element
+}
+
+type storedBlock struct {
+	id     string
+	data   []byte
+	public bool
+	// paths are the files of the node holding the block
+	paths map[string]bool
+}
+
+func newBlockStore(maxSize int64) *blockStore {
+	return &blockStore{
+		maxSize: maxSize,
+		order:   list.New(),
+		blocks:  make(map[string]*list.Element),
+	}
+}
+
+// get returns a stored block
+func (s *blockStore) get(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.blocks[id]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(element)
+	return element.Value.(*storedBlock).data, true
+}
+
+// has reports whether a block is stored, without counting as a use of it
+func (s *blockStore) has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blocks[id]
+	return ok
+}
+
+// shared returns a stored block if it may be sent to a peer, that is if it is public or readable is true for one
+// of the files of the node it is part of
+func (s *blockStore) shared(id string, readable func(path string) bool) ([]byte, bool) {
+	s.mu.Lock()
+	element, ok := s.blocks[id]
+	if !ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+	block := element.Value.(*storedBlock)
+	public, paths := block.public, make([]string, 0, len(block.paths))
+	for path := range block.paths {
+		paths = append(paths, path)
+	}
+	s.mu.Unlock()
+	if public {
+		return block.data, true
+	}
+	for _, path := range paths {
+		if readable(path) {
+			return block.data, true
+		}
+	}
+	return nil, false
+}
+
+// put stores a block, evicting the least recently used blocks to make room. A block is public once stored as public,
+// and path, unless empty, is added to the files of the node it is part of.
+func (s *blockStore) put(id string, data []byte, public bool, path string) {
+	if int64(len(data)) > s.maxSize {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.blocks[id]; ok {
+		s.order.MoveToFront(element)
+		element.Value.(*storedBlock).share(public, path)
+		return
+	}
+	block := &storedBlock{id: id, data: data}
+	block.share(public, path)
+	s.blocks[id] = s.order.PushFront(block)
+	s.size += int64(len(data))
+	for s.size > s.maxSize {
+		block := s.order.Remove(s.order.Back()).(*storedBlock)
+		delete(s.blocks, block.id)
+		s.size -= int64(len(block.data))
+	}
+}
+
+// share records who may be sent a block, s.mu has to be held
+func (b *storedBlock) share(public bool, path string) {
+	b.public = b.public || public
+	if path == "" {
+		return
+	}
+	if b.paths == nil {
+		b.paths = make(map[string]bool)
+	}
+	b.paths[path] = true
+}
+
+// blockListCache keeps the block lists of the files of the node by path, along with the version of the file they
+// were made of, dropping the least recently used once full
+type blockListCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type blockListEntry struct {
+	path    string
+	version share.FileVersion
+	listed  blockList
+}
+
+func newBlockListCache() *blockListCache {
+	return &blockListCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the block list of a file if it was made of the same version of the file
+func (c *blockListCache) get(path string, version share.FileVersion) (blockList, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[path]
+	if !ok || element.Value.(*blockListEntry).version != version {
+		return blockList{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*blockListEntry).listed, true
+}
+
+// put keeps the block list of a version of a file, in place of any other of the file
+func (c *blockListCache) put(path string, version share.FileVersion, listed blockList) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[path] = c.order.PushFront(&blockListEntry{path: path, version: version, listed: listed})
+	for c.order.Len() > blockListCacheSize {
+		delete(c.entries, c.order.Remove(c.order.Back()).(*blockListEntry).path)
+	}
+}
+
+// publishBlocks splits a file of the node at path into blocks, storing them so that they can be served to the peers
+// able to read it, and returns its block list
+func (rfs *RemoteFilesystem) publishBlocks(path string, data []byte) blockList {
+	published := blockList{Size: int64(len(data)), BlockSize: blockSize, Blocks: make([]string, 0)}
+	if sh, _, err := rfs.shares.Resolve(path); err == nil {
+		published.Public = len(sh.Allowed) == 0
+	}
+	for _, block := range splitBlocks(data, blockSize) {
+		id := blockId(block)
+		rfs.blocks.put(id, block, published.Public, path)
+		published.Blocks = append(published.Blocks, id)
+	}
+	return published
+}
+
+// listBlocks returns the block list of a file shared with requester, from the block lists kept unless the file
+// changed since, with the file itself in place of its blocks if it is small and requester can take it so
+func (rfs *RemoteFilesystem) listBlocks(requester, path string) (blockList, error) {
+	version, err := rfs.shares.Version(requester, path)
+	if err != nil {
+		return blockList{}, err
+	}
+	inline := version.Size <= inlineSize && rfs.supports(requester, capabilityInline)
+	if listed, ok := rfs.blockLists.get(path, version); ok && !inline {
+		return listed, nil
+	}
+	contents, err := rfs.shares.ReadFile(requester, path)
+	if err != nil {
+		return blockList{}, err
+	}
+	if inline && int64(len(contents)) <= inlineSize {
+		return blockList{Size: int64(len(contents)), BlockSize: blockSize, Blocks: make([]string, 0), Data: contents}, nil
+	}
+	listed := rfs.publishBlocks(path, contents)
+	rfs.blockLists.put(path, version, listed)
+	return listed, nil
+}
+
+// serveBlockList answers a block list request for one of the files shared with requester
+func (rfs *RemoteFilesystem) serveBlockList(rw *bufio.ReadWriter, requester string, data []byte) {
+	path, requestID := parseFileRequest(data)
+	requestLog := log.WithField(tracing.RequestIDKey, requestID)
+	requestLog.Infof("user: %s is listing the blocks of %s", requester, path)
+	listed, err := rfs.listBlocks(requester, path)
+	var responseData []byte
+	if err == nil {
+		responseData, err = json.Marshal(listed)
+	}
+	if err != nil {
+		errStr := fmt.Sprintf("error reading file: %s", err)
+		requestLog.Error(errStr)
+		observeServed(blockListing, metrics.Failed)
+		err = rfs.writeData(rw, []byte(errStr), remoteError)
+	} else {
+		observeServed(blockListing, metrics.OK)
+		err = rfs.writeData(rw, responseData, remoteData)
+	}
+	if err != nil {
+		requestLog.Error("error sending block list: ", err)
+		metrics.StreamErrors.WithLabelValues("write").Inc()
+	}
+}
+
+// readableBy returns whether requester may read a file of the node, for the blocks of the file to be sent to them
+func (rfs *RemoteFilesystem) readableBy(requester string) func(path string) bool {
+	return func(path string) bool {
+		sh, _, err := rfs.shares.Resolve(path)
+		return err == nil && sh.Allows(requester)
+	}
+}
+
+// serveBlockQuery answers which of the blocks listed one per line are held and may be sent to requester,
+// with a '1' for each of them and a '0' for the others
+func (rfs *RemoteFilesystem) serveBlockQuery(rw *bufio.ReadWriter, requester string, data []byte) {
+	ids := strings.Split(string(data), "\n")
+	held := make([]byte, len(ids))
+	readable := rfs.readableBy(requester)
+	for i, id := range ids {
+		held[i] = '0'
+		if _, ok := rfs.blocks.shared(id, readable); ok {
+			held[i] = '1'
+		}
+	}
+	observeServed(blockQuery, metrics.OK)
+	if err := rfs.writeData(rw, held, remoteData); err != nil {
+		log.Error("error answering block query: ", err)
+		metrics.StreamErrors.WithLabelValues("write").Inc()
+	}
+}
+
+// serveBlock sends a held block to a peer asking for it by CID, provided the block is public or part of a file of
+// the node the peer may read. The CID may be followed by the path of the file the block belongs to on a line of its
+// own, for the owner to read it again if the block is no longer stored.
+func (rfs *RemoteFilesystem) serveBlock(rw *bufio.ReadWriter, stream network.Stream, requester string, data []byte) {
+	lines := strings.SplitN(string(data), "\n", 2)
+	id := lines[0]
+	block, ok := rfs.blocks.shared(id, rfs.readableBy(requester))
+	if !ok && len(lines) == 2 {
+		block, ok = rfs.republishBlock(requester, lines[1], id)
+	}
+	var err error
+	if !ok {
+		observeServed(blockRequest, metrics.Failed)
+		err = rfs.writeData(rw, []byte("block not found"), remoteError)
+	} else {
+		observeServed(blockRequest, metrics.OK)
+		remotePeer := stream.Conn().RemotePeer()
+		throttled := bufio.NewReadWriter(rw.Reader, bufio.NewWriter(rfs.limits.throttle(context.Background(), remotePeer, stream)))
+		err = rfs.writeData(throttled, block, remoteData)
+		if err == nil {
+			observeBytes(blockRequest, metrics.Out, len(block))
+		}
+	}
+	if err != nil {
+		log.Error("error sending block: ", err)
+		metrics.StreamErrors.WithLabelValues("write").Inc()
+	}
+}
+
+// republishBlock reads the block named id of a file shared with requester again, if the block list kept of the
+// current version of the file has it. Only the block is read, so a request never costs more than the block sent.
+func (rfs *RemoteFilesystem) republishBlock(requester, path, id string) ([]byte, bool) {
+	version, err := rfs.shares.Version(requester, path)
+	if err != nil {
+		log.Debugf("error reading %s for block %s: %s", path, id, err)
+		return nil, false
+	}
+	listed, ok := rfs.blockLists.get(path, version)
+	if !ok {
+		return nil, false
+	}
+	for i, listedId := range listed.Blocks {
+		if listedId != id {
+			continue
+		}
+		block, err := rfs.shares.ReadRange(requester, path, int64(i)*int64(listed.BlockSize), int64(listed.BlockSize))
+		if err == nil {
+			err = verifyBlock(id, block)
+		}
+		if err != nil {
+			log.Debugf("error reading block %s of %s: %s", id, path, err)
+			return nil, false
+		}
+		rfs.blocks.put(id, block, listed.Public, path)
+		return block, true
+	}
+	return nil, false
+}
+
+// getBlocks fetches a file of username as blocks, from any peer holding them or from username.
+// If a block can not be fetched the whole file is requested from username instead.
+func (rfs *RemoteFilesystem) getBlocks(ctx context.Context, username, path, requestID string) (file []byte, err error) {
+	ctx, span := tracing.StartSpan(ctx, "remote.getBlocks")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	data, err := rfs.request(ctx, username, blockListing, fileRequest(path, requestID))
+	if err != nil {
+		return nil, err
+	}
+	var blocks blockList
+	if err = json.Unmarshal(data, &blocks); err != nil {
+		return nil, &PeerError{Username: username, Op: opRead, Err: protocolError("invalid block list: %s", err)}
+	}
+	if err = blocks.check(rfs.maxFrameSize); err != nil {
+		return nil, &PeerError{Username: username, Op: opRead, Err: err}
+	}
+	if blocks.Data != nil {
+		return blocks.Data, nil
+	}
+
+	file, err = rfs.fetchBlocks(ctx, username, path, blocks)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.WithField(tracing.RequestIDKey, requestID).Warnf("error fetching blocks of %s from user %s, asking for the whole file: %s", path, username, err)
+		return rfs.getWholeFile(ctx, username, path, requestID)
+	}
+	return file, nil
+}
+
+// fetchBlocks fetches the blocks of the file of owner at path in parallel and joins them,
+// spreading the blocks held by other peers across them and asking owner for the rest
+func (rfs *RemoteFilesystem) fetchBlocks(ctx context.Context, owner, path string, blocks blockList) ([]byte, error) {
+	holders := rfs.blockHolders(ctx, owner, blocks.Blocks)
+	fetched := make([][]byte, len(blocks.Blocks))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var fetchErr error
+	indices := make(chan int)
+	for i := 0; i < blockFetchers && i < len(blocks.Blocks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				block, err := rfs.fetchBlock(ctx, owner, path, blocks.Blocks[index], blocks.Public, holders[index], index)
+				if err != nil {
+					mu.Lock()
+					if fetchErr == nil {
+						fetchErr = fmt.Errorf("error fetching block %d: %w", index, err)
+						cancel()
+					}
+					mu.Unlock()
+					continue
+				}
+				fetched[index] = block
+			}
+		}()
+	}
+feed:
+	for index := range blocks.Blocks {
+		select {
+		case indices <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file := bytes.Join(fetched, nil)
+	if int64(len(file)) != blocks.Size {
+		return nil, &PeerError{Username: owner, Op: opRead, Err: protocolError("blocks add up to %d bytes instead of %d", len(file), blocks.Size)}
+	}
+	return file, nil
+}
+
+// fetchBlock returns a block of the file at path from the store, or fetches it from one of the peers
+// holding it picked by the index of the block, or from owner if that fails or no peer holds it.
+// Fetched blocks are only passed on to other peers if public.
+func (rfs *RemoteFilesystem) fetchBlock(ctx context.Context, owner, path, id string, public bool, holders []string, index int) ([]byte, error) {
+	if block, ok := rfs.blocks.get(id); ok {
+		metrics.BlocksFetched.WithLabelValues(blockSourceLocal).Inc()
+		return block, nil
+	}
+	if len(holders) > 0 {
+		holder := holders[index%len(holders)]
+		block, err := rfs.request(ctx, holder, blockRequest, []byte(id))
+		if err == nil {
+			err = verifyBlock(id, block)
+		}
+		if err == nil {
+			rfs.blocks.put(id, block, public, "")
+			metrics.BlocksFetched.WithLabelValues(blockSourcePeer).Inc()
+			return block, nil
+		}
+		log.Debugf("error fetching block %s from user %s, asking user %s: %s", id, holder, owner, err)
+	}
+	block, err := rfs.request(ctx, owner, blockRequest, []byte(id+"\n"+path))
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyBlock(id, block); err != nil {
+		return nil, &PeerError{Username: owner, Op: opRead, Err: err}
+	}
+	rfs.blocks.put(id, block, public, "")
+	metrics.BlocksFetched.WithLabelValues(blockSourceOwner).Inc()
+	return block, nil
+}
+
+// blockHolders asks every other online peer able to serve blocks which of the blocks it holds,
+// returning the usernames holding each block. Peers that do not answer in time are left out.
+func (rfs *RemoteFilesystem) blockHolders(ctx context.Context, owner string, ids []string) [][]string {
+	holders := make([][]string, len(ids))
+	ctx, cancel := context.WithTimeout(ctx, haveTimeout)
+	defer cancel()
+	query := []byte(strings.Join(ids, "\n"))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, username := range rfs.GetOnlineNodes() {
+		if username == owner || username == rfs.iam || !rfs.supports(username, capabilityBlocks) {
+			continue
+		}
+		wg.Add(1)
+		go func(username string) {
+			defer wg.Done()
+			held, err := rfs.request(ctx, username, blockQuery, query)
+			if err == nil && len(held) != len(ids) {
+				err = protocolError("%d answers to a query of %d blocks", len(held), len(ids))
+			}
+			if err != nil {
+				log.Debugf("not fetching blocks from user %s: %s", username, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for i, answer := range held {
+				if answer == '1' {
+					holders[i] = append(holders[i], username)
+				}
+			}
+		}(username)
+	}
+	wg.Wait()
+	for _, usernames := range holders {
+		sort.Strings(usernames)
+	}
+	return holders
+}
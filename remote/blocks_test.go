@@ -0,0 +1,144 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+func Test_splitBlocks(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Data     string
+		Expected []string
+	}{
+		{Name: "empty", Data: "", Expected: []string{}},
+		{Name: "one short block", Data: "ab", Expected: []string{"ab"}},
+		{Name: "whole blocks", Data: "abcdef", Expected: []string{"abc", "def"}},
+		{Name: "short last block", Data: "abcdefg", Expected: []string{"abc", "def", "g"}},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			blocks := make([]string, 0)
+			for _, block := range splitBlocks([]byte(testCase.Data), 3) {
+				blocks = append(blocks, string(block))
+			}
+			assert.Equal(t, testCase.Expected, blocks)
+		})
+	}
+}
+
+func Test_verifyBlock(t *testing.T) {
+	id := blockId([]byte("block"))
+	assert.Equal(t, "bafkreicjnlfibzgy6kp3r2gnqfwdv62i2pyqhfylhixocyambdfgomtn5y", id)
+	assert.NoError(t, verifyBlock(id, []byte("block")))
+	assert.True(t, errors.Is(verifyBlock(id, []byte("tampered")), ErrProtocol))
+}
+
+func Test_blockList_check(t *testing.T) {
+	id := blockId([]byte("block"))
+	cases := []struct {
+		Name          string
+		List          blockList
+		ExpectedError string
+	}{
+		{Name: "valid", List: blockList{Size: 5, BlockSize: 3, Blocks: []string{id, id}}},
+		{Name: "empty file", List: blockList{Size: 0, BlockSize: 3, Blocks: []string{}}},
+		{Name: "larger than a block", List: blockList{Size: 11, BlockSize: 3, Blocks: []string{id, id, id, id}}},
+		{Name: "block too large", List: blockList{Size: 11, BlockSize: 11, Blocks: []string{id}}, ExpectedError: "protocol error: blocks of 11 bytes are larger than the 10 bytes allowed"},
+		{Name: "negative size", List: blockList{Size: -1, BlockSize: 3}, ExpectedError: "protocol error: invalid file size -1"},
+		{Name: "no block size", List: blockList{Size: 5, Blocks: []string{id}}, ExpectedError: "protocol error: invalid block size 0"},
+		{Name: "missing block", List: blockList{Size: 5, BlockSize: 3, Blocks: []string{id}}, ExpectedError: "protocol error: 1 blocks listed for a file of 5 bytes"},
+		{Name: "invalid id", List: blockList{Size: 5, BlockSize: 3, Blocks: []string{id, "block"}}, ExpectedError: `protocol error: invalid block id "block"`},
+		{Name: "inline", List: blockList{Size: 5, BlockSize: 3, Blocks: []string{}, Data: []byte("block")}},
+		{Name: "inline and blocks", List: blockList{Size: 5, BlockSize: 3, Blocks: []string{id, id}, Data: []byte("block")}, ExpectedError: "protocol error: 5 bytes sent along with 2 blocks for a file of 5 bytes"},
+		{Name: "inline too short", List: blockList{Size: 6, BlockSize: 3, Data: []byte("block")}, ExpectedError: "protocol error: 5 bytes sent along with 0 blocks for a file of 6 bytes"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := testCase.List.check(10)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_blockStore(t *testing.T) {
+	store := newBlockStore(10)
+	store.put("a", []byte("12345"), false, "")
+	store.put("b", []byte("12345"), false, "")
+	_, ok := store.get("a")
+	assert.True(t, ok)
+
+	// b is now the least recently used and makes room, has does not count as a use
+	assert.True(t, store.has("b"))
+	store.put("c", []byte("123"), false, "")
+	assert.False(t, store.has("b"))
+	assert.True(t, store.has("a"))
+
+	store.put("big", []byte("12345678901"), false, "")
+	assert.False(t, store.has("big"))
+	assert.Equal(t, int64(8), store.size)
+}
+
+func Test_blockStore_shared(t *testing.T) {
+	store := newBlockStore(100)
+	store.put("public", []byte("1"), true, "")
+	store.put("fetched", []byte("2"), false, "")
+	store.put("team", []byte("3"), false, "team/plan.md")
+	store.put("team", []byte("3"), false, "notes/plan.md")
+	readable := func(path string) bool { return strings.HasPrefix(path, "notes/") }
+	nothing := func(string) bool { return false }
+
+	cases := []struct {
+		Name     string
+		Id       string
+		Readable func(string) bool
+		Expected bool
+	}{
+		{Name: "public", Id: "public", Readable: nothing, Expected: true},
+		{Name: "fetched from a restricted file", Id: "fetched", Readable: readable, Expected: false},
+		{Name: "part of a readable file", Id: "team", Readable: readable, Expected: true},
+		{Name: "part of no readable file", Id: "team", Readable: nothing, Expected: false},
+		{Name: "missing", Id: "missing", Readable: readable, Expected: false},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, ok := store.shared(testCase.Id, testCase.Readable)
+			assert.Equal(t, testCase.Expected, ok)
+		})
+	}
+}
+
+func Test_blockListCache(t *testing.T) {
+	cache := newBlockListCache()
+	version := share.FileVersion{Size: 1, Modified: time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)}
+	listed := blockList{Size: 1, BlockSize: blockSize, Blocks: []string{"a"}}
+	cache.put("a.txt", version, listed)
+
+	cached, ok := cache.get("a.txt", version)
+	assert.True(t, ok)
+	assert.Equal(t, listed, cached)
+
+	// a file that changed is split again
+	_, ok = cache.get("a.txt", share.FileVersion{Size: 1, Modified: version.Modified.Add(time.Second)})
+	assert.False(t, ok)
+	_, ok = cache.get("b.txt", version)
+	assert.False(t, ok)
+
+	for i := 0; i < blockListCacheSize; i++ {
+		cache.put(fmt.Sprintf("%d.txt", i), version, listed)
+	}
+	_, ok = cache.get("a.txt", version)
+	assert.False(t, ok)
+	assert.Equal(t, blockListCacheSize, cache.order.Len())
+}
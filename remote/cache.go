@@ -0,0 +1,117 @@
+package remote
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheTTL is how long a cached file is served without asking its owner again
+const cacheTTL = 5 * time.Minute
+
+// fileCache is a least recently used cache of files fetched from other users, bounded by total size.
+// Files are cached by the peer ID of their owner, whichever name the owner was addressed by.
+type fileCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	data    []byte
+	fetched time.Time
+}
+
+func newFileCache(maxSize int64) *fileCache {
+	return &fileCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns a cached file of a peer if it is still fresh
+func (c *fileCache) get(peerId, path string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[cacheKey(peerId, path)]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Since(entry.fetched) > cacheTTL {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.data, true
+}
+
+// expired returns a cached file of a peer that is no longer fresh, kept so that it can be checked against its owner
+// rather than fetched again
+func (c *fileCache) expired(peerId, path string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[cacheKey(peerId, path)]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Since(entry.fetched) <= cacheTTL {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+// refresh makes a cached file of a peer fresh again, once its owner confirmed it did not change
+func (c *fileCache) refresh(peerId, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[cacheKey(peerId, path)]; ok {
+		element.Value.(*cacheEntry).fetched = time.Now()
+		c.order.MoveToFront(element)
+	}
+}
+
+// put caches a file of a peer, evicting the least recently used files to make room
+func (c *fileCache) put(peerId, path string, data []byte) {
+	if int64(len(data)) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(peerId, path)
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, data: data, fetched: time.Now()})
+	c.size += int64(len(data))
+	for c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops every cached file of a peer
+func (c *fileCache) invalidate(peerId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := cacheKey(peerId, "")
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *fileCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+func cacheKey(peerId, path string) string {
+	return peerId + "/" + path
+}
@@ -0,0 +1,57 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_fileCache(t *testing.T) {
+	cache := newFileCache(10)
+
+	cache.put("host1", "a.txt", []byte("12345"))
+	cache.put("host2", "b.txt", []byte("12345"))
+	data, ok := cache.get("host1", "a.txt")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("12345"), data)
+
+	// host2/b.txt is now the least recently used and makes room
+	cache.put("host1", "c.txt", []byte("123"))
+	_, ok = cache.get("host2", "b.txt")
+	assert.False(t, ok)
+
+	// files larger than the cache are never cached
+	cache.put("host2", "big.txt", []byte("12345678901"))
+	_, ok = cache.get("host2", "big.txt")
+	assert.False(t, ok)
+
+	cache.invalidate("host1")
+	_, ok = cache.get("host1", "a.txt")
+	assert.False(t, ok)
+	_, ok = cache.get("host1", "c.txt")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), cache.size)
+}
+
+func Test_fileCache_expired(t *testing.T) {
+	cache := newFileCache(10)
+	cache.put("host1", "a.txt", []byte("12345"))
+	_, ok := cache.expired("host1", "a.txt")
+	assert.False(t, ok)
+
+	cache.entries[cacheKey("host1", "a.txt")].Value.(*cacheEntry).fetched = time.Now().Add(-cacheTTL - time.Second)
+	_, ok = cache.get("host1", "a.txt")
+	assert.False(t, ok)
+	data, ok := cache.expired("host1", "a.txt")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("12345"), data)
+
+	// a file its owner confirmed is unchanged is fresh again
+	cache.refresh("host1", "a.txt")
+	data, ok = cache.get("host1", "a.txt")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("12345"), data)
+	_, ok = cache.expired("host1", "a.txt")
+	assert.False(t, ok)
+}
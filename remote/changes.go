@@ -0,0 +1,87 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+// changesBuffer is how many change notifications are held for a slow consumer before they are dropped
+const changesBuffer = 64
+
+// Changes returns notifications of files changing in the shares of any user, the current one included
+func (rfs *RemoteFilesystem) Changes() <-chan share.Change {
+	return rfs.changes
+}
+
+// initChanges watches the local shares and publishes their changes to the network,
+// while listening for changes published by other peers
+func (rfs *RemoteFilesystem) initChanges(ctx context.Context) error {
+	topic, err := rfs.pubsub.Join(rfs.networkName + "/changes")
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return err
+	}
+	go rfs.readChanges(ctx, sub)
+
+	return rfs.shares.Watch(ctx, func(change share.Change) {
+		change.Username = rfs.iam
+		log.Debug("local file changed: ", change.Path)
+		rfs.index.Invalidate()
+		rfs.notifyChange(change)
+		data, err := json.Marshal(change)
+		if err != nil {
+			log.Error("error encoding change: ", err)
+			return
+		}
+		if err = topic.Publish(ctx, data); err != nil {
+			log.Error("error publishing change: ", err)
+		}
+	})
+}
+
+// readChanges handles change notifications published by other peers until ctx is done
+func (rfs *RemoteFilesystem) readChanges(ctx context.Context, sub *pubsub.Subscription) {
+	defer sub.Cancel()
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		from := msg.GetFrom().Pretty()
+		if from == rfs.hostId {
+			continue
+		}
+		var change share.Change
+		if err = json.Unmarshal(msg.Data, &change); err != nil {
+			log.Error("invalid change notification from peer ", from, ": ", err)
+			continue
+		}
+		// only the owner of a share may announce changes to it, they are passed on under the name it is listed under
+		claimed, name := rfs.userOf(from)
+		if claimed == "" || claimed != change.Username {
+			log.Debugf("ignoring change notification for %s from peer %s", change.Username, from)
+			continue
+		}
+		change.Username = name
+		log.Debugf("file %s of user %s changed", change.Path, change.Username)
+		rfs.cache.invalidate(from)
+		rfs.notifyChange(change)
+	}
+}
+
+// notifyChange passes a change on to the consumer of Changes without ever blocking
+func (rfs *RemoteFilesystem) notifyChange(change share.Change) {
+	select {
+	case rfs.changes <- change:
+	default:
+		log.Debug("dropping change notification, nobody is reading them")
+	}
+}
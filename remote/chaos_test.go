@@ -0,0 +1,268 @@
+package remote_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/metrics"
+	"github.com/mungujn/web-exp/remote"
+	"github.com/mungujn/web-exp/remote/remotetest"
+)
+
+// requestTimeout is the deadline of requests made to misbehaving peers
+const requestTimeout = 300 * time.Millisecond
+
+// answer returns a stream handler that reads a request and writes raw in reply, then does what after does
+func answer(raw string, after func(stream network.Stream)) network.StreamHandler {
+	return func(stream network.Stream) {
+		rw := bufio.NewReader(stream)
+		if _, err := rw.ReadString('\n'); err != nil {
+			return
+		}
+		if _, err := io.WriteString(stream, raw); err != nil {
+			return
+		}
+		after(stream)
+	}
+}
+
+// hang waits for the requester to give up on the stream
+func hang(stream network.Stream) {
+	_, _ = io.Copy(ioutil.Discard, stream)
+}
+
+// hangUp closes the stream as if the peer disconnected
+func hangUp(stream network.Stream) {
+	_ = stream.Close()
+}
+
+// drop resets the stream as if the connection was lost
+func drop(stream network.Stream) {
+	_ = stream.Reset()
+}
+
+func Test_GetFile_misbehavingPeer(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Handler network.StreamHandler
+		// Expected is wrapped by the error, besides a PeerError
+		Expected error
+	}{
+		{
+			Name:     "never answers",
+			Handler:  func(stream network.Stream) { hang(stream) },
+			Expected: context.DeadlineExceeded,
+		},
+		{
+			Name:     "disconnects mid transfer",
+			Handler:  answer("mallory:d:100\n0123456789", hangUp),
+			Expected: remote.ErrProtocol,
+		},
+		{
+			Name:    "connection lost mid transfer",
+			Handler: answer("mallory:d:100\n0123456789", drop),
+		},
+		{
+			Name:     "sends fewer bytes than announced",
+			Handler:  answer("mallory:d:100\n0123456789", hang),
+			Expected: context.DeadlineExceeded,
+		},
+		{
+			Name:     "byte count is not a number",
+			Handler:  answer("mallory:d:ten\n0123456789", hang),
+			Expected: remote.ErrProtocol,
+		},
+		{
+			Name:     "malformed header",
+			Handler:  answer("mallory-d-10\n0123456789", hang),
+			Expected: remote.ErrProtocol,
+		},
+		{
+			Name:     "header never ends",
+			Handler:  answer("mallory:d:10", hang),
+			Expected: context.DeadlineExceeded,
+		},
+		{
+			Name:     "unknown message type",
+			Handler:  answer(remotetest.Frame("mallory", "z", "0123456789"), hang),
+			Expected: remote.ErrProtocol,
+		},
+		{
+			Name:     "answers as another user",
+			Handler:  answer(remotetest.Frame("eve", "d", "0123456789"), hang),
+			Expected: remote.ErrProtocol,
+		},
+		{
+			Name:    "hangs up without answering",
+			Handler: func(stream network.Stream) { hangUp(stream) },
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			network := remotetest.New(t, remotetest.NodeConfig{Username: "alice"})
+			rogue := network.AddRogue(testCase.Handler)
+			rogue.Handshake("alice", "mallory")
+
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			defer cancel()
+			start := time.Now()
+			data, err := network.Node("alice").GetFile(ctx, "mallory", "a.txt")
+
+			assert.Less(t, int64(time.Since(start)), int64(requestTimeout+200*time.Millisecond))
+			assert.Nil(t, data)
+			var peerErr *remote.PeerError
+			if assert.True(t, errors.As(err, &peerErr), "not a PeerError: %v", err) {
+				assert.Equal(t, "mallory", peerErr.Username)
+			}
+			if testCase.Expected != nil {
+				assert.True(t, errors.Is(err, testCase.Expected), "%v does not wrap %v", err, testCase.Expected)
+			}
+			assert.Equal(t, []string{"mallory"}, network.Node("alice").GetOnlineNodes())
+		})
+	}
+}
+
+func Test_GetFile_cancelled(t *testing.T) {
+	network := remotetest.New(t, remotetest.NodeConfig{Username: "alice"})
+	rogue := network.AddRogue(hang)
+	rogue.Handshake("alice", "mallory")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := network.Node("alice").GetFile(ctx, "mallory", "a.txt")
+	assert.True(t, errors.Is(err, context.Canceled), "%v does not wrap %v", err, context.Canceled)
+}
+
+func Test_GetFile_remoteError(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice"},
+		remotetest.NodeConfig{Username: "bob", Files: fstest.MapFS{"a.txt": {Data: []byte("a")}}},
+	)
+
+	_, err := network.Node("alice").GetFile(context.Background(), "bob", "missing.txt")
+	var remoteErr *remote.RemoteError
+	if assert.True(t, errors.As(err, &remoteErr), "not a RemoteError: %v", err) {
+		assert.Equal(t, "bob", remoteErr.Username)
+	}
+}
+
+func Test_roster_misbehavingPeer(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice"},
+		remotetest.NodeConfig{Username: "bob", Files: fstest.MapFS{"a.txt": {Data: []byte("a")}}},
+	)
+	alice := network.Node("alice")
+	rogue := network.AddRogue(hang)
+
+	// messages alice can not make sense of are dropped
+	rogue.Send("alice", "garbage\n")
+	rogue.Send("alice", remotetest.Frame("mallory", "z", "0123456789"))
+	rogue.Send("alice", "mallory:p:100\nshort")
+	// handshakes claiming the peer ID of another node are rejected
+	rogue.Send("alice", remotetest.Frame("bob2", "h", network.Node("bob").Host.ID().Pretty()+"\n"))
+
+	rogue.Handshake("alice", "mallory")
+	assert.ElementsMatch(t, []string{"bob", "mallory"}, alice.GetOnlineNodes())
+
+	// a second handshake under another name renames the peer rather than adding a user
+	rogue.Handshake("alice", "eve")
+	assert.ElementsMatch(t, []string{"bob", "eve"}, alice.GetOnlineNodes())
+	usernames := make([]string, 0)
+	for _, peer := range alice.GetPeers() {
+		usernames = append(usernames, peer.Username)
+	}
+	assert.ElementsMatch(t, []string{"bob", "eve"}, usernames)
+	_, err := alice.GetFile(context.Background(), "mallory", "a.txt")
+	assert.EqualError(t, err, "username mallory is not assciated with a peer id")
+
+	// and the rest of the network still works
+	data, err := alice.GetFile(context.Background(), "bob", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+}
+
+func Test_handleStream_unreadableMessage(t *testing.T) {
+	network := remotetest.New(t, remotetest.NodeConfig{Username: "alice"})
+	rogue := network.AddRogue(hang)
+	streamErrors := func(kind string) float64 {
+		return testutil.ToFloat64(metrics.StreamErrors.WithLabelValues(kind))
+	}
+	read, unknown := streamErrors("read"), streamErrors("unknown_type")
+
+	// alice answers a message larger than she accepts without reading it, and handles nothing else
+	reply := rogue.Request("alice", "mallory:p:2000000\n")
+	assert.Equal(t, remotetest.Frame("alice", "e", "error reading message: protocol error: message of 2000000 bytes is larger than the 1048576 bytes allowed"), reply)
+	assert.Equal(t, read+1, streamErrors("read"))
+	assert.Equal(t, unknown, streamErrors("unknown_type"))
+}
+
+func Test_roster_usernameConflict(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice"},
+		remotetest.NodeConfig{Username: "bob", Files: fstest.MapFS{"a.txt": {Data: []byte("a")}}},
+	)
+	alice := network.Node("alice")
+	bobId := network.Node("bob").Host.ID().Pretty()
+	rogue := network.AddRogue(hang)
+	rogueId := rogue.Host.ID().Pretty()
+
+	// a second node claiming bob makes both of them known by qualified names only
+	rogue.Handshake("alice", "bob")
+	claimants := []string{remote.QualifiedName("bob", bobId), remote.QualifiedName("bob", rogueId)}
+	assert.ElementsMatch(t, claimants, alice.GetOnlineNodes())
+	for _, peer := range alice.GetPeers() {
+		assert.True(t, peer.Conflict, peer.Username)
+		assert.Equal(t, remote.QualifiedName("bob", peer.PeerId), peer.Username)
+	}
+	sort.Strings(claimants)
+	_, err := alice.GetFile(context.Background(), "bob", "a.txt")
+	assert.EqualError(t, err, "username bob is claimed by more than one node, use one of "+strings.Join(claimants, ", "))
+	data, err := alice.GetFile(context.Background(), remote.QualifiedName("bob", bobId), "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	// a node claiming the username of the current user is always qualified, and bob is bob again
+	rogue.Handshake("alice", "alice")
+	assert.ElementsMatch(t, []string{"bob", remote.QualifiedName("alice", rogueId)}, alice.GetOnlineNodes())
+	data, err = alice.GetFile(context.Background(), "bob", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	// qualified names keep working without a conflict
+	data, err = alice.GetFile(context.Background(), remote.QualifiedName("bob", bobId), "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+}
+
+func Test_roster_pinnedUsername(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "bob", Files: fstest.MapFS{"a.txt": {Data: []byte("a")}}},
+		remotetest.NodeConfig{Username: "alice", Pinned: []string{"bob"}},
+	)
+	alice := network.Node("alice")
+	rogue := network.AddRogue(hang)
+	rogueId := rogue.Host.ID().Pretty()
+
+	// another node claiming a pinned username is told apart from its owner, who keeps it
+	rogue.Handshake("alice", "bob")
+	assert.ElementsMatch(t, []string{"bob", remote.QualifiedName("bob", rogueId)}, alice.GetOnlineNodes())
+	for _, peer := range alice.GetPeers() {
+		assert.Equal(t, peer.PeerId == rogueId, peer.Conflict, peer.Username)
+	}
+	data, err := alice.GetFile(context.Background(), "bob", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+}
@@ -0,0 +1,78 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// ErrProtocol is wrapped by the errors of peers breaking the protocol, such as malformed or unexpected messages
+var ErrProtocol = errors.New("protocol error")
+
+// steps of a request to a peer, as reported by PeerError
+const (
+	opOpen  = "opening stream to"
+	opWrite = "sending request to"
+	opRead  = "reading response from"
+)
+
+// PeerError is returned when a request to the peer of a user fails part way.
+// It wraps the cause, which is the error of the context if the request was cancelled or ran out of time.
+type PeerError struct {
+	Username string
+	// Op is the step of the request that failed
+	Op  string
+	Err error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("error %s peer %s: %s", e.Op, e.Username, e.Err)
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// Unreachable reports whether the peer could not be reached at all, as when its node is off
+func (e *PeerError) Unreachable() bool {
+	return e.Op == opOpen
+}
+
+// RemoteError is returned when a peer answers a request with an error of its own, such as a missing file
+type RemoteError struct {
+	Username string
+	Message  string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("user %s answered: %s", e.Username, e.Message)
+}
+
+// peerError describes a failed step of a request, blaming ctx if it is done as that is why the stream failed
+func peerError(ctx context.Context, username, op string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	return &PeerError{Username: username, Op: op, Err: err}
+}
+
+// protocolError returns an error wrapping ErrProtocol
+func protocolError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, args...))
+}
+
+// resetOnDone resets stream once ctx is done, so that reads and writes blocked on an unresponsive peer return.
+// The returned function stops watching ctx.
+func resetOnDone(ctx context.Context, stream network.Stream) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = stream.Reset()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
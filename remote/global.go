@@ -17,26 +17,30 @@ import (
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/multiformats/go-multiaddr"
+
+	"github.com/mungujn/web-exp/metrics"
 )
 
 func connectToPublicPeers(ctx context.Context, host libp2phost.Host, customBootstrapPeer string) {
 	// This connects to public bootstrappers
 	bootstrapPeers := dht.DefaultBootstrapPeers
 
-	// This uses a custom bootstrapper peer
-	// addr, err := multiaddr.NewMultiaddr(customBootstrapPeer)
-	// if err != nil {
-	// 	log.Error("failed to parse custom bootstrap peer multiaddr: ", err)
-	// } else {
-	// 	log.Infof("parsed global bootstrap peer address %s successfully", customBootstrapPeer)
-	// }
-
-	// bootstrapPeers := []multiaddr.Multiaddr{addr}
+	// This also uses a custom bootstrapper peer, such as a node started with the bridge command
+	if customBootstrapPeer != "" {
+		addr, err := multiaddr.NewMultiaddr(customBootstrapPeer)
+		if err != nil {
+			log.Error("failed to parse custom bootstrap peer multiaddr: ", err)
+		} else {
+			log.Infof("parsed global bootstrap peer address %s successfully", customBootstrapPeer)
+			bootstrapPeers = append([]multiaddr.Multiaddr{addr}, bootstrapPeers...)
+		}
+	}
 
 	for _, addr := range bootstrapPeers {
 		pi, err := peer.AddrInfoFromP2pAddr(addr)
 		if err != nil {
 			log.Error("failed to parse bootstrap peer multiaddr: ", err)
+			continue
 		}
 
 		// We ignore errors as a bootstrap peers may be down
@@ -54,6 +58,7 @@ func getGlobalHost(
 	prvKey crypto.PrivKey,
 	sourceMultiAddr multiaddr.Multiaddr,
 	idht *dht.IpfsDHT,
+	runBridge bool,
 ) (libp2phost.Host, error) {
 	log.Debug("setting up global host")
 	cmgi, err := connmgr.NewConnManager(
@@ -64,9 +69,10 @@ func getGlobalHost(
 		log.Error("failed to create connection manager: ", err)
 		return nil, err
 	}
-	return libp2p.New(
+	options := []libp2p.Option{
 		libp2p.ListenAddrs(sourceMultiAddr),
 		libp2p.Identity(prvKey),
+		libp2p.BandwidthReporter(metrics.NewBandwidthCounter()),
 		libp2p.DefaultTransports,
 		// Let's prevent our peer from having too many
 		// connections by attaching a connection manager.
@@ -89,5 +95,10 @@ func getGlobalHost(
 		// This service is highly rate-limited and should not cause any
 		// performance issues.
 		libp2p.EnableNATService(),
-	)
+	}
+	if runBridge {
+		log.Info("running as a bridge peer, relaying connections for other peers")
+		options = append(options, libp2p.EnableRelayService())
+	}
+	return libp2p.New(options...)
 }
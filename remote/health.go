@@ -0,0 +1,36 @@
+package remote
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+// Readiness checks that the host is listening and that peers can be discovered
+func (rfs *RemoteFilesystem) Readiness() []share.Check {
+	host := share.Check{Name: "host", Detail: "host not started"}
+	if rfs.host != nil {
+		addrs := rfs.host.Network().ListenAddresses()
+		if len(addrs) == 0 {
+			host.Detail = "host is not listening"
+		} else {
+			listening := make([]string, 0, len(addrs))
+			for _, addr := range addrs {
+				listening = append(listening, addr.String())
+			}
+			host.OK, host.Detail = true, fmt.Sprintf("listening on %s", strings.Join(listening, ", "))
+		}
+	}
+
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	mdns := share.Check{Name: "mdns", OK: rfs.mdnsStarted, Detail: "started"}
+	switch {
+	case rfs.mdnsErr != nil:
+		mdns.Detail = rfs.mdnsErr.Error()
+	case !rfs.mdnsStarted:
+		mdns.Detail = "not started"
+	}
+	return []share.Check{host, mdns}
+}
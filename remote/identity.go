@@ -0,0 +1,75 @@
+package remote
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	mrand "math/rand"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/app"
+)
+
+// Identity returns the private key a node built from dcfg runs with.
+// With a key file set the key is loaded from it, or created and saved there on first use.
+// Otherwise a new key is generated, fixed for the node port in debug mode.
+func Identity(dcfg app.Config) (crypto.PrivKey, error) {
+	return identity(dcfg.KeyFile, dcfg.Debug, dcfg.LocalNodePort)
+}
+
+// identity loads, creates or generates a private key, see Identity
+func identity(keyFile string, debug bool, port int) (crypto.PrivKey, error) {
+	if keyFile != "" {
+		return loadOrCreateKey(keyFile)
+	}
+
+	var r io.Reader
+	if debug {
+		log.Info("debug mode is on, will use port number as random seed data")
+		r = mrand.New(mrand.NewSource(int64(9223372036854775807 - port)))
+	} else {
+		r = rand.Reader
+	}
+
+	// Creates a new RSA key pair for this host.
+	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	return prvKey, err
+}
+
+// PeerId returns the peer ID belonging to a private key
+func PeerId(prvKey crypto.PrivKey) (string, error) {
+	id, err := peer.IDFromPrivateKey(prvKey)
+	if err != nil {
+		return "", err
+	}
+	return id.Pretty(), nil
+}
+
+// loadOrCreateKey reads a private key from path, creating one there if the file does not exist
+func loadOrCreateKey(path string) (crypto.PrivKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		log.Debug("loading host identity from: ", path)
+		return crypto.UnmarshalPrivateKey(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	log.Info("creating new host identity in: ", path)
+	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, 0, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err = crypto.MarshalPrivateKey(prvKey)
+	if err != nil {
+		return nil, err
+	}
+	return prvKey, ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,31 @@
+package remote
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	log "github.com/sirupsen/logrus"
+)
+
+// pingTimeout is how long a latency measurement waits for a peer to answer
+const pingTimeout = 5 * time.Second
+
+// measureLatency pings every connected peer in the roster, the peerstore records the round trip times
+func (rfs *RemoteFilesystem) measureLatency(ctx context.Context) {
+	for _, peerId := range rfs.rosterPeerIds() {
+		id, err := peer.Decode(peerId)
+		if err != nil || rfs.host.Network().Connectedness(id) != network.Connected {
+			continue
+		}
+		go func(id peer.ID) {
+			ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+			defer cancel()
+			if result := <-ping.Ping(ctx, rfs.host, id); result.Error != nil {
+				log.Debugf("error pinging peer %s: %s", id.Pretty(), result.Error)
+			}
+		}(id)
+	}
+}
@@ -0,0 +1,195 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/time/rate"
+
+	"github.com/mungujn/web-exp/app"
+)
+
+const (
+	// transferRetryAfter is how long peers are asked to wait when every transfer slot is taken
+	transferRetryAfter = time.Second
+	// idlePeerLimits is how long the limits of a peer are kept after its last request
+	idlePeerLimits = 10 * time.Minute
+	// maxThrottledWrite is the largest write passed on at once by a throttled writer
+	maxThrottledWrite = 32 * 1024
+)
+
+// BusyError is returned when a peer turns a request down because it is over one of its limits
+type BusyError struct {
+	Username   string
+	retryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("user %s is busy, retry after %s", e.Username, e.retryAfter)
+}
+
+// RetryAfter is how long the peer asked to wait before trying again
+func (e *BusyError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// newBusyError parses the payload of a busy message, which is the number of seconds to wait
+func newBusyError(username string, data []byte) error {
+	seconds, err := strconv.Atoi(string(data))
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("invalid busy message from %s: %q", username, string(data))
+	}
+	return &BusyError{Username: username, retryAfter: time.Duration(seconds) * time.Second}
+}
+
+// limits enforces the limits a node puts on requests from other peers
+type limits struct {
+	// upload caps the bytes per second sent to all peers together, nil if unlimited
+	upload *rate.Limiter
+	// peerUpload caps the bytes per second sent to a single peer, 0 if unlimited
+	peerUpload int64
+	// peerRequests caps the requests a single peer may make per minute, 0 if unlimited
+	peerRequests int
+	// transfers holds a token for every transfer in progress, nil if unlimited
+	transfers chan struct{}
+
+	mu    sync.Mutex
+	peers map[peer.ID]*peerLimits
+}
+
+// peerLimits are the limiters of a single peer
+type peerLimits struct {
+	requests *rate.Limiter
+	upload   *rate.Limiter
+	lastUsed time.Time
+}
+
+func newLimits(dcfg app.Config) *limits {
+	l := &limits{
+		upload:       bandwidthLimiter(dcfg.UploadRateLimit),
+		peerUpload:   dcfg.PeerUploadRateLimit,
+		peerRequests: dcfg.PeerRequestsPerMinute,
+		peers:        make(map[peer.ID]*peerLimits),
+	}
+	if dcfg.MaxConcurrentTransfers > 0 {
+		l.transfers = make(chan struct{}, dcfg.MaxConcurrentTransfers)
+	}
+	return l
+}
+
+// bandwidthLimiter returns a limiter of bytesPerSecond, nil if it is 0
+func bandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := maxThrottledWrite
+	if bytesPerSecond < int64(burst) {
+		burst = int(bytesPerSecond)
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// peer returns the limiters of a peer, dropping those of peers that have been idle for a while
+func (l *limits) peer(id peer.ID) *peerLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for other, pl := range l.peers {
+		if now.Sub(pl.lastUsed) > idlePeerLimits {
+			delete(l.peers, other)
+		}
+	}
+	pl, exists := l.peers[id]
+	if !exists {
+		pl = &peerLimits{upload: bandwidthLimiter(l.peerUpload)}
+		if l.peerRequests > 0 {
+			pl.requests = rate.NewLimiter(rate.Limit(float64(l.peerRequests)/60), l.peerRequests)
+		}
+		l.peers[id] = pl
+	}
+	pl.lastUsed = now
+	return pl
+}
+
+// allowRequest reports whether a peer is within its request rate, and how long it has to wait if not
+func (l *limits) allowRequest(id peer.ID) (time.Duration, bool) {
+	requests := l.peer(id).requests
+	if requests == nil {
+		return 0, true
+	}
+	now := time.Now()
+	reservation := requests.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// startTransfer takes a transfer slot, returning a function that gives it back, false if all slots are taken
+func (l *limits) startTransfer() (func(), bool) {
+	if l.transfers == nil {
+		return func() {}, true
+	}
+	select {
+	case l.transfers <- struct{}{}:
+		return func() { <-l.transfers }, true
+	default:
+		return nil, false
+	}
+}
+
+// throttle wraps w so that writes to it keep to the global and per peer upload bandwidth
+func (l *limits) throttle(ctx context.Context, id peer.ID, w io.Writer) io.Writer {
+	limiters := make([]*rate.Limiter, 0, 2)
+	for _, limiter := range []*rate.Limiter{l.upload, l.peer(id).upload} {
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{ctx: ctx, w: w, limiters: limiters}
+}
+
+// throttledWriter waits for every limiter to allow each chunk before writing it
+type throttledWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := len(p) - written
+		for _, limiter := range t.limiters {
+			if limiter.Burst() < chunk {
+				chunk = limiter.Burst()
+			}
+		}
+		for _, limiter := range t.limiters {
+			if err := limiter.WaitN(t.ctx, chunk); err != nil {
+				return written, err
+			}
+		}
+		n, err := t.w.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// retryAfterSeconds rounds a delay up to whole seconds for a busy message
+func retryAfterSeconds(delay time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(delay.Seconds())))
+}
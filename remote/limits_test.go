@@ -0,0 +1,80 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/app"
+)
+
+func Test_limits_allowRequest(t *testing.T) {
+	l := newLimits(app.Config{PeerRequestsPerMinute: 2})
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+
+	_, ok := l.allowRequest(alice)
+	assert.True(t, ok)
+	_, ok = l.allowRequest(alice)
+	assert.True(t, ok)
+
+	// the third request within the minute has to wait about 30 seconds for the next token
+	delay, ok := l.allowRequest(alice)
+	assert.False(t, ok)
+	assert.InDelta(t, 30*time.Second, delay, float64(time.Second))
+
+	// every peer has its own allowance
+	_, ok = l.allowRequest(bob)
+	assert.True(t, ok)
+
+	unlimited := newLimits(app.Config{})
+	for i := 0; i < 100; i++ {
+		_, ok = unlimited.allowRequest(alice)
+		assert.True(t, ok)
+	}
+}
+
+func Test_limits_startTransfer(t *testing.T) {
+	l := newLimits(app.Config{MaxConcurrentTransfers: 1})
+
+	done, ok := l.startTransfer()
+	assert.True(t, ok)
+	_, ok = l.startTransfer()
+	assert.False(t, ok)
+
+	done()
+	done, ok = l.startTransfer()
+	assert.True(t, ok)
+	done()
+}
+
+func Test_limits_throttle(t *testing.T) {
+	l := newLimits(app.Config{UploadRateLimit: 100 * 1024, PeerUploadRateLimit: 10 * 1024})
+	var out bytes.Buffer
+	w := l.throttle(context.Background(), peer.ID("alice"), &out)
+
+	// the first 10 KiB go out at once as the burst, the next 5 KiB take about half a second at the peers rate
+	start := time.Now()
+	n, err := w.Write(make([]byte, 15*1024))
+	assert.NoError(t, err)
+	assert.Equal(t, 15*1024, n)
+	assert.Equal(t, 15*1024, out.Len())
+	assert.InDelta(t, 500*time.Millisecond, time.Since(start), float64(200*time.Millisecond))
+
+	// without limits writes are not wrapped
+	assert.Equal(t, &out, newLimits(app.Config{}).throttle(context.Background(), peer.ID("alice"), &out))
+}
+
+func Test_newBusyError(t *testing.T) {
+	err := newBusyError("alice", []byte("3"))
+	var busy *BusyError
+	assert.True(t, errors.As(err, &busy))
+	assert.Equal(t, 3*time.Second, busy.RetryAfter())
+	assert.EqualError(t, err, "user alice is busy, retry after 3s")
+
+	assert.EqualError(t, newBusyError("alice", []byte("-1")), `invalid busy message from alice: "-1"`)
+}
@@ -16,10 +16,15 @@ func (rfs *RemoteFilesystem) HandlePeerFound(pi peer.AddrInfo) {
 	rfs.handshakePeer(pi)
 }
 
-// initMDNS starts the mDNS service for notification about peer discovery
+// initMDNS starts the mDNS service for notification about peer discovery.
+// Peers can still be reached without it, so a failure is kept for the readiness checks rather than returned.
 func (rfs *RemoteFilesystem) initMDNS() {
 	ser := mdns.NewMdnsService(rfs.host, rfs.networkName, rfs)
-	if err := ser.Start(); err != nil {
+	err := ser.Start()
+	if err != nil {
 		log.Error("failed to start mDNS", err)
 	}
+	rfs.mu.Lock()
+	rfs.mdnsStarted, rfs.mdnsErr = err == nil, err
+	rfs.mu.Unlock()
 }
@@ -0,0 +1,48 @@
+package remote
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mungujn/web-exp/metrics"
+)
+
+// messageName returns the metric label of a message type
+func messageName(messageType string) string {
+	if kind, ok := messageKinds[messageType]; ok {
+		return kind.name
+	}
+	return "unknown"
+}
+
+// outcome returns the metric label of how a request ended
+func outcome(err error) string {
+	var busyErr *BusyError
+	switch {
+	case err == nil:
+		return metrics.OK
+	case errors.As(err, &busyErr):
+		return metrics.Busy
+	default:
+		return metrics.Failed
+	}
+}
+
+// observeRequest records a request made to another peer, which answered with received bytes
+func observeRequest(messageType string, start time.Time, received int, err error) {
+	metrics.PeerRequestsMade.WithLabelValues(messageName(messageType), outcome(err)).Inc()
+	metrics.PeerRequestDuration.WithLabelValues(messageName(messageType)).Observe(time.Since(start).Seconds())
+	observeBytes(messageType, metrics.In, received)
+}
+
+// observeBytes records bytes exchanged with another peer for a request of messageType
+func observeBytes(messageType, direction string, size int) {
+	if size > 0 {
+		metrics.PeerBytes.WithLabelValues(messageName(messageType), direction).Add(float64(size))
+	}
+}
+
+// observeServed records a request answered for another peer
+func observeServed(messageType, result string) {
+	metrics.PeerRequestsServed.WithLabelValues(messageName(messageType), result).Inc()
+}
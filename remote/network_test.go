@@ -0,0 +1,439 @@
+package remote_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/app"
+	"github.com/mungujn/web-exp/metrics"
+	"github.com/mungujn/web-exp/remote"
+	"github.com/mungujn/web-exp/remote/remotetest"
+	"github.com/mungujn/web-exp/share"
+)
+
+func Test_GetFile(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "host1", Files: os.DirFS("test_data/host_1")},
+		remotetest.NodeConfig{Username: "host2", Files: os.DirFS("test_data/host_2")},
+	)
+
+	cases := []struct {
+		Name          string
+		Username      string
+		Path          string
+		Host          string
+		ExpectedBytes []byte
+	}{
+		{
+			Name:          "root element",
+			Username:      "host2",
+			Path:          "error.png",
+			Host:          "host1",
+			ExpectedBytes: getFile("test_data/expected/error.png"),
+		},
+		{
+			Name:          "nested element",
+			Username:      "host2",
+			Path:          "nested/file.js",
+			Host:          "host1",
+			ExpectedBytes: getFile("test_data/expected/file.js"),
+		},
+		{
+			Name:          "root element reversed",
+			Username:      "host1",
+			Path:          "success.png",
+			Host:          "host2",
+			ExpectedBytes: getFile("test_data/expected/success.png"),
+		},
+		{
+			Name:          "nested element reversed",
+			Username:      "host1",
+			Path:          "nested/file.css",
+			Host:          "host2",
+			ExpectedBytes: getFile("test_data/expected/file.css"),
+		},
+		{
+			Name:          "self read",
+			Username:      "",
+			Path:          "success.png",
+			Host:          "host1",
+			ExpectedBytes: getFile("test_data/expected/success.png"),
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, err := network.Node(testCase.Host).GetFile(context.Background(), testCase.Username, testCase.Path)
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.ExpectedBytes, data)
+		})
+	}
+}
+
+func Test_GetFile_latency(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice"},
+		remotetest.NodeConfig{Username: "bob", Files: fstest.MapFS{"a.txt": {Data: []byte("a")}}},
+	)
+	network.SetLatency("alice", "bob", 50*time.Millisecond)
+
+	// the request and the response each cross the link once
+	start := time.Now()
+	data, err := network.Node("alice").GetFile(context.Background(), "bob", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+}
+
+func Test_GetFile_partition(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice"},
+		remotetest.NodeConfig{Username: "bob", Files: fstest.MapFS{"a.txt": {Data: []byte("a")}}},
+		remotetest.NodeConfig{Username: "carol"},
+	)
+	ctx := context.Background()
+
+	network.Partition("alice", "bob")
+	_, err := network.Node("alice").GetFile(ctx, "bob", "a.txt")
+	assert.Error(t, err)
+
+	// the rest of the network is unaffected
+	data, err := network.Node("carol").GetFile(ctx, "bob", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	network.Heal("alice", "bob")
+	data, err = network.Node("alice").GetFile(ctx, "bob", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+}
+
+func Test_GetFile_changed(t *testing.T) {
+	docs := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(docs, "a.txt"), []byte("old"), 0600))
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Config: app.Config{CacheSize: 1 << 20}},
+		remotetest.NodeConfig{Username: "bob", Shares: share.Shares{{Name: "docs", Root: docs}}},
+	)
+	alice := network.Node("alice")
+	qualified := remote.QualifiedName("bob", network.Node("bob").Host.ID().Pretty())
+	ctx := context.Background()
+
+	// files are cached whichever name their owner is addressed by, and dropped from the cache once the owner
+	// announces they changed. Notifications may be published before alice subscribed, so the file is written
+	// until one reaches her.
+	for _, name := range []string{"bob", qualified} {
+		data, err := alice.GetFile(ctx, name, "docs/a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "old", string(data))
+	}
+	network.Wait("alice to fetch the file bob changed", func() bool {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(docs, "a.txt"), []byte("new"), 0600))
+		data, err := alice.GetFile(ctx, qualified, "docs/a.txt")
+		return err == nil && string(data) == "new"
+	})
+	data, err := alice.GetFile(ctx, "bob", "docs/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+}
+
+func Test_GetFile_crash(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice"},
+		remotetest.NodeConfig{Username: "bob", Files: fstest.MapFS{"a.txt": {Data: []byte("a")}}},
+	)
+
+	network.Crash("bob")
+	_, err := network.Node("alice").GetFile(context.Background(), "bob", "a.txt")
+	assert.Error(t, err)
+}
+
+func getFile(path string) []byte {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []byte("will fail")
+	}
+	return contents
+}
+
+func Test_Manifest(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Files: fstest.MapFS{"index.html": {Data: []byte("home")}}, Shares: share.Shares{
+			{Name: "docs", Files: fstest.MapFS{"a.md": {Data: []byte("a")}}},
+			{Name: "team", Allowed: []string{"carol"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+		}},
+		remotetest.NodeConfig{Username: "bob"},
+	)
+
+	entries, err := network.Node("bob").Manifest(context.Background(), "alice", "")
+	assert.NoError(t, err)
+	paths := make([]string, 0)
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, []string{"index.html", "docs/a.md"}, paths)
+
+	entries, err = network.Node("bob").Manifest(context.Background(), "alice", "docs")
+	assert.NoError(t, err)
+	assert.Equal(t, []share.ManifestEntry{{
+		Path: "docs/a.md",
+		Size: 1,
+		Hash: "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+	}}, entries)
+}
+
+func Test_GetFile_blocks(t *testing.T) {
+	// a file of four and a half blocks, too large to be sent in its block list
+	contents := make([]byte, 1152<<10)
+	rand.New(rand.NewSource(1)).Read(contents)
+	// nodes keep the blocks they fetched as long as they fit their cache,
+	// alice has none and reads every block asked of her from her file again
+	cfg := app.Config{CacheSize: 4 << 20, MaxFrameSize: 4 << 20}
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Files: fstest.MapFS{"video.bin": {Data: contents}, "a.txt": {Data: []byte("a")}}, Shares: share.Shares{
+			{Name: "team", Allowed: []string{"bob", "carol"}, Files: fstest.MapFS{"video.bin": {Data: contents[1:]}}},
+		}},
+		remotetest.NodeConfig{Username: "bob", Config: cfg},
+		remotetest.NodeConfig{Username: "carol", Config: cfg},
+	)
+	ctx := context.Background()
+	for _, username := range []string{"bob", "carol"} {
+		node := network.Node(username)
+		network.Wait(username+" to learn who serves blocks", func() bool {
+			serving := 0
+			for _, peer := range node.GetPeers() {
+				for _, capability := range peer.Capabilities {
+					if capability == "blocks" {
+						serving++
+					}
+				}
+			}
+			return serving == 2
+		})
+	}
+	fetched := func(source string) float64 {
+		return testutil.ToFloat64(metrics.BlocksFetched.WithLabelValues(source))
+	}
+
+	fromOwner := fetched("owner")
+	data, err := network.Node("bob").GetFile(ctx, "alice", "video.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, contents, data)
+	assert.Equal(t, float64(5), fetched("owner")-fromOwner)
+
+	// carol finds every block at bob, and only asks alice for the list of blocks
+	fromOwner, fromPeer := fetched("owner"), fetched("peer")
+	data, err = network.Node("carol").GetFile(ctx, "alice", "video.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, contents, data)
+	assert.Equal(t, float64(5), fetched("peer")-fromPeer)
+	assert.Equal(t, float64(0), fetched("owner")-fromOwner)
+
+	// the blocks of files only some users may read are only sent by their owner
+	_, err = network.Node("bob").GetFile(ctx, "alice", "team/video.bin")
+	assert.NoError(t, err)
+	fromOwner, fromPeer = fetched("owner"), fetched("peer")
+	data, err = network.Node("carol").GetFile(ctx, "alice", "team/video.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, contents[1:], data)
+	assert.Equal(t, float64(0), fetched("peer")-fromPeer)
+	assert.Equal(t, float64(5), fetched("owner")-fromOwner)
+
+	// small files are sent in their block list
+	fromOwner, fromPeer = fetched("owner"), fetched("peer")
+	data, err = network.Node("carol").GetFile(ctx, "alice", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+	assert.Equal(t, float64(0), fetched("peer")-fromPeer+fetched("owner")-fromOwner)
+
+	// access is still checked by the owner when listing blocks
+	_, err = network.Node("carol").GetFile(ctx, "alice", "missing.bin")
+	var remoteErr *remote.RemoteError
+	assert.True(t, errors.As(err, &remoteErr))
+}
+
+func Test_GetRange(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Files: fstest.MapFS{"a.bin": {Data: []byte("0123456789")}}, Shares: share.Shares{
+			{Name: "team", Allowed: []string{"carol"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+		}},
+		remotetest.NodeConfig{Username: "bob"},
+	)
+	bob := network.Node("bob")
+	network.WaitForCapability("bob", "alice", "ranges")
+	ctx := context.Background()
+
+	data, err := bob.GetRange(ctx, "alice", "a.bin", 3, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "3456", string(data))
+
+	data, err = bob.GetRange(ctx, "alice", "a.bin", 8, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "89", string(data))
+
+	_, err = bob.GetRange(ctx, "alice", "team/plan.md", 0, 4)
+	assert.EqualError(t, err, "user alice answered: error reading file: access to share team denied")
+}
+
+func Test_GetArchive(t *testing.T) {
+	// the video is sent over several messages
+	video := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(video)
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Files: fstest.MapFS{
+			"docs/a.md":       {Data: []byte("a")},
+			"docs/video.bin":  {Data: video},
+			"docs/.git/HEAD":  {Data: []byte("ref")},
+			"docs/old/b.md":   {Data: []byte("b")},
+			"notes/secret.md": {Data: []byte("secret")},
+		}, Shares: share.Shares{
+			{Name: "team", Allowed: []string{"carol"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+		}},
+		remotetest.NodeConfig{Username: "bob"},
+	)
+	bob := network.Node("bob")
+	network.WaitForCapability("bob", "alice", "archives")
+	ctx := context.Background()
+
+	var data bytes.Buffer
+	assert.NoError(t, bob.GetArchive(ctx, "alice", "docs", share.ArchiveZip, &data))
+	archive, err := zip.NewReader(bytes.NewReader(data.Bytes()), int64(data.Len()))
+	assert.NoError(t, err)
+	files := make(map[string][]byte)
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		assert.NoError(t, err)
+		files[file.Name], _ = ioutil.ReadAll(reader)
+	}
+	assert.Equal(t, map[string][]byte{
+		"docs/": {}, "docs/a.md": []byte("a"), "docs/video.bin": video, "docs/old/": {}, "docs/old/b.md": []byte("b"),
+	}, files)
+
+	data.Reset()
+	err = bob.GetArchive(ctx, "alice", "team", share.ArchiveTarGz, &data)
+	assert.EqualError(t, err, "user alice answered: error archiving folder: access to share team denied")
+	assert.Equal(t, 0, data.Len())
+
+	err = bob.GetArchive(ctx, "alice", "docs/a.md", share.ArchiveTarGz, &data)
+	assert.EqualError(t, err, "user alice answered: error archiving folder: docs/a.md is not a folder")
+}
+
+func Test_GetRange_peerBytes(t *testing.T) {
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Files: fstest.MapFS{"a.bin": {Data: []byte("0123456789")}}},
+		remotetest.NodeConfig{Username: "bob"},
+	)
+	network.WaitForCapability("bob", "alice", "ranges")
+	peerBytes := func(direction string) float64 {
+		return testutil.ToFloat64(metrics.PeerBytes.WithLabelValues("range", direction))
+	}
+	received, sent := peerBytes(metrics.In), peerBytes(metrics.Out)
+
+	data, err := network.Node("bob").GetRange(context.Background(), "alice", "a.bin", 3, 4)
+	assert.NoError(t, err)
+	// both nodes count into the same registry, and by message type rather than by peer.
+	// alice counts the bytes once they are sent, which may be after bob read them.
+	assert.Equal(t, received+float64(len(data)), peerBytes(metrics.In))
+	assert.Eventually(t, func() bool {
+		return peerBytes(metrics.Out) == sent+float64(len(data))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_ListFolder(t *testing.T) {
+	modified := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Files: fstest.MapFS{
+			"docs/a.md":      {Data: []byte("a"), ModTime: modified},
+			"docs/.git/HEAD": {Data: []byte("ref")},
+		}, Shares: share.Shares{
+			{Name: "team", Allowed: []string{"carol"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+		}},
+		remotetest.NodeConfig{Username: "bob"},
+	)
+	bob := network.Node("bob")
+	network.WaitForCapability("bob", "alice", "folders")
+	ctx := context.Background()
+
+	list, err := bob.ListFolder(ctx, "alice", "docs")
+	assert.NoError(t, err)
+	assert.Equal(t, []share.FileInfo{{Name: "a.md", Size: 1, Modified: modified}}, list)
+
+	_, err = bob.ListFolder(ctx, "alice", "team")
+	assert.EqualError(t, err, "user alice answered: error listing folder: access to share team denied")
+
+	_, err = bob.ListFolder(ctx, "dave", "docs")
+	assert.Error(t, err)
+}
+
+func Test_Stat(t *testing.T) {
+	modified := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Files: fstest.MapFS{
+			"hello.txt": {Data: []byte("hello"), Mode: 0644, ModTime: modified},
+		}, Shares: share.Shares{
+			{Name: "team", Allowed: []string{"carol"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+		}},
+		remotetest.NodeConfig{Username: "bob"},
+	)
+	bob := network.Node("bob")
+	network.WaitForCapability("bob", "alice", "stat")
+	ctx := context.Background()
+
+	stat, err := bob.Stat(ctx, "alice", "hello.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, share.FileStat{
+		Size:        5,
+		Modified:    modified,
+		Mode:        0644,
+		ContentType: "text/plain; charset=utf-8",
+		Hash:        "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}, stat)
+
+	_, err = bob.Stat(ctx, "alice", "team/plan.md")
+	assert.EqualError(t, err, "user alice answered: error describing file: access to share team denied")
+
+	_, err = bob.Stat(ctx, "dave", "hello.txt")
+	assert.Error(t, err)
+}
+
+func Test_PutFile(t *testing.T) {
+	drop, inbox := t.TempDir(), t.TempDir()
+	network := remotetest.New(t,
+		remotetest.NodeConfig{Username: "alice", Shares: share.Shares{
+			{Name: "drop", Root: drop},
+			{Name: "docs", Root: t.TempDir(), ReadOnly: true},
+		}, Config: app.Config{InboxFolder: inbox, InboxMaxSize: 8}},
+		remotetest.NodeConfig{Username: "bob"},
+	)
+	bob := network.Node("bob")
+	ctx := context.Background()
+
+	// plain file names go to the inbox, paths to the share they are in if it is writable
+	assert.NoError(t, bob.PutFile(ctx, "alice", "a.txt", strings.NewReader("a"), 1))
+	data, err := ioutil.ReadFile(filepath.Join(inbox, "bob", "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	assert.NoError(t, bob.PutFile(ctx, "alice", "drop/new/b.txt", strings.NewReader("b"), 1))
+	data, err = ioutil.ReadFile(filepath.Join(drop, "new", "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(data))
+
+	err = bob.PutFile(ctx, "alice", "docs/c.txt", strings.NewReader("c"), 1)
+	assert.EqualError(t, err, "user alice answered: docs/c.txt is in a read only share")
+	err = bob.PutFile(ctx, "alice", "drop/d.txt", strings.NewReader("too large"), 9)
+	assert.EqualError(t, err, "user alice answered: file of 9 bytes exceeds the upload limit of 8 bytes")
+}
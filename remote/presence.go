@@ -0,0 +1,301 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/app"
+)
+
+const (
+	// presenceInterval is how often a node announces itself
+	presenceInterval = 30 * time.Second
+	// presenceTTL is how long a presence record is trusted after it was signed
+	presenceTTL = 3 * presenceInterval
+	// presenceClockSkew is how far in the future a record may be signed
+	presenceClockSkew = time.Minute
+	// presenceJoinDelay is how long a node waits to announce the roster to a peer joining the presence topic,
+	// as messages published right after the peer joined do not always reach it
+	presenceJoinDelay = 2 * time.Second
+
+	capabilityFiles      = "files"
+	capabilityChanges    = "changes"
+	capabilityUpload     = "upload"
+	capabilityBlocks     = "blocks"
+	capabilityRanges     = "ranges"
+	capabilityArchives   = "archives"
+	capabilityFolders    = "folders"
+	capabilityStat       = "stat"
+	capabilityInline     = "inline"
+	capabilityRequestIDs = "requestids"
+)
+
+// presenceVersion is the version of the encoding of presence records, signed along with them
+// so that a record is never read as a version other than the one it was signed as
+const presenceVersion = 1
+
+// PresenceRecord announces a node to the network. It is signed by the node,
+// so other nodes can pass it on without being able to change it.
+type PresenceRecord struct {
+	Username     string   `json:"username"`
+	PeerId       string   `json:"peer_id"`
+	PublicKey    []byte   `json:"public_key"`
+	Shares       []string `json:"shares"`
+	Capabilities []string `json:"capabilities"`
+	Addrs        []string `json:"addrs"`
+	// Timestamp is when the record was signed, in unix nanoseconds
+	Timestamp int64 `json:"timestamp"`
+	// signed is the record as it was published, which is passed on as is
+	signed signedPresence
+}
+
+// signedPresence is a presence record as published: its encoding and the signature over it.
+// The signature covers the bytes sent rather than how a node would encode the record again,
+// so nodes built from other versions of the code can still verify it.
+type signedPresence struct {
+	Version   int             `json:"version"`
+	Record    json.RawMessage `json:"record"`
+	Signature []byte          `json:"signature"`
+}
+
+// presenceAnnouncement is the message published on the presence topic
+type presenceAnnouncement struct {
+	Records []signedPresence `json:"records"`
+}
+
+// signedBytes returns the bytes a signature covers, the version followed by the encoded record
+func signedBytes(version int, record []byte) []byte {
+	return append([]byte(fmt.Sprintf("presence/%d\n", version)), record...)
+}
+
+// sign signs the record with the private key of the node it describes
+func (r *PresenceRecord) sign(prvKey crypto.PrivKey) error {
+	pubKey, err := crypto.MarshalPublicKey(prvKey.GetPublic())
+	if err != nil {
+		return err
+	}
+	r.PublicKey = pubKey
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	signature, err := prvKey.Sign(signedBytes(presenceVersion, data))
+	if err != nil {
+		return err
+	}
+	r.signed = signedPresence{Version: presenceVersion, Record: data, Signature: signature}
+	return nil
+}
+
+// open decodes the record and checks it was signed by the peer it names and is still fresh
+func (s signedPresence) open(now time.Time) (PresenceRecord, error) {
+	var record PresenceRecord
+	if s.Version != presenceVersion {
+		return record, fmt.Errorf("unsupported record version %d", s.Version)
+	}
+	if err := json.Unmarshal(s.Record, &record); err != nil {
+		return record, fmt.Errorf("invalid record: %s", err)
+	}
+	record.signed = s
+	pubKey, err := crypto.UnmarshalPublicKey(record.PublicKey)
+	if err != nil {
+		return record, fmt.Errorf("invalid public key: %s", err)
+	}
+	id, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return record, err
+	}
+	if id.Pretty() != record.PeerId {
+		return record, fmt.Errorf("public key does not belong to peer %s", record.PeerId)
+	}
+	valid, err := pubKey.Verify(signedBytes(s.Version, s.Record), s.Signature)
+	if err != nil || !valid {
+		return record, errors.New("invalid signature")
+	}
+	signed := time.Unix(0, record.Timestamp)
+	if signed.After(now.Add(presenceClockSkew)) {
+		return record, errors.New("record signed in the future")
+	}
+	if now.Sub(signed) > presenceTTL {
+		return record, errors.New("record expired")
+	}
+	return record, nil
+}
+
+// initPresence announces this node on the presence topic every presenceInterval,
+// and announces every record it knows whenever a peer joins the topic, so late joiners
+// learn the whole network from any one peer
+func (rfs *RemoteFilesystem) initPresence(ctx context.Context) error {
+	topic, err := rfs.pubsub.Join(rfs.networkName + "/presence")
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return err
+	}
+	events, err := topic.EventHandler()
+	if err != nil {
+		return err
+	}
+	go rfs.readPresence(ctx, sub)
+
+	go func() {
+		defer events.Cancel()
+		for {
+			event, err := events.NextPeerEvent(ctx)
+			if err != nil {
+				return
+			}
+			if event.Type == pubsub.PeerJoin {
+				log.Debug("peer joined presence topic: ", event.Peer.Pretty())
+				time.AfterFunc(presenceJoinDelay, func() { rfs.announce(ctx, topic, true) })
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(presenceInterval)
+		defer ticker.Stop()
+		for {
+			rfs.announce(ctx, topic, false)
+			rfs.expireUsers(time.Now())
+			rfs.measureLatency(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// announce publishes the record of this node, along with every fresh record known if withRoster is set
+func (rfs *RemoteFilesystem) announce(ctx context.Context, topic *pubsub.Topic, withRoster bool) {
+	own, err := rfs.ownPresence()
+	if err != nil {
+		log.Error("error creating presence record: ", err)
+		return
+	}
+	announcement := presenceAnnouncement{Records: []signedPresence{own.signed}}
+	if withRoster {
+		now := time.Now()
+		rfs.mu.RLock()
+		for _, record := range rfs.presence {
+			if now.Sub(time.Unix(0, record.Timestamp)) <= presenceTTL {
+				announcement.Records = append(announcement.Records, record.signed)
+			}
+		}
+		rfs.mu.RUnlock()
+	}
+	data, err := json.Marshal(announcement)
+	if err != nil {
+		log.Error("error encoding presence announcement: ", err)
+		return
+	}
+	if err = topic.Publish(ctx, data); err != nil && ctx.Err() == nil {
+		log.Error("error publishing presence announcement: ", err)
+	}
+}
+
+// ownPresence returns a freshly signed record of this node
+func (rfs *RemoteFilesystem) ownPresence() (PresenceRecord, error) {
+	capabilities := []string{capabilityFiles, capabilityChanges, capabilityBlocks, capabilityRanges, capabilityArchives,
+		capabilityFolders, capabilityStat, capabilityInline, capabilityRequestIDs}
+	if rfs.inbox != nil {
+		capabilities = append(capabilities, capabilityUpload)
+	}
+	record := PresenceRecord{
+		Username:     rfs.iam,
+		PeerId:       rfs.hostId,
+		Shares:       rfs.shares.Names(),
+		Capabilities: capabilities,
+		Addrs:        rfs.Addrs(),
+		Timestamp:    time.Now().UnixNano(),
+	}
+	err := record.sign(rfs.host.Peerstore().PrivKey(rfs.host.ID()))
+	return record, err
+}
+
+// readPresence adds the peers announced on the presence topic to the roster until ctx is done
+func (rfs *RemoteFilesystem) readPresence(ctx context.Context, sub *pubsub.Subscription) {
+	defer sub.Cancel()
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		if msg.GetFrom().Pretty() == rfs.hostId {
+			continue
+		}
+		var announcement presenceAnnouncement
+		if err = json.Unmarshal(msg.Data, &announcement); err != nil {
+			log.Error("invalid presence announcement from peer ", msg.GetFrom().Pretty(), ": ", err)
+			continue
+		}
+		for _, signed := range announcement.Records {
+			rfs.handlePresence(signed)
+		}
+	}
+}
+
+// handlePresence adds the peer described by a record to the roster, if the record is valid and newer than the one known
+func (rfs *RemoteFilesystem) handlePresence(signed signedPresence) {
+	record, err := signed.open(time.Now())
+	if record.PeerId == rfs.hostId {
+		return
+	}
+	if err != nil {
+		log.Debugf("ignoring presence record of peer %s: %s", record.PeerId, err)
+		return
+	}
+	if err := app.ValidateUsername(record.Username); err != nil {
+		log.Warnf("ignoring presence record of peer %s, username %s", record.PeerId, err)
+		return
+	}
+
+	rfs.mu.Lock()
+	known, exists := rfs.presence[record.PeerId]
+	if exists && known.Timestamp >= record.Timestamp {
+		rfs.mu.Unlock()
+		return
+	}
+	rfs.presence[record.PeerId] = record
+	rfs.mu.Unlock()
+
+	addrs := make([]multiaddr.Multiaddr, 0)
+	for _, addr := range record.Addrs {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			log.Debugf("ignoring invalid address %s of peer %s", addr, record.PeerId)
+			continue
+		}
+		addrs = append(addrs, maddr)
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		log.Debugf("ignoring addresses of peer %s: %s", record.PeerId, err)
+	}
+	for _, info := range infos {
+		if info.ID.Pretty() != record.PeerId {
+			continue
+		}
+		rfs.host.Peerstore().AddAddrs(info.ID, info.Addrs, presenceTTL)
+		rfs.addPeerInfo(info)
+	}
+
+	if !exists {
+		log.Infof("learned of peer %s with username %s from presence announcement", record.PeerId, record.Username)
+	}
+	rfs.addUser(record.Username, record.PeerId, record.Shares)
+}
@@ -0,0 +1,118 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_signedPresence_open(t *testing.T) {
+	// prep
+	prvKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	assert.NoError(t, err)
+	otherKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	assert.NoError(t, err)
+	peerId, err := PeerId(prvKey)
+	assert.NoError(t, err)
+	otherPeerId, err := PeerId(otherKey)
+	assert.NoError(t, err)
+	publicKey, err := crypto.MarshalPublicKey(prvKey.GetPublic())
+	assert.NoError(t, err)
+	now := time.Now()
+
+	signed := func(modify func(record *PresenceRecord)) signedPresence {
+		record := PresenceRecord{
+			Username:  "host1",
+			PeerId:    peerId,
+			Shares:    []string{"docs"},
+			Timestamp: now.UnixNano(),
+		}
+		if modify != nil {
+			modify(&record)
+		}
+		assert.NoError(t, record.sign(prvKey))
+		return record.signed
+	}
+	// signedAs signs a record encoded by hand, as a node running another version would encode it
+	signedAs := func(version int, data string) signedPresence {
+		signature, err := prvKey.Sign(signedBytes(version, []byte(data)))
+		assert.NoError(t, err)
+		return signedPresence{Version: version, Record: json.RawMessage(data), Signature: signature}
+	}
+	encodedKey, err := json.Marshal(publicKey)
+	assert.NoError(t, err)
+	newerRecord := `{"status": "away", "username": "host1", "peer_id": "` + peerId + `", "public_key": ` + string(encodedKey) +
+		`, "timestamp": ` + strconv.FormatInt(now.UnixNano(), 10) + `}`
+
+	cases := []struct {
+		Name          string
+		Signed        signedPresence
+		ExpectedError string
+	}{
+		{
+			Name:   "valid",
+			Signed: signed(nil),
+		},
+		{
+			Name:   "encoded by another version",
+			Signed: signedAs(presenceVersion, newerRecord),
+		},
+		{
+			Name:          "unsupported version",
+			Signed:        signedAs(presenceVersion+1, newerRecord),
+			ExpectedError: "unsupported record version 2",
+		},
+		{
+			Name: "tampered after signing",
+			Signed: func() signedPresence {
+				record := signed(nil)
+				record.Record = bytes.Replace(record.Record, []byte("host1"), []byte("host2"), 1)
+				return record
+			}(),
+			ExpectedError: "invalid signature",
+		},
+		{
+			Name: "version changed after signing",
+			Signed: func() signedPresence {
+				record := signedAs(presenceVersion+1, newerRecord)
+				record.Version = presenceVersion
+				return record
+			}(),
+			ExpectedError: "invalid signature",
+		},
+		{
+			Name:          "claims another peer",
+			Signed:        signed(func(record *PresenceRecord) { record.PeerId = otherPeerId }),
+			ExpectedError: "public key does not belong to peer " + otherPeerId,
+		},
+		{
+			Name:          "expired",
+			Signed:        signed(func(record *PresenceRecord) { record.Timestamp = now.Add(-presenceTTL - time.Second).UnixNano() }),
+			ExpectedError: "record expired",
+		},
+		{
+			Name:          "signed in the future",
+			Signed:        signed(func(record *PresenceRecord) { record.Timestamp = now.Add(2 * presenceClockSkew).UnixNano() }),
+			ExpectedError: "record signed in the future",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			record, err := testCase.Signed.open(now)
+			if testCase.ExpectedError == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, "host1", record.Username)
+				assert.Equal(t, testCase.Signed, record.signed)
+				return
+			}
+			assert.EqualError(t, err, testCase.ExpectedError)
+		})
+	}
+}
@@ -2,32 +2,36 @@ package remote
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io"
-	"io/ioutil"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	mrand "math/rand"
-
 	libp2phost "github.com/libp2p/go-libp2p-core/host"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"bufio"
-	"crypto/rand"
 	"fmt"
 
 	"github.com/mungujn/web-exp/app"
+	"github.com/mungujn/web-exp/metrics"
+	"github.com/mungujn/web-exp/share"
+	"github.com/mungujn/web-exp/tracing"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 
 	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
 
 	"github.com/multiformats/go-multiaddr"
 )
@@ -37,42 +41,133 @@ const (
 	handshake      = "h"
 	remoteData     = "d"
 	remoteError    = "e"
+	upload         = "u"
+	search         = "s"
+	busy           = "b"
+	manifest       = "l"
+	blockListing   = "k"
+	blockQuery     = "v"
+	blockRequest   = "x"
+	fileRange      = "g"
+	archive        = "a"
+	folderListing  = "f"
+	fileStat       = "t"
 )
 
+// messageKind describes how a type of message is handled
+type messageKind struct {
+	// name labels the message type in metrics
+	name string
+	// limited requests count against the PEER_REQUESTS_PER_MINUTE of their sender
+	limited bool
+	// transfers send or receive file contents, and take one of the MAX_CONCURRENT_TRANSFERS while served
+	transfer bool
+}
+
+// messageKinds holds the properties of every message type
+var messageKinds = map[string]messageKind{
+	remoteFilepath: {name: "file", limited: true, transfer: true},
+	handshake:      {name: "handshake"},
+	remoteData:     {name: "data"},
+	remoteError:    {name: "error"},
+	upload:         {name: "upload", limited: true, transfer: true},
+	search:         {name: "search", limited: true},
+	busy:           {name: "busy"},
+	manifest:       {name: "manifest", limited: true},
+	blockListing:   {name: "block_list", limited: true},
+	blockQuery:     {name: "block_query", limited: true},
+	blockRequest:   {name: "block", limited: true, transfer: true},
+	fileRange:      {name: "range", limited: true, transfer: true},
+	archive:        {name: "archive", limited: true, transfer: true},
+	folderListing:  {name: "folder", limited: true},
+	fileStat:       {name: "stat", limited: true},
+}
+
 // RemoteFilesystem is a remote filesystem host built around libp2p
 type RemoteFilesystem struct {
-	iam                 string
-	rootFolder          string
-	listenHost          string
-	listenPort          int
-	networkName         string
-	protocolId          string
-	host                libp2phost.Host
-	hostId              string
-	peerIds             map[string]peer.AddrInfo
-	usernameToPeerId    map[string]string
-	usernames           []string
+	iam         string
+	shares      share.Shares
+	listenHost  string
+	listenPort  int
+	networkName string
+	protocolId  string
+	host        libp2phost.Host
+	hostId      string
+	mu          sync.RWMutex
+	peerIds     map[string]peer.AddrInfo
+	// usernameToPeerId maps the names users are listed under, qualified while claimed by more than one peer,
+	// to their peer IDs, and usernames holds them in the order the users joined
+	usernameToPeerId map[string]string
+	usernames        []string
+	// peerIdToUsername, peerIdToShares and lastSeen hold what each peer announced and when
+	peerIdToUsername map[string]string
+	peerIdToShares   map[string][]string
+	lastSeen         map[string]time.Time
+	presence         map[string]PresenceRecord
+	// knownPeers pins usernames to the peer IDs of the nodes that own them
+	knownPeers         map[string]string
+	inbox              *share.Inbox
+	index              *share.Index
+	searchFileContents bool
+	pubsub             *pubsub.PubSub
+	cache              *fileCache
+	blocks             *blockStore
+	blockLists         *blockListCache
+	maxFrameSize       int64
+	// maxUploadSize bounds the files written to writable shares, as INBOX_MAX_SIZE bounds those saved to the inbox
+	maxUploadSize       int64
+	limits              *limits
+	mdnsStarted         bool
+	mdnsErr             error
+	changes             chan share.Change
 	runGlobal           bool
+	runBridge           bool
 	customBootstrapPeer string
 	debug               bool
+	keyFile             string
 }
 
 // New creates a new RemoteFilesystem host using libp2p
 func New(dcfg app.Config) *RemoteFilesystem {
 	log.Debugf("setting up the remote node system using host %s and port %d", dcfg.LocalNodeHost, dcfg.LocalNodePort)
+	shares, err := dcfg.AllShares()
+	if err != nil {
+		log.Error("error reading shares, only LOCAL_ROOT_FOLDER will be served: ", err)
+		shares = share.Shares{{Name: share.DefaultName, Root: dcfg.LocalRootFolder, ReadOnly: true}}
+	}
+	knownPeers, err := app.ParseKnownPeers(dcfg.KnownPeers)
+	if err != nil {
+		log.Error("error reading known peers, no username will be pinned: ", err)
+	}
 	return &RemoteFilesystem{
 		iam:                 dcfg.Username,
-		rootFolder:          dcfg.LocalRootFolder,
+		shares:              shares,
+		inbox:               dcfg.Inbox(),
+		searchFileContents:  dcfg.SearchFileContents,
+		cache:               newFileCache(dcfg.CacheSize),
+		blocks:              newBlockStore(dcfg.CacheSize),
+		blockLists:          newBlockListCache(),
+		maxFrameSize:        dcfg.MaxFrameSize,
+		maxUploadSize:       dcfg.InboxMaxSize,
+		limits:              newLimits(dcfg),
+		changes:             make(chan share.Change, changesBuffer),
 		listenHost:          dcfg.LocalNodeHost,
 		listenPort:          dcfg.LocalNodePort,
 		networkName:         dcfg.NetworkName,
 		protocolId:          fmt.Sprintf("/%s/%s", dcfg.ProtocolId, dcfg.ProtocolVersion),
-		runGlobal:           dcfg.RunGlobal,
+		runGlobal:           dcfg.RunGlobal || dcfg.RunBridge,
+		runBridge:           dcfg.RunBridge,
 		customBootstrapPeer: dcfg.CustomBootstrapPeer,
 		debug:               dcfg.Debug,
+		keyFile:             dcfg.KeyFile,
 		peerIds:             make(map[string]peer.AddrInfo),
 		usernameToPeerId:    make(map[string]string),
 		usernames:           make([]string, 0),
+		peerIdToUsername:    make(map[string]string),
+		peerIdToShares:      make(map[string][]string),
+		lastSeen:            make(map[string]time.Time),
+		presence:            make(map[string]PresenceRecord),
+		knownPeers:          knownPeers,
 	}
 }
 
@@ -80,17 +175,7 @@ func New(dcfg app.Config) *RemoteFilesystem {
 func (rfs *RemoteFilesystem) StartHost(ctx context.Context) error {
 	log.Infof("will listen on: %s with port: %d\n", rfs.listenHost, rfs.listenPort)
 
-	var r io.Reader
-
-	if rfs.debug {
-		log.Info("debug mode is on, will use port number as random seed data")
-		r = mrand.New(mrand.NewSource(int64(9223372036854775807 - rfs.listenPort)))
-	} else {
-		r = rand.Reader
-	}
-
-	// Creates a new RSA key pair for this host.
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	prvKey, err := identity(rfs.keyFile, rfs.debug, rfs.listenPort)
 	if err != nil {
 		log.Error("error generating host identity: ", err)
 		return err
@@ -110,18 +195,50 @@ func (rfs *RemoteFilesystem) StartHost(ctx context.Context) error {
 	// Other options can be added here.
 	if rfs.runGlobal {
 		log.Info("running global node")
-		host, err = getGlobalHost(ctx, prvKey, sourceMultiAddr, idht)
+		host, err = getGlobalHost(ctx, prvKey, sourceMultiAddr, idht, rfs.runBridge)
 	} else {
 		log.Info("running local node")
 		host, err = libp2p.New(
 			libp2p.ListenAddrs(sourceMultiAddr),
 			libp2p.Identity(prvKey),
+			libp2p.BandwidthReporter(metrics.NewBandwidthCounter()),
 		)
 	}
 
 	if err != nil {
-		log.Error("error creating host:", err)
+		log.Error("error creating host: ", err)
+		return err
+	}
+	if err = rfs.start(ctx, host); err != nil {
+		return err
 	}
+	log.Debugf("\nthis hosts Multiaddress Is: /ip4/%s/tcp/%v/p2p/%s\n", rfs.listenHost, rfs.listenPort, rfs.hostId)
+
+	rfs.initMDNS()
+
+	if rfs.runGlobal {
+		connectToPublicPeers(ctx, rfs.host, rfs.customBootstrapPeer)
+	}
+
+	return nil
+}
+
+// NewWithHost creates a RemoteFilesystem serving shares on an existing host, which is closed when ctx is done.
+// Peers are not discovered over mDNS, they have to be introduced with HandlePeerFound. This lets tests run
+// nodes on an in-memory network. The shares of dcfg are published if shares is nil.
+func NewWithHost(ctx context.Context, dcfg app.Config, host libp2phost.Host, shares share.Shares) (*RemoteFilesystem, error) {
+	rfs := New(dcfg)
+	if shares != nil {
+		rfs.shares = shares
+	}
+	if err := rfs.start(ctx, host); err != nil {
+		return nil, err
+	}
+	return rfs, nil
+}
+
+// start serves the protocol on host and starts the indexing, change notification and presence services
+func (rfs *RemoteFilesystem) start(ctx context.Context, host libp2phost.Host) error {
 	rfs.host = host
 	rfs.setUpGracefulHostStop(ctx)
 
@@ -130,68 +247,249 @@ func (rfs *RemoteFilesystem) StartHost(ctx context.Context) error {
 	rfs.host.SetStreamHandler(protocol.ID(rfs.protocolId), rfs.handleStream)
 	rfs.hostId = host.ID().Pretty()
 
-	log.Debugf("\nthis hosts Multiaddress Is: /ip4/%s/tcp/%v/p2p/%s\n", rfs.listenHost, rfs.listenPort, rfs.hostId)
 	log.Debug("this hosts peer ID Is: ", rfs.hostId)
 
-	rfs.initMDNS()
+	rfs.index = share.NewIndex(rfs.shares, rfs.searchFileContents)
 
-	if rfs.runGlobal {
-		connectToPublicPeers(ctx, rfs.host, rfs.customBootstrapPeer)
+	var err error
+	rfs.pubsub, err = pubsub.NewGossipSub(ctx, rfs.host)
+	if err != nil {
+		log.Error("error starting pubsub: ", err)
+		return err
+	}
+	if err = rfs.initChanges(ctx); err != nil {
+		log.Error("error starting change notifications: ", err)
+		return err
+	}
+	if err = rfs.initPresence(ctx); err != nil {
+		log.Error("error starting presence announcements: ", err)
+		return err
 	}
-
 	return nil
 }
 
 // GetFile returns a file from any peer, including the current one
-func (rfs *RemoteFilesystem) GetFile(ctx context.Context, username, path string) ([]byte, error) {
-	var fullPath string
+func (rfs *RemoteFilesystem) GetFile(ctx context.Context, username, path string) (file []byte, err error) {
 	if username == "" {
-		fullPath = rfs.rootFolder + "/" + path
-		log.Debug("reading local file: ", fullPath)
-		return ioutil.ReadFile(fullPath)
+		log.Debug("reading local file: ", path)
+		return rfs.shares.ReadFile(share.Self, path)
 	} else {
-		log.Debugf("reading remote file %s from user %s ", path, username)
+		requestID := tracing.RequestID(ctx)
+		log.WithField(tracing.RequestIDKey, requestID).Debugf("reading remote file %s from user %s ", path, username)
+		ctx, span := tracing.StartSpan(ctx, "remote.GetFile", attribute.String("username", username), attribute.String("path", path))
+		defer func() {
+			tracing.End(span, err)
+		}()
 
-		peerId, exists := rfs.usernameToPeerId[username]
-		if !exists {
-			return nil, fmt.Errorf("username %s is not assciated with a peer id", username)
+		// files are cached by the peer ID of their owner, as a user may be addressed by more than one name
+		owner, known := rfs.peerIdOf(username)
+		if data, ok := rfs.cache.get(owner, path); known && ok {
+			log.Debug("serving cached file: ", path)
+			span.SetAttributes(attribute.Bool("cache.hit", true))
+			return data, nil
 		}
-		peer, exists := rfs.peerIds[peerId]
-		if !exists {
-			return nil, fmt.Errorf("peer %s not known by current node", username)
+		if data, ok := rfs.cache.expired(owner, path); known && ok && rfs.revalidate(ctx, username, owner, path, data) {
+			log.Debug("serving revalidated cached file: ", path)
+			span.SetAttributes(attribute.Bool("cache.hit", true))
+			return data, nil
+		}
+		// files of owners able to split them into blocks are fetched from any peer holding the blocks
+		if rfs.supports(username, capabilityBlocks) {
+			span.SetAttributes(attribute.Bool("blocks", true))
+			file, err = rfs.getBlocks(ctx, username, path, requestID)
+		} else {
+			file, err = rfs.getWholeFile(ctx, username, path, requestID)
 		}
-
-		stream, err := rfs.host.NewStream(ctx, peer.ID, protocol.ID(rfs.protocolId))
 		if err != nil {
-			return nil, fmt.Errorf("error opening stream to peer %s: %s", username, err)
+			return nil, err
 		}
+		if known {
+			rfs.cache.put(owner, path, file)
+		}
+		return file, nil
+	}
+}
 
-		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+// revalidate reports whether a cached file is still the file its owner has, comparing its hash with the one the owner
+// describes the file with, and makes it fresh again if so. owner is the peer ID of username.
+func (rfs *RemoteFilesystem) revalidate(ctx context.Context, username, owner, path string, data []byte) bool {
+	if !rfs.supports(username, capabilityStat) {
+		return false
+	}
+	stat, err := rfs.Stat(ctx, username, path)
+	if err != nil {
+		log.Debugf("error revalidating cached file %s of user %s: %s", path, username, err)
+		return false
+	}
+	hash := sha256.Sum256(data)
+	if stat.Hash != hex.EncodeToString(hash[:]) {
+		return false
+	}
+	rfs.cache.refresh(owner, path)
+	return true
+}
 
-		err = rfs.writeData(rw, []byte(path), remoteFilepath)
-		if err != nil {
-			return nil, fmt.Errorf("error requesting file from peer %s: %s", username, err)
-		}
+// getWholeFile requests a file of username in a single message
+func (rfs *RemoteFilesystem) getWholeFile(ctx context.Context, username, path, requestID string) ([]byte, error) {
+	// older nodes take everything sent as the path
+	if !rfs.supports(username, capabilityRequestIDs) {
+		requestID = ""
+	}
+	return rfs.request(ctx, username, remoteFilepath, fileRequest(path, requestID))
+}
 
-		data, peerUsername, getting, err := readData(rw)
-		if getting != remoteData {
-			err = fmt.Errorf("not getting data bytes: %s", string(data))
-			log.Error(err)
-		}
-		if peerUsername != username {
-			err = fmt.Errorf("peer %s is not %s", peerUsername, username)
-		}
-		if err != nil {
-			return nil, err
-		}
+// PutFile uploads size bytes of content to the inbox of a remote user, or to a path in one of their writable shares.
+// The upload message carries the file name and size. Once the peer accepts it
+// the content is streamed, and the peer replies with the name it was saved as.
+func (rfs *RemoteFilesystem) PutFile(ctx context.Context, username, filename string, content io.Reader, size int64) (err error) {
+	log.Debugf("uploading file %s to user %s", filename, username)
+	defer func(start time.Time) {
+		observeRequest(upload, start, 0, err)
+	}(time.Now())
+
+	req, err := rfs.openRequest(ctx, username, upload, []byte(fmt.Sprintf("%s\n%d", filename, size)))
+	if err != nil {
+		return err
+	}
+	defer req.close()
+	if _, err = req.read(); err != nil {
+		return err
+	}
+
+	written, err := io.Copy(req.rw, io.LimitReader(content, size))
+	if err == nil {
+		err = req.rw.Flush()
+	}
+	if err != nil {
+		return peerError(ctx, username, opWrite, err)
+	}
+	observeBytes(upload, metrics.Out, int(written))
+	if written != size {
+		return fmt.Errorf("upload incomplete, expected %d bytes, sent %d", size, written)
+	}
+
+	savedAs, err := req.read()
+	if err != nil {
+		return err
+	}
+	log.Infof("file %s saved by user %s as %s", filename, username, string(savedAs))
+	return nil
+}
+
+// Search returns the files of a user matching a query, username is empty for the current user
+func (rfs *RemoteFilesystem) Search(ctx context.Context, username, query string) ([]share.SearchResult, error) {
+	if username == "" {
+		return rfs.index.Search(query, share.Self), nil
+	}
+	data, err := rfs.request(ctx, username, search, []byte(query))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]share.SearchResult, 0)
+	if err = json.Unmarshal(data, &results); err != nil {
+		return nil, &PeerError{Username: username, Op: opRead, Err: protocolError("invalid search results: %s", err)}
+	}
+	return results, nil
+}
+
+// Manifest lists the files of a user under prefix with their hashes, username is empty for the current user
+func (rfs *RemoteFilesystem) Manifest(ctx context.Context, username, prefix string) ([]share.ManifestEntry, error) {
+	if username == "" {
+		return rfs.shares.Manifest(share.Self, prefix)
+	}
+	data, err := rfs.request(ctx, username, manifest, []byte(prefix))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]share.ManifestEntry, 0)
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, &PeerError{Username: username, Op: opRead, Err: protocolError("invalid manifest: %s", err)}
+	}
+	return entries, nil
+}
+
+// GetRange returns up to length bytes of a file of a user from offset, as stored, fewer at the end of the file.
+// username is empty for the current user. Nodes predating ranges are never asked for one.
+func (rfs *RemoteFilesystem) GetRange(ctx context.Context, username, path string, offset, length int64) ([]byte, error) {
+	if username == "" {
+		return rfs.shares.ReadRange(share.Self, path, offset, length)
+	}
+	if !rfs.supports(username, capabilityRanges) {
+		return nil, fmt.Errorf("user %s can not send parts of files", username)
+	}
+	return rfs.request(ctx, username, fileRange, rangeRequest(path, tracing.RequestID(ctx), offset, length))
+}
 
-		return data, nil
+// ListFolder lists a folder of a user by name, username is empty for the current user.
+// Nodes predating folder listings are never asked for one.
+func (rfs *RemoteFilesystem) ListFolder(ctx context.Context, username, path string) ([]share.FileInfo, error) {
+	if username == "" {
+		return rfs.shares.List(share.Self, path)
+	}
+	if _, err := rfs.lookupPeer(username); err != nil {
+		return nil, err
 	}
+	if !rfs.supports(username, capabilityFolders) {
+		return nil, fmt.Errorf("user %s can not list folders", username)
+	}
+	data, err := rfs.request(ctx, username, folderListing, fileRequest(path, tracing.RequestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]share.FileInfo, 0)
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, &PeerError{Username: username, Op: opRead, Err: protocolError("invalid folder listing: %s", err)}
+	}
+	return list, nil
+}
+
+// Stat describes a file of a user without sending its contents, username is empty for the current user
+func (rfs *RemoteFilesystem) Stat(ctx context.Context, username, path string) (share.FileStat, error) {
+	if username == "" {
+		return rfs.shares.Stat(share.Self, path)
+	}
+	if _, err := rfs.lookupPeer(username); err != nil {
+		return share.FileStat{}, err
+	}
+	if !rfs.supports(username, capabilityStat) {
+		return share.FileStat{}, fmt.Errorf("user %s can not describe files", username)
+	}
+	data, err := rfs.request(ctx, username, fileStat, fileRequest(path, tracing.RequestID(ctx)))
+	if err != nil {
+		return share.FileStat{}, err
+	}
+	var stat share.FileStat
+	if err = json.Unmarshal(data, &stat); err != nil {
+		return share.FileStat{}, &PeerError{Username: username, Op: opRead, Err: protocolError("invalid file description: %s", err)}
+	}
+	return stat, nil
 }
 
 // GetOnlineNodes returns usernames of all online nodes
 func (rfs *RemoteFilesystem) GetOnlineNodes() []string {
-	return rfs.usernames
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	return append([]string{}, rfs.usernames...)
+}
+
+// GetShares returns the named shares of a user, username is empty for the current user
+func (rfs *RemoteFilesystem) GetShares(username string) []string {
+	if username == "" {
+		return rfs.shares.Names()
+	}
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	peerId, _ := rfs.resolve(username)
+	return rfs.peerIdToShares[peerId]
+}
+
+// Addrs returns the full multiaddresses, including peer ID, that other peers can reach this host on
+func (rfs *RemoteFilesystem) Addrs() []string {
+	addrs := make([]string, 0)
+	for _, addr := range rfs.host.Addrs() {
+		addrs = append(addrs, fmt.Sprintf("%s/p2p/%s", addr, rfs.hostId))
+	}
+	return addrs
 }
 
 // handshakePeer initiates a handshake with a peer for username exchange
@@ -211,12 +509,14 @@ func (rfs *RemoteFilesystem) handshakePeer(peer peer.AddrInfo) {
 	if err != nil {
 		log.Error("stream open failed: ", err)
 	} else {
-		rfs.peerIds[peerId] = peer
+		rfs.addPeerInfo(peer)
 		log.Infof("peer %s now known by current node", peerId)
 
 		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
 
-		err = rfs.writeData(rw, []byte(rfs.hostId), handshake)
+		// the handshake carries the host ID, followed by the names of the shares on the next line
+		message := rfs.hostId + "\n" + strings.Join(rfs.shares.Names(), ",")
+		err = rfs.writeData(rw, []byte(message), handshake)
 		if err != nil {
 			log.Error("error writing handshake message: ", err)
 		} else {
@@ -232,46 +532,319 @@ func (rfs *RemoteFilesystem) handleStream(stream network.Stream) {
 	// Create a buffer stream for non blocking read and write.
 	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
 
-	data, sender, getting, err := readData(rw)
+	data, sender, getting, err := readData(rw, rfs.maxFrameSize)
 	if err != nil {
 		log.Error("error reading data: ", err)
+		metrics.StreamErrors.WithLabelValues("read").Inc()
+		// tell peers breaking the protocol what was wrong, such as a message larger than allowed
+		if errors.Is(err, ErrProtocol) {
+			if err = rfs.writeData(rw, []byte(fmt.Sprintf("error reading message: %s", err)), remoteError); err != nil {
+				log.Debug("error replying to unreadable message: ", err)
+			}
+		}
+		return
 	}
+
+	remotePeer := stream.Conn().RemotePeer()
+	kind := messageKinds[getting]
+	if kind.limited {
+		if delay, ok := rfs.limits.allowRequest(remotePeer); !ok {
+			observeServed(getting, metrics.Busy)
+			rfs.replyBusy(rw, remotePeer, delay)
+			return
+		}
+	}
+	if kind.transfer {
+		done, ok := rfs.limits.startTransfer()
+		if !ok {
+			observeServed(getting, metrics.Busy)
+			rfs.replyBusy(rw, remotePeer, transferRetryAfter)
+			return
+		}
+		defer done()
+	}
+
 	switch getting {
 	case handshake:
 		log.Infof("got handshake from: %s", sender)
-		peerId := string(data)
-		peerId = strings.Replace(peerId, "\n", "", -1)
-		rfs.usernames = append(rfs.usernames, sender)
-		rfs.usernameToPeerId[sender] = peerId
+		if err := app.ValidateUsername(sender); err != nil {
+			log.Warnf("rejecting handshake from peer %s, username %s", stream.Conn().RemotePeer().Pretty(), err)
+			metrics.Handshakes.WithLabelValues(metrics.Rejected).Inc()
+			break
+		}
+		lines := strings.SplitN(string(data), "\n", 2)
+		peerId := lines[0]
+		if peerId != remotePeer.Pretty() {
+			log.Warnf("rejecting handshake from peer %s, claiming to be peer %s", remotePeer.Pretty(), peerId)
+			metrics.Handshakes.WithLabelValues(metrics.Rejected).Inc()
+			break
+		}
+		shares := make([]string, 0)
+		if len(lines) == 2 && lines[1] != "" {
+			shares = strings.Split(lines[1], ",")
+		}
+		rfs.addPeerInfo(peer.AddrInfo{ID: remotePeer, Addrs: []multiaddr.Multiaddr{stream.Conn().RemoteMultiaddr()}})
+		rfs.addUser(sender, peerId, shares)
+		metrics.Handshakes.WithLabelValues(metrics.OK).Inc()
 		log.Infof("connected to peer: %s with username %s", peerId, sender)
 	case remoteFilepath:
-		path := string(data)
-		path = strings.Replace(path, "\n", "", -1)
-		log.Infof("user: %s is requesting %s", sender, path)
-		responseData, err := rfs.GetFile(context.TODO(), "", path)
+		path, requestID := parseFileRequest(data)
+		requestLog := log.WithField(tracing.RequestIDKey, requestID)
+		requestLog.Infof("user: %s is requesting %s", sender, path)
+		ctx, span := tracing.StartSpan(tracing.WithRequestID(context.Background(), requestID), "remote.serveFile",
+			attribute.String("username", sender), attribute.String("path", path))
+		requester := rfs.requester(stream, sender)
+		_, readSpan := tracing.StartSpan(ctx, "share.ReadFile")
+		responseData, err := rfs.shares.ReadFile(requester, path)
+		tracing.End(readSpan, err)
+		_, writeSpan := tracing.StartSpan(ctx, "stream.write")
 		if err != nil {
 			errStr := fmt.Sprintf("error reading file: %s", err)
-			log.Error(errStr)
+			requestLog.Error(errStr)
+			observeServed(getting, metrics.Failed)
 			err = rfs.writeData(rw, []byte(errStr), remoteError)
 		} else {
-			log.Infof("file %s read successfully", path)
+			requestLog.Infof("file %s read successfully", path)
+			observeServed(getting, metrics.OK)
+			throttled := bufio.NewReadWriter(rw.Reader, bufio.NewWriter(rfs.limits.throttle(ctx, remotePeer, stream)))
+			err = rfs.writeData(throttled, responseData, remoteData)
+			if err == nil {
+				observeBytes(remoteFilepath, metrics.Out, len(responseData))
+			}
+		}
+		tracing.End(writeSpan, err)
+		tracing.End(span, err)
+		if err != nil {
+			requestLog.Error("error writing response data: ", err)
+			metrics.StreamErrors.WithLabelValues("write").Inc()
+		} else {
+			requestLog.Infof("sent response to user %s", sender)
+		}
+	case search:
+		query := string(data)
+		log.Infof("user: %s is searching for %s", sender, query)
+		results := rfs.index.Search(query, rfs.requester(stream, sender))
+		responseData, err := json.Marshal(results)
+		if err != nil {
+			observeServed(getting, metrics.Failed)
+			err = rfs.writeData(rw, []byte(err.Error()), remoteError)
+		} else {
+			observeServed(getting, metrics.OK)
 			err = rfs.writeData(rw, responseData, remoteData)
 		}
 		if err != nil {
-			log.Error("error writing response data: ", err)
+			log.Error("error writing search results: ", err)
+			metrics.StreamErrors.WithLabelValues("write").Inc()
+		}
+	case manifest:
+		prefix := string(data)
+		log.Infof("user: %s is listing %s", sender, prefix)
+		entries, err := rfs.shares.Manifest(rfs.requester(stream, sender), prefix)
+		var responseData []byte
+		if err == nil {
+			responseData, err = json.Marshal(entries)
+		}
+		if err != nil {
+			observeServed(getting, metrics.Failed)
+			err = rfs.writeData(rw, []byte(err.Error()), remoteError)
 		} else {
-			log.Infof("sent response to user %s", sender)
+			observeServed(getting, metrics.OK)
+			err = rfs.writeData(rw, responseData, remoteData)
+		}
+		if err != nil {
+			log.Error("error sending manifest: ", err)
+			metrics.StreamErrors.WithLabelValues("write").Inc()
 		}
+	case fileRange:
+		rfs.serveRange(rw, stream, rfs.requester(stream, sender), data)
+	case archive:
+		rfs.serveArchive(rw, stream, rfs.requester(stream, sender), data)
+	case folderListing:
+		rfs.serveFolder(rw, rfs.requester(stream, sender), data)
+	case fileStat:
+		rfs.serveStat(rw, rfs.requester(stream, sender), data)
+	case blockListing:
+		rfs.serveBlockList(rw, rfs.requester(stream, sender), data)
+	case blockQuery:
+		rfs.serveBlockQuery(rw, rfs.requester(stream, sender), data)
+	case blockRequest:
+		rfs.serveBlock(rw, stream, rfs.requester(stream, sender), data)
+	case upload:
+		rfs.handleUpload(rw, rfs.requester(stream, sender), string(data))
 	case remoteData:
 		log.Error("getting remote data from: ", sender)
 	case remoteError:
 		log.Error("getting remote error data from: ", sender)
+	case busy:
+		log.Error("getting busy message from: ", sender)
 	default:
 		log.Error("unknown data type: ", getting)
+		metrics.StreamErrors.WithLabelValues("unknown_type").Inc()
 	}
 	// 'stream' will stay open until closed (or the other side closes it).
 }
 
+// handleUpload saves a file streamed after an upload message to the inbox or a writable share, replying with the saved name
+func (rfs *RemoteFilesystem) handleUpload(rw *bufio.ReadWriter, uploader, message string) {
+	var err error
+	parts := strings.SplitN(message, "\n", 2)
+	size := int64(-1)
+	if len(parts) == 2 {
+		size, err = strconv.ParseInt(parts[1], 10, 64)
+	}
+	if len(parts) != 2 || err != nil {
+		err = errors.New("invalid upload message")
+	} else {
+		err = rfs.checkUpload(uploader, parts[0], size)
+	}
+	if err != nil {
+		log.Error("upload rejected: ", err)
+		observeServed(upload, metrics.Rejected)
+		if err = rfs.writeData(rw, []byte(err.Error()), remoteError); err != nil {
+			log.Error("error writing upload response: ", err)
+		}
+		return
+	}
+
+	log.Infof("user: %s is uploading %s of %d bytes", uploader, parts[0], size)
+	if err = rfs.writeData(rw, []byte("ready"), remoteData); err != nil {
+		log.Error("error writing upload response: ", err)
+		return
+	}
+	savedAs, err := rfs.saveUpload(uploader, parts[0], rw, size)
+	if err != nil {
+		log.Error("error saving upload: ", err)
+		observeServed(upload, metrics.Failed)
+		err = rfs.writeData(rw, []byte(err.Error()), remoteError)
+	} else {
+		log.Infof("upload from user %s saved as %s", uploader, savedAs)
+		observeServed(upload, metrics.OK)
+		observeBytes(upload, metrics.In, int(size))
+		err = rfs.writeData(rw, []byte(savedAs), remoteData)
+	}
+	if err != nil {
+		log.Error("error writing upload response: ", err)
+	}
+}
+
+// checkUpload reports why an upload can not be accepted, if it can not. Files named with a folder are written to
+// the share the path is in, provided it is writable, and any other file is saved to the inbox.
+func (rfs *RemoteFilesystem) checkUpload(uploader, name string, size int64) error {
+	if !share.IsSharePath(name) {
+		return rfs.inbox.Check(uploader, size)
+	}
+	if size < 0 || size > rfs.maxUploadSize {
+		return fmt.Errorf("file of %d bytes exceeds the upload limit of %d bytes", size, rfs.maxUploadSize)
+	}
+	return rfs.shares.CheckWrite(uploader, name)
+}
+
+// saveUpload saves an upload checked by checkUpload, returning the name it was saved as
+func (rfs *RemoteFilesystem) saveUpload(uploader, name string, content io.Reader, size int64) (string, error) {
+	if !share.IsSharePath(name) {
+		return rfs.inbox.Save(uploader, name, content, size)
+	}
+	return name, rfs.shares.WriteFile(uploader, name, content, size)
+}
+
+// serveRange sends part of a file shared with requester, never more than a message may hold
+func (rfs *RemoteFilesystem) serveRange(rw *bufio.ReadWriter, stream network.Stream, requester string, data []byte) {
+	path, requestID, offset, length, err := parseRangeRequest(data)
+	requestLog := log.WithField(tracing.RequestIDKey, requestID)
+	var responseData []byte
+	if err == nil {
+		requestLog.Infof("user: %s is requesting %d bytes of %s from %d", requester, length, path, offset)
+		if length > rfs.maxFrameSize {
+			length = rfs.maxFrameSize
+		}
+		responseData, err = rfs.shares.ReadRange(requester, path, offset, length)
+	}
+	if err != nil {
+		errStr := fmt.Sprintf("error reading file: %s", err)
+		requestLog.Error(errStr)
+		observeServed(fileRange, metrics.Failed)
+		err = rfs.writeData(rw, []byte(errStr), remoteError)
+	} else {
+		observeServed(fileRange, metrics.OK)
+		remotePeer := stream.Conn().RemotePeer()
+		throttled := bufio.NewReadWriter(rw.Reader, bufio.NewWriter(rfs.limits.throttle(context.Background(), remotePeer, stream)))
+		err = rfs.writeData(throttled, responseData, remoteData)
+		if err == nil {
+			observeBytes(fileRange, metrics.Out, len(responseData))
+		}
+	}
+	if err != nil {
+		requestLog.Error("error sending file range: ", err)
+		metrics.StreamErrors.WithLabelValues("write").Inc()
+	}
+}
+
+// serveFolder sends the listing of a folder shared with requester
+func (rfs *RemoteFilesystem) serveFolder(rw *bufio.ReadWriter, requester string, data []byte) {
+	path, requestID := parseFileRequest(data)
+	requestLog := log.WithField(tracing.RequestIDKey, requestID)
+	requestLog.Infof("user: %s is listing folder %s", requester, path)
+	list, err := rfs.shares.List(requester, path)
+	var responseData []byte
+	if err == nil {
+		responseData, err = json.Marshal(list)
+	}
+	if err != nil {
+		requestLog.Error("error listing folder: ", err)
+		observeServed(folderListing, metrics.Failed)
+		err = rfs.writeData(rw, []byte(fmt.Sprintf("error listing folder: %s", err)), remoteError)
+	} else {
+		observeServed(folderListing, metrics.OK)
+		err = rfs.writeData(rw, responseData, remoteData)
+	}
+	if err != nil {
+		requestLog.Error("error sending folder listing: ", err)
+		metrics.StreamErrors.WithLabelValues("write").Inc()
+	}
+}
+
+// serveStat describes a file shared with requester
+func (rfs *RemoteFilesystem) serveStat(rw *bufio.ReadWriter, requester string, data []byte) {
+	path, requestID := parseFileRequest(data)
+	requestLog := log.WithField(tracing.RequestIDKey, requestID)
+	requestLog.Infof("user: %s is describing file %s", requester, path)
+	stat, err := rfs.shares.Stat(requester, path)
+	var responseData []byte
+	if err == nil {
+		responseData, err = json.Marshal(stat)
+	}
+	if err != nil {
+		requestLog.Error("error describing file: ", err)
+		observeServed(fileStat, metrics.Failed)
+		err = rfs.writeData(rw, []byte(fmt.Sprintf("error describing file: %s", err)), remoteError)
+	} else {
+		observeServed(fileStat, metrics.OK)
+		err = rfs.writeData(rw, responseData, remoteData)
+	}
+	if err != nil {
+		requestLog.Error("error sending file description: ", err)
+		metrics.StreamErrors.WithLabelValues("write").Inc()
+	}
+}
+
+// replyBusy tells a peer that is over a limit when to try again
+func (rfs *RemoteFilesystem) replyBusy(rw *bufio.ReadWriter, remotePeer peer.ID, retryAfter time.Duration) {
+	log.Warnf("peer %s is over its limits, asking it to retry after %s", remotePeer.Pretty(), retryAfter)
+	if err := rfs.writeData(rw, []byte(retryAfterSeconds(retryAfter)), busy); err != nil {
+		log.Error("error writing busy message: ", err)
+	}
+}
+
+// requester returns the username to check share access for, which is the claimed sender
+// only if the streams remote peer is the one that handshaked with that username
+func (rfs *RemoteFilesystem) requester(stream network.Stream, sender string) string {
+	remotePeerId := stream.Conn().RemotePeer().Pretty()
+	if claimed, name := rfs.userOf(remotePeerId); sender != "" && claimed == sender && name != "" {
+		return name
+	}
+	return "peer:" + remotePeerId
+}
+
 // writeData writes a message to a stream
 func (rfs *RemoteFilesystem) writeData(rw *bufio.ReadWriter, data []byte, sending string) error {
 	sendingCount := len(data)
@@ -298,49 +871,195 @@ func (rfs *RemoteFilesystem) writeData(rw *bufio.ReadWriter, data []byte, sendin
 	return nil
 }
 
-// readData reads data from a stream
-func readData(rw *bufio.ReadWriter) ([]byte, string, string, error) {
-	theyAre, err := rw.ReadString('\n')
-	if err != nil {
+// readData reads a message from a stream, returning its payload, sender and type.
+// Messages larger than maxSize are rejected before anything is allocated for them.
+func readData(rw *bufio.ReadWriter, maxSize int64) ([]byte, string, string, error) {
+	line, err := rw.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, "", "", protocolError("message header too long")
+	} else if err != nil {
 		log.Error("error reading from buffer: ", err)
 		return nil, "", "", err
 	}
+	theyAre := string(line)
 
 	log.Debug("string received from client: ", theyAre)
 
-	if theyAre != "" {
-		parts := strings.Split(theyAre, ":")
-		if len(parts) != 3 {
-			return nil, "", "", errors.New("invalid handshake message")
-		}
-		clientUsername := parts[0]
-		sending := parts[1]
-		countStr := parts[2]
-		countStr = strings.Replace(countStr, "\n", "", -1)
-		sendingCount, err := strconv.Atoi(countStr)
-		if err != nil {
-			return nil, "", "", errors.New("invalid handshake message, invalid byte count")
-		}
+	clientUsername, sending, sendingCount, err := parseHeader(theyAre, maxSize)
+	if err != nil {
+		return nil, "", "", err
+	}
 
-		data := make([]byte, sendingCount)
-		count, err := rw.Read(data)
-		if err == io.EOF || err == nil {
-			if count != sendingCount {
-				return nil, "", "", fmt.Errorf(
-					"invalid read message, expected %d bytes, got %d", sendingCount, count,
-				)
-			}
-			log.Debugf("read %d bytes received from client", count)
-			return data, clientUsername, sending, nil
-		} else {
-			log.Error("error reading from buffer: ", err)
-			return nil, "", "", err
-		}
-	} else {
-		err = errors.New("client did not send identity")
+	data := make([]byte, sendingCount)
+	count, err := io.ReadFull(rw, data)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && sendingCount > 0) {
+		return nil, "", "", protocolError("message cut short, expected %d bytes, got %d", sendingCount, count)
+	} else if err != nil {
+		log.Error("error reading from buffer: ", err)
+		return nil, "", "", err
 	}
+	log.Debugf("read %d bytes received from client", count)
+	return data, clientUsername, sending, nil
+}
 
-	return nil, "", "", err
+// parseHeader splits a message header of the form user:type:count into its parts,
+// checking that the byte count is a number between 0 and maxSize
+func parseHeader(header string, maxSize int64) (string, string, int64, error) {
+	header = strings.TrimSuffix(header, "\n")
+	if header == "" {
+		return "", "", 0, protocolError("client did not send identity")
+	}
+	parts := strings.Split(header, ":")
+	if len(parts) != 3 {
+		return "", "", 0, protocolError("invalid message header")
+	}
+	count, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", "", 0, protocolError("invalid message header, invalid byte count")
+	}
+	if count < 0 {
+		return "", "", 0, protocolError("invalid message header, negative byte count %d", count)
+	}
+	if count > maxSize {
+		return "", "", 0, protocolError("message of %d bytes is larger than the %d bytes allowed", count, maxSize)
+	}
+	return parts[0], parts[1], count, nil
+}
+
+// checkResponse checks that the answer to a request came from username and carries data
+func checkResponse(username, peerUsername, getting string, data []byte) error {
+	switch {
+	case getting == busy:
+		return newBusyError(username, data)
+	case getting == remoteError:
+		return &RemoteError{Username: username, Message: string(data)}
+	case getting != remoteData:
+		return &PeerError{Username: username, Op: opRead, Err: protocolError("unexpected message type %q", getting)}
+	case peerUsername != claimedName(username):
+		return &PeerError{Username: username, Op: opRead, Err: protocolError("answer came from %s", peerUsername)}
+	}
+	return nil
+}
+
+// request sends a message of messageType to the peer of username, returning the data it answers with
+func (rfs *RemoteFilesystem) request(ctx context.Context, username, messageType string, payload []byte) (response []byte, err error) {
+	defer func(start time.Time) {
+		observeRequest(messageType, start, len(response), err)
+	}(time.Now())
+
+	req, err := rfs.openRequest(ctx, username, messageType, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer req.close()
+
+	_, readSpan := tracing.StartSpan(ctx, "stream.read")
+	response, err = req.read()
+	readSpan.SetAttributes(attribute.Int("bytes", len(response)))
+	tracing.End(readSpan, err)
+	return response, err
+}
+
+// peerRequest is a message sent to the peer of a user, answered on the stream it was sent on
+type peerRequest struct {
+	ctx          context.Context
+	username     string
+	stream       network.Stream
+	rw           *bufio.ReadWriter
+	maxFrameSize int64
+	// stopReset stops the stream from being reset once ctx is done
+	stopReset func()
+}
+
+// openRequest opens a stream to the peer of username and sends a message of messageType on it.
+// Requests of more than one answer are read from the returned request, which has to be closed.
+func (rfs *RemoteFilesystem) openRequest(ctx context.Context, username, messageType string, payload []byte) (*peerRequest, error) {
+	peer, err := rfs.lookupPeer(username)
+	if err != nil {
+		return nil, err
+	}
+
+	_, openSpan := tracing.StartSpan(ctx, "stream.open")
+	stream, err := rfs.host.NewStream(ctx, peer.ID, protocol.ID(rfs.protocolId))
+	tracing.End(openSpan, err)
+	if err != nil {
+		metrics.StreamErrors.WithLabelValues("open").Inc()
+		return nil, peerError(ctx, username, opOpen, err)
+	}
+	req := &peerRequest{
+		ctx:          ctx,
+		username:     username,
+		stream:       stream,
+		rw:           bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream)),
+		maxFrameSize: rfs.maxFrameSize,
+		stopReset:    resetOnDone(ctx, stream),
+	}
+
+	_, writeSpan := tracing.StartSpan(ctx, "stream.write")
+	err = rfs.writeData(req.rw, payload, messageType)
+	tracing.End(writeSpan, err)
+	if err != nil {
+		req.close()
+		return nil, peerError(ctx, username, opWrite, err)
+	}
+	return req, nil
+}
+
+// read returns the data of the next answer of the peer, failing on any other answer
+func (r *peerRequest) read() ([]byte, error) {
+	data, peerUsername, getting, err := readData(r.rw, r.maxFrameSize)
+	if err != nil {
+		return nil, peerError(r.ctx, r.username, opRead, err)
+	}
+	if err = checkResponse(r.username, peerUsername, getting, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// close closes the stream of the request
+func (r *peerRequest) close() {
+	r.stopReset()
+	r.stream.Close()
+}
+
+// fileRequest is the payload of a file request, the path followed by the request ID on a line of its own.
+// Without a request ID it is the bare path.
+func fileRequest(path, requestID string) []byte {
+	if requestID == "" {
+		return []byte(path)
+	}
+	return []byte(path + "\n" + requestID)
+}
+
+// parseFileRequest splits a file request into its path and request ID.
+// The request ID is empty if the peer sent none, or one that can not be used.
+func parseFileRequest(data []byte) (string, string) {
+	lines := strings.SplitN(string(data), "\n", 2)
+	path, requestID := lines[0], ""
+	if len(lines) == 2 && tracing.ValidRequestID(lines[1]) {
+		requestID = lines[1]
+	}
+	return path, requestID
+}
+
+// rangeRequest is the payload of a range request, the offset and length followed by a file request
+func rangeRequest(path, requestID string, offset, length int64) []byte {
+	return append([]byte(fmt.Sprintf("%d %d\n", offset, length)), fileRequest(path, requestID)...)
+}
+
+// parseRangeRequest splits a range request into its path, request ID, offset and length
+func parseRangeRequest(data []byte) (string, string, int64, int64, error) {
+	lines := strings.SplitN(string(data), "\n", 2)
+	var offset, length int64
+	if len(lines) != 2 {
+		return "", "", 0, 0, errors.New("invalid range request")
+	}
+	if _, err := fmt.Sscanf(lines[0], "%d %d", &offset, &length); err != nil {
+		return "", "", 0, 0, fmt.Errorf("invalid range %q", lines[0])
+	}
+	path, requestID := parseFileRequest([]byte(lines[1]))
+	return path, requestID, offset, length, nil
 }
 
 // setUpGracefulHostStop sets up a graceful shutdown of the host
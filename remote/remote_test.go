@@ -1,146 +1,161 @@
 package remote
 
 import (
-	"context"
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
 	"testing"
-	"time"
-
-	"io/ioutil"
-
-	log "github.com/sirupsen/logrus"
-
-	"github.com/mungujn/web-exp/app"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func Test_GetFile(t *testing.T) {
-	// prep
-	networkName := "test_network"
-	protocolId := "test_protocol"
-	protocolV := "0.1"
-
-	// prep host 1
-	dcfg1 := app.Config{
-		Username:        "host1",
-		LocalRootFolder: "test_data/host_1",
-		LocalNodeHost:   "0.0.0.0",
-		LocalNodePort:   4042,
-		NetworkName:     networkName,
-		ProtocolId:      protocolId,
-		ProtocolVersion: protocolV,
-		RunGlobal:       false,
+func Test_parseFileRequest(t *testing.T) {
+	cases := []struct {
+		Name              string
+		Data              string
+		ExpectedPath      string
+		ExpectedRequestID string
+	}{
+		{Name: "with request id", Data: string(fileRequest("docs/a.html", "0123abcd")), ExpectedPath: "docs/a.html", ExpectedRequestID: "0123abcd"},
+		{Name: "without request id", Data: string(fileRequest("docs/a.html", "")), ExpectedPath: "docs/a.html"},
+		{Name: "path only", Data: "docs/a.html", ExpectedPath: "docs/a.html"},
+		{Name: "unusable request id", Data: "docs/a.html\nbad id:\n", ExpectedPath: "docs/a.html"},
 	}
-	h1Ctx, h1Cancel := context.WithCancel(context.Background())
-	host1 := New(dcfg1)
-	err := host1.StartHost(h1Ctx)
-	assert.NoError(t, err)
-	defer h1Cancel()
-
-	// prep host 2
-	dcfg2 := app.Config{
-		Username:        "host2",
-		LocalRootFolder: "test_data/host_2",
-		LocalNodeHost:   "0.0.0.0",
-		LocalNodePort:   4043,
-		NetworkName:     networkName,
-		ProtocolId:      protocolId,
-		ProtocolVersion: protocolV,
-		RunGlobal:       false,
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			path, requestID := parseFileRequest([]byte(testCase.Data))
+			assert.Equal(t, testCase.ExpectedPath, path)
+			assert.Equal(t, testCase.ExpectedRequestID, requestID)
+		})
 	}
-	h2Ctx, h2Cancel := context.WithCancel(context.Background())
-	host2 := New(dcfg2)
-	err = host2.StartHost(h2Ctx)
+}
+
+func Test_fileRequest(t *testing.T) {
+	// nodes from before request IDs read the whole payload as the path
+	assert.Equal(t, "docs/a.html", string(fileRequest("docs/a.html", "")))
+	assert.Equal(t, "docs/a.html\n0123abcd", string(fileRequest("docs/a.html", "0123abcd")))
+}
+
+func Test_parseRangeRequest(t *testing.T) {
+	path, requestID, offset, length, err := parseRangeRequest(rangeRequest("docs/a.bin", "0123abcd", 1<<32, 4096))
 	assert.NoError(t, err)
-	defer h2Cancel()
+	assert.Equal(t, "docs/a.bin", path)
+	assert.Equal(t, "0123abcd", requestID)
+	assert.Equal(t, int64(1<<32), offset)
+	assert.Equal(t, int64(4096), length)
 
-	// prep test cases
+	_, _, _, _, err = parseRangeRequest([]byte("docs/a.bin"))
+	assert.EqualError(t, err, "invalid range request")
+	_, _, _, _, err = parseRangeRequest([]byte("ten\ndocs/a.bin"))
+	assert.EqualError(t, err, `invalid range "ten"`)
+}
+
+func Test_readData(t *testing.T) {
 	cases := []struct {
-		Name          string
-		Username      string
-		Path          string
-		Host          int
-		ExpectedBytes []byte
+		Name             string
+		Raw              string
+		ExpectedData     string
+		ExpectedUsername string
+		ExpectedType     string
+		ExpectedErr      string
 	}{
-		{
-			Name:          "root element",
-			Username:      "host2",
-			Path:          "error.png",
-			Host:          1,
-			ExpectedBytes: getFile("test_data/expected/error.png"),
-		},
-		{
-			Name:          "nested element",
-			Username:      "host2",
-			Path:          "nested/file.js",
-			Host:          1,
-			ExpectedBytes: getFile("test_data/expected/file.js"),
-		},
-		{
-			Name:          "root element reversed",
-			Username:      "host1",
-			Path:          "success.png",
-			Host:          2,
-			ExpectedBytes: getFile("test_data/expected/success.png"),
-		},
-		{
-			Name:          "nested element reversed",
-			Username:      "host1",
-			Path:          "nested/file.css",
-			Host:          2,
-			ExpectedBytes: getFile("test_data/expected/file.css"),
-		},
-		{
-			Name:          "self read",
-			Username:      "",
-			Path:          "success.png",
-			Host:          1,
-			ExpectedBytes: getFile("test_data/expected/success.png"),
-		},
-	}
-
-	start := time.Now()
-	for {
-		if time.Since(start) > time.Second*5 {
-			t.Fatal("timed out before successful host handshake")
-		}
-		usernames1 := host1.GetOnlineNodes()
-		usernames2 := host2.GetOnlineNodes()
-		if len(usernames1) == 1 && len(usernames2) == 1 {
-			if usernames1[0] == "host2" && usernames2[0] == "host1" {
-				break
-			}
-		}
-		log.Info("u1 ", usernames1, "u2 ", usernames2)
-		time.Sleep(time.Second)
-
+		{Name: "message", Raw: "bob:d:5\nhello", ExpectedData: "hello", ExpectedUsername: "bob", ExpectedType: "d"},
+		{Name: "empty payload", Raw: "bob:h:0\n", ExpectedData: "", ExpectedUsername: "bob", ExpectedType: "h"},
+		{Name: "payload followed by more", Raw: "bob:d:2\nhello", ExpectedData: "he", ExpectedUsername: "bob", ExpectedType: "d"},
+		{Name: "largest payload", Raw: "bob:d:16\n0123456789abcdef", ExpectedData: "0123456789abcdef", ExpectedUsername: "bob", ExpectedType: "d"},
+		{Name: "nothing sent", Raw: "", ExpectedErr: "EOF"},
+		{Name: "header without newline", Raw: "bob:d:5", ExpectedErr: "EOF"},
+		{Name: "empty header", Raw: "\n", ExpectedErr: "protocol error: client did not send identity"},
+		{Name: "too few parts", Raw: "bob:5\nhello", ExpectedErr: "protocol error: invalid message header"},
+		{Name: "too many parts", Raw: "bob:d:x:5\nhello", ExpectedErr: "protocol error: invalid message header"},
+		{Name: "count not a number", Raw: "bob:d:five\nhello", ExpectedErr: "protocol error: invalid message header, invalid byte count"},
+		{Name: "count overflows", Raw: "bob:d:99999999999999999999\nhello", ExpectedErr: "protocol error: invalid message header, invalid byte count"},
+		{Name: "negative count", Raw: "bob:d:-5\nhello", ExpectedErr: "protocol error: invalid message header, negative byte count -5"},
+		{Name: "count over the limit", Raw: "bob:d:17\n0123456789abcdefg", ExpectedErr: "protocol error: message of 17 bytes is larger than the 16 bytes allowed"},
+		{Name: "huge count", Raw: "bob:d:9223372036854775807\nhello", ExpectedErr: "protocol error: message of 9223372036854775807 bytes is larger than the 16 bytes allowed"},
+		{Name: "payload cut short", Raw: "bob:d:10\nhello", ExpectedErr: "protocol error: message cut short, expected 10 bytes, got 5"},
+		{Name: "payload missing", Raw: "bob:d:10\n", ExpectedErr: "protocol error: message cut short, expected 10 bytes, got 0"},
+		{Name: "header too long", Raw: strings.Repeat("b", 5000) + ":d:5\nhello", ExpectedErr: "protocol error: message header too long"},
 	}
-
-	// run tests
 	for _, testCase := range cases {
 		t.Run(testCase.Name, func(t *testing.T) {
-			log.Debug("testing host case: ", testCase.Path)
-			var host *RemoteFilesystem
-			var ctx context.Context
-			if testCase.Host == 1 {
-				host = host1
-				ctx = h1Ctx
-			} else {
-				host = host2
-				ctx = h2Ctx
+			data, username, messageType, err := readData(readerOf(testCase.Raw), 16)
+			if testCase.ExpectedErr != "" {
+				assert.EqualError(t, err, testCase.ExpectedErr)
+				assert.Nil(t, data)
+				return
 			}
-			data, err := host.GetFile(ctx, testCase.Username, testCase.Path)
-			// writeFile(testCase.Name, data)
-			assert.Nil(t, err)
-			assert.Equal(t, testCase.ExpectedBytes, data)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.ExpectedData, string(data))
+			assert.Equal(t, testCase.ExpectedUsername, username)
+			assert.Equal(t, testCase.ExpectedType, messageType)
 		})
 	}
 }
 
-func getFile(path string) []byte {
-	contents, err := ioutil.ReadFile(path)
-	if err != nil {
-		return []byte("will fail")
+// fuzzFrameSize is the largest message accepted by the fuzz targets
+const fuzzFrameSize = 1 << 10
+
+// readerOf returns a stream that reads raw
+func readerOf(raw string) *bufio.ReadWriter {
+	return bufio.NewReadWriter(bufio.NewReader(strings.NewReader(raw)), bufio.NewWriter(io.Discard))
+}
+
+func FuzzReadData(f *testing.F) {
+	for _, seed := range []string{
+		"bob:d:5\nhello",
+		"bob:h:0\n",
+		"bob:d:-1\n",
+		"bob:d:10\nhello",
+		"bob:d:9223372036854775807\n",
+		"bob:d:1025\n",
+		"bob::\n",
+		":::\n",
+		"\n",
+	} {
+		f.Add([]byte(seed))
 	}
-	return contents
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		data, _, _, err := readData(readerOf(string(raw)), fuzzFrameSize)
+		if err != nil {
+			if data != nil {
+				t.Errorf("data %q returned with error %s", data, err)
+			}
+			return
+		}
+		if len(data) > fuzzFrameSize {
+			t.Errorf("read %d bytes, more than the %d allowed", len(data), fuzzFrameSize)
+		}
+		if len(data) > len(raw) {
+			t.Errorf("read %d bytes from a %d byte message", len(data), len(raw))
+		}
+	})
+}
+
+func FuzzFrame(f *testing.F) {
+	f.Add("bob", "d", []byte("hello"))
+	f.Add("bob", "h", []byte{})
+	f.Add("b-o_b.1", "u", []byte("a.txt\n5"))
+	f.Fuzz(func(t *testing.T, username, messageType string, payload []byte) {
+		if len(payload) > fuzzFrameSize || strings.ContainsAny(username+messageType, ":\n") {
+			t.Skip("not a frame a node would send")
+		}
+		if len(username)+len(messageType) > 4000 {
+			t.Skip("header longer than the read buffer")
+		}
+		var buf bytes.Buffer
+		rw := bufio.NewReadWriter(bufio.NewReader(&buf), bufio.NewWriter(&buf))
+		rfs := &RemoteFilesystem{iam: username}
+		if err := rfs.writeData(rw, payload, messageType); err != nil {
+			t.Fatal(err)
+		}
+		data, sender, sending, err := readData(rw, fuzzFrameSize)
+		if err != nil {
+			t.Fatalf("frame written for %q of type %q with %d bytes not read back: %s", username, messageType, len(payload), err)
+		}
+		if sender != username || sending != messageType || !bytes.Equal(data, payload) {
+			t.Errorf("read %q %q %q back, wrote %q %q %q", sender, sending, data, username, messageType, payload)
+		}
+	})
 }
@@ -0,0 +1,354 @@
+// Package remotetest runs RemoteFilesystem nodes on an in-memory libp2p network for tests.
+// Nodes share files from memory, find each other without mDNS, and the links between them
+// can be slowed down, cut and restored, or their nodes crashed.
+package remotetest
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/mungujn/web-exp/app"
+	"github.com/mungujn/web-exp/remote"
+	"github.com/mungujn/web-exp/share"
+)
+
+const (
+	// waitTimeout is how long Wait waits for a condition before failing the test
+	waitTimeout = 5 * time.Second
+	// waitInterval is how often Wait checks its condition
+	waitInterval = 10 * time.Millisecond
+	// maxFrameSize is the largest message nodes accept unless their config sets one
+	maxFrameSize = 1 << 20
+)
+
+// NodeConfig describes a node of the network
+type NodeConfig struct {
+	Username string
+	// Files are served from the default share of the node, usually an fstest.MapFS
+	Files fs.FS
+	// Shares are published by the node besides the default share, set their Files to keep them in memory
+	Shares share.Shares
+	// Config is the base configuration of the node, Username is always replaced
+	Config app.Config
+	// Pinned are users of nodes started before this one whose usernames it pins to their peer IDs in KNOWN_PEERS
+	Pinned []string
+}
+
+// Node is a RemoteFilesystem running on the in-memory network
+type Node struct {
+	*remote.RemoteFilesystem
+	Username string
+	Host     host.Host
+	cancel   context.CancelFunc
+}
+
+// Network is a set of nodes on an in-memory libp2p network
+type Network struct {
+	t     testing.TB
+	mn    mocknet.Mocknet
+	nodes map[string]*Node
+	// protocol is the protocol ID spoken by the nodes
+	protocol protocol.ID
+	// peers counts the hosts added to the network, to give each its own address
+	peers int
+}
+
+// Rogue is a peer speaking the protocol by hand, to test how nodes cope with peers that misbehave
+type Rogue struct {
+	Host host.Host
+	n    *Network
+}
+
+// New starts a node for every config and connects every node to every other one,
+// returning once all of them know each other. The network is shut down when the test ends.
+func New(t testing.TB, configs ...NodeConfig) *Network {
+	t.Helper()
+	n := &Network{t: t, mn: mocknet.New(), nodes: make(map[string]*Node)}
+	t.Cleanup(func() {
+		for _, node := range n.nodes {
+			node.cancel()
+		}
+		n.mn.Close() // nolint:errcheck
+	})
+	for _, cfg := range configs {
+		n.addNode(cfg)
+	}
+	usernames := n.Usernames()
+	for i, a := range usernames {
+		for _, b := range usernames[i+1:] {
+			n.Connect(a, b)
+		}
+	}
+	return n
+}
+
+// addHost adds a host with a new identity and address to the network
+func (n *Network) addHost() host.Host {
+	n.t.Helper()
+	prvKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		n.t.Fatal("error generating host key: ", err)
+	}
+	n.peers++
+	addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/4040", net.IPv4(10, 0, byte(n.peers>>8), byte(n.peers))))
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	h, err := n.mn.AddPeer(prvKey, addr)
+	if err != nil {
+		n.t.Fatal("error adding host to the network: ", err)
+	}
+	return h
+}
+
+// addNode creates the host of a node on the network and starts the node on it
+func (n *Network) addNode(cfg NodeConfig) {
+	n.t.Helper()
+	h := n.addHost()
+
+	dcfg := cfg.Config
+	dcfg.Username = cfg.Username
+	if dcfg.NetworkName == "" {
+		dcfg.NetworkName, dcfg.ProtocolId, dcfg.ProtocolVersion = "test_network", "test_protocol", "0.1"
+	}
+	if dcfg.MaxFrameSize == 0 {
+		dcfg.MaxFrameSize = maxFrameSize
+	}
+	for _, username := range cfg.Pinned {
+		pin := username + "=" + n.Node(username).Host.ID().Pretty()
+		dcfg.KnownPeers = strings.Trim(dcfg.KnownPeers+","+pin, ",")
+	}
+	n.protocol = protocol.ID(fmt.Sprintf("/%s/%s", dcfg.ProtocolId, dcfg.ProtocolVersion))
+	shares := append(share.Shares{{Name: share.DefaultName, Files: cfg.Files, ReadOnly: true}}, cfg.Shares...)
+	if cfg.Files == nil {
+		shares[0].Files = fstest.MapFS{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rfs, err := remote.NewWithHost(ctx, dcfg, h, shares)
+	if err != nil {
+		cancel()
+		n.t.Fatal("error starting node: ", err)
+	}
+	n.nodes[cfg.Username] = &Node{RemoteFilesystem: rfs, Username: cfg.Username, Host: h, cancel: cancel}
+}
+
+// Node returns the node of a user, failing the test if there is none
+func (n *Network) Node(username string) *Node {
+	n.t.Helper()
+	node, ok := n.nodes[username]
+	if !ok {
+		n.t.Fatalf("no node for user %s", username)
+	}
+	return node
+}
+
+// Usernames returns the users of every node, in order
+func (n *Network) Usernames() []string {
+	usernames := make([]string, 0, len(n.nodes))
+	for username := range n.nodes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// Connect links the nodes of two users and has them handshake, returning once both know the other
+func (n *Network) Connect(a, b string) {
+	n.t.Helper()
+	nodeA, nodeB := n.Node(a), n.Node(b)
+	if _, err := n.mn.LinkPeers(nodeA.Host.ID(), nodeB.Host.ID()); err != nil {
+		n.t.Fatalf("error linking %s and %s: %s", a, b, err)
+	}
+	nodeA.HandlePeerFound(*host.InfoFromHost(nodeB.Host))
+	nodeB.HandlePeerFound(*host.InfoFromHost(nodeA.Host))
+	n.Wait(fmt.Sprintf("%s and %s to know each other", a, b), func() bool {
+		return knows(nodeA, b) && knows(nodeB, a)
+	})
+}
+
+// SetLatency delays everything sent between the nodes of two users
+func (n *Network) SetLatency(a, b string, latency time.Duration) {
+	n.t.Helper()
+	for _, link := range n.mn.LinksBetweenPeers(n.Node(a).Host.ID(), n.Node(b).Host.ID()) {
+		link.SetOptions(mocknet.LinkOptions{Latency: latency})
+	}
+}
+
+// Partition cuts the link between the nodes of two users, closing their connections.
+// The nodes still list each other as users, but can not reach each other until Heal is called.
+func (n *Network) Partition(a, b string) {
+	n.t.Helper()
+	idA, idB := n.Node(a).Host.ID(), n.Node(b).Host.ID()
+	if err := n.mn.UnlinkPeers(idA, idB); err != nil {
+		n.t.Fatalf("error unlinking %s and %s: %s", a, b, err)
+	}
+	if err := n.mn.DisconnectPeers(idA, idB); err != nil {
+		n.t.Fatalf("error disconnecting %s and %s: %s", a, b, err)
+	}
+}
+
+// Heal restores the link between the nodes of two users cut by Partition
+func (n *Network) Heal(a, b string) {
+	n.t.Helper()
+	n.Connect(a, b)
+}
+
+// Crash stops the node of a user and closes its host, as if its process died.
+// Its links are cut too, as a closed mock host would still accept connections.
+func (n *Network) Crash(username string) {
+	n.t.Helper()
+	node := n.Node(username)
+	for _, other := range n.Usernames() {
+		if other != username && len(n.mn.LinksBetweenPeers(node.Host.ID(), n.Node(other).Host.ID())) > 0 {
+			n.Partition(username, other)
+		}
+	}
+	node.cancel()
+	if err := node.Host.Close(); err != nil {
+		n.t.Fatalf("error closing host of %s: %s", username, err)
+	}
+}
+
+// AddRogue adds a peer that answers the streams nodes open to it with handler.
+// It is linked to every node, but no node knows it until it handshakes.
+func (n *Network) AddRogue(handler network.StreamHandler) *Rogue {
+	n.t.Helper()
+	r := &Rogue{Host: n.addHost(), n: n}
+	r.Host.SetStreamHandler(n.protocol, handler)
+	for _, username := range n.Usernames() {
+		if _, err := n.mn.LinkPeers(r.Host.ID(), n.Node(username).Host.ID()); err != nil {
+			n.t.Fatalf("error linking rogue to %s: %s", username, err)
+		}
+	}
+	return r
+}
+
+// Send opens a stream to the node of a user, writes raw to it and closes it
+func (r *Rogue) Send(to, raw string) {
+	r.n.t.Helper()
+	node := r.n.Node(to)
+	r.Host.Peerstore().AddAddrs(node.Host.ID(), node.Host.Addrs(), peerstore.PermanentAddrTTL)
+	stream, err := r.Host.NewStream(context.Background(), node.Host.ID(), r.n.protocol)
+	if err != nil {
+		r.n.t.Fatalf("error opening stream to %s: %s", to, err)
+	}
+	defer stream.Close()
+	if _, err = io.WriteString(stream, raw); err != nil {
+		r.n.t.Fatalf("error writing to %s: %s", to, err)
+	}
+}
+
+// Request opens a stream to the node of a user, writes raw to it and returns the message it answers with,
+// its header included
+func (r *Rogue) Request(to, raw string) string {
+	r.n.t.Helper()
+	node := r.n.Node(to)
+	r.Host.Peerstore().AddAddrs(node.Host.ID(), node.Host.Addrs(), peerstore.PermanentAddrTTL)
+	stream, err := r.Host.NewStream(context.Background(), node.Host.ID(), r.n.protocol)
+	if err != nil {
+		r.n.t.Fatalf("error opening stream to %s: %s", to, err)
+	}
+	defer stream.Close()
+	if _, err = io.WriteString(stream, raw); err != nil {
+		r.n.t.Fatalf("error writing to %s: %s", to, err)
+	}
+	// in-memory streams have no deadlines, so the stream is reset if no answer comes in time
+	timer := time.AfterFunc(waitTimeout, func() {
+		_ = stream.Reset()
+	})
+	defer timer.Stop()
+	reader := bufio.NewReader(stream)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		r.n.t.Fatalf("error reading the answer of %s: %s", to, err)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(header[strings.LastIndex(header, ":")+1:]))
+	if err != nil {
+		r.n.t.Fatalf("invalid answer header from %s: %q", to, header)
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		r.n.t.Fatalf("error reading the answer of %s: %s", to, err)
+	}
+	return header + string(payload)
+}
+
+// Handshake introduces the rogue to the node of a user as username, with the peer ID it claims,
+// returning once the node lists the username, or its qualified name if another node claims it too
+func (r *Rogue) Handshake(to, username string) {
+	r.n.t.Helper()
+	r.Send(to, Frame(username, "h", r.Host.ID().Pretty()+"\n"))
+	r.n.Wait(fmt.Sprintf("%s to know %s", to, username), func() bool {
+		for _, known := range r.n.Node(to).GetPeers() {
+			qualified := remote.QualifiedName(username, r.Host.ID().Pretty())
+			if known.PeerId == r.Host.ID().Pretty() && (known.Username == username || known.Username == qualified) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Frame returns a message as written by a peer: a header naming the sender, the message type and the
+// payload size, followed by the payload
+func Frame(username, messageType, payload string) string {
+	return fmt.Sprintf("%s:%s:%d\n%s", username, messageType, len(payload), payload)
+}
+
+// Wait polls condition until it holds, failing the test if it does not within a few seconds
+func (n *Network) Wait(what string, condition func() bool) {
+	n.t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			n.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(waitInterval)
+	}
+}
+
+// WaitForCapability waits until the node of username learns that the node of peer announced a capability
+func (n *Network) WaitForCapability(username, peer, capability string) {
+	n.t.Helper()
+	node := n.Node(username)
+	n.Wait(fmt.Sprintf("%s to learn that %s announced %s", username, peer, capability), func() bool {
+		for _, known := range node.GetPeers() {
+			for _, announced := range known.Capabilities {
+				if known.Username == peer && announced == capability {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// knows reports whether node lists username among the online users
+func knows(node *Node, username string) bool {
+	for _, online := range node.GetOnlineNodes() {
+		if online == username {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package remote
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/app"
+	"github.com/mungujn/web-exp/metrics"
+	"github.com/mungujn/web-exp/share"
+)
+
+// addPeerInfo records how to reach a peer
+func (rfs *RemoteFilesystem) addPeerInfo(info peer.AddrInfo) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	rfs.peerIds[info.ID.Pretty()] = info
+}
+
+// qualifier separates a username from the end of the peer ID qualifying it
+const qualifier = app.UsernameQualifier
+
+// qualifiedLength is how many characters of the end of a peer ID qualify a username
+const qualifiedLength = 6
+
+// QualifiedName returns the name of the user of a peer qualified by the end of its peer ID. Nodes list users
+// by qualified names while more than one peer claims their username, and they can be addressed by them at any time.
+func QualifiedName(username, peerId string) string {
+	if len(peerId) > qualifiedLength {
+		peerId = peerId[len(peerId)-qualifiedLength:]
+	}
+	return username + qualifier + peerId
+}
+
+// claimedName returns the username a name as listed in the roster was claimed as, dropping any qualification
+func claimedName(name string) string {
+	username, _, _ := strings.Cut(name, qualifier)
+	return username
+}
+
+// addUser records the username a peer claims and the names of the users shares.
+// A peer has a single username, any other username it was known by is dropped.
+func (rfs *RemoteFilesystem) addUser(username, peerId string, shares []string) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	previous, known := rfs.peerIdToUsername[peerId]
+	if known && previous != username {
+		log.Infof("peer %s renamed from %s to %s", peerId, previous, username)
+		rfs.removeUser(peerId)
+		rfs.nameClaimants(previous)
+	}
+	rfs.peerIdToUsername[peerId] = username
+	rfs.peerIdToShares[peerId] = shares
+	rfs.lastSeen[peerId] = time.Now()
+	rfs.nameClaimants(username)
+	metrics.RosterSize.Set(float64(len(rfs.usernames)))
+}
+
+// nameClaimants names every peer claiming username in the roster, rfs.mu has to be held. The peers are named by
+// username if it is theirs alone, and by their qualified names if another peer, or the current user, claims it too.
+// A username pinned in KNOWN_PEERS names its own peer only. Claimants that went offline stay in the roster until their
+// presence record expires, so that a peer claiming the username of a user who just went offline can not pass for them.
+func (rfs *RemoteFilesystem) nameClaimants(username string) {
+	claimants := make([]string, 0)
+	for peerId, claimed := range rfs.peerIdToUsername {
+		if claimed == username {
+			claimants = append(claimants, peerId)
+		}
+	}
+	owner, pinned := rfs.knownPeers[username]
+	for _, peerId := range claimants {
+		name := username
+		switch {
+		case username == rfs.iam:
+			name = QualifiedName(username, peerId)
+		case pinned:
+			if peerId != owner {
+				name = QualifiedName(username, peerId)
+			}
+		case len(claimants) > 1:
+			name = QualifiedName(username, peerId)
+		}
+		if previous := rfs.nameOf(peerId); previous != name && name != username {
+			log.Warnf("username %s of peer %s is claimed by another node too, listing it as %s", username, peerId, name)
+		}
+		rfs.setName(peerId, name)
+	}
+}
+
+// setName lists a peer under name, in the place of any name it was listed under before, rfs.mu has to be held
+func (rfs *RemoteFilesystem) setName(peerId, name string) {
+	previous := rfs.nameOf(peerId)
+	if previous == name {
+		return
+	}
+	rfs.usernameToPeerId[name] = peerId
+	if previous == "" {
+		rfs.usernames = append(rfs.usernames, name)
+		return
+	}
+	delete(rfs.usernameToPeerId, previous)
+	for i, known := range rfs.usernames {
+		if known == previous {
+			rfs.usernames[i] = name
+			break
+		}
+	}
+}
+
+// nameOf returns the name a peer is listed under, empty if it is not in the roster, rfs.mu has to be held
+func (rfs *RemoteFilesystem) nameOf(peerId string) string {
+	for name, namedPeerId := range rfs.usernameToPeerId {
+		if namedPeerId == peerId {
+			return name
+		}
+	}
+	return ""
+}
+
+// removeUser drops a peer from the roster, rfs.mu has to be held
+func (rfs *RemoteFilesystem) removeUser(peerId string) {
+	name := rfs.nameOf(peerId)
+	delete(rfs.usernameToPeerId, name)
+	delete(rfs.peerIdToUsername, peerId)
+	delete(rfs.peerIdToShares, peerId)
+	delete(rfs.lastSeen, peerId)
+	for i, known := range rfs.usernames {
+		if known == name {
+			rfs.usernames = append(rfs.usernames[:i], rfs.usernames[i+1:]...)
+			break
+		}
+	}
+}
+
+// expireUsers drops the peers that are not connected and were last seen more than presenceTTL before now from the
+// roster, along with their presence records. The usernames they claimed are given back to the remaining claimants.
+func (rfs *RemoteFilesystem) expireUsers(now time.Time) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	expired := make(map[string]bool)
+	for peerId, username := range rfs.peerIdToUsername {
+		lastSeen := rfs.lastSeen[peerId]
+		if now.Sub(lastSeen) <= presenceTTL {
+			continue
+		}
+		if id, err := peer.Decode(peerId); err == nil && rfs.host.Network().Connectedness(id) == network.Connected {
+			continue
+		}
+		log.Infof("dropping peer %s with username %s, last seen %s", peerId, username, lastSeen.Format(time.RFC3339))
+		rfs.removeUser(peerId)
+		delete(rfs.presence, peerId)
+		delete(rfs.peerIds, peerId)
+		expired[username] = true
+	}
+	for username := range expired {
+		rfs.nameClaimants(username)
+	}
+	metrics.RosterSize.Set(float64(len(rfs.usernames)))
+}
+
+// resolve returns the peer ID of a user by the name it is listed under or its qualified name, rfs.mu has to be held
+func (rfs *RemoteFilesystem) resolve(name string) (string, bool) {
+	if peerId, ok := rfs.usernameToPeerId[name]; ok {
+		return peerId, true
+	}
+	if !strings.Contains(name, qualifier) {
+		return "", false
+	}
+	for peerId, claimed := range rfs.peerIdToUsername {
+		if QualifiedName(claimed, peerId) == name {
+			return peerId, true
+		}
+	}
+	return "", false
+}
+
+// peerIdOf returns the peer ID of a user by the name it is listed under or its qualified name
+func (rfs *RemoteFilesystem) peerIdOf(name string) (string, bool) {
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	return rfs.resolve(name)
+}
+
+// userOf returns the username a peer claims and the name it is listed under, both empty if it is not in the roster
+func (rfs *RemoteFilesystem) userOf(peerId string) (string, string) {
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	return rfs.peerIdToUsername[peerId], rfs.nameOf(peerId)
+}
+
+// lookupPeer returns how to reach the peer of a username
+func (rfs *RemoteFilesystem) lookupPeer(username string) (peer.AddrInfo, error) {
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	peerId, exists := rfs.resolve(username)
+	if !exists {
+		if claimants := rfs.claimantNames(username); len(claimants) > 0 {
+			return peer.AddrInfo{}, fmt.Errorf("username %s is claimed by more than one node, use one of %s",
+				username, strings.Join(claimants, ", "))
+		}
+		return peer.AddrInfo{}, fmt.Errorf("username %s is not assciated with a peer id", username)
+	}
+	info, exists := rfs.peerIds[peerId]
+	if !exists {
+		return peer.AddrInfo{}, fmt.Errorf("peer %s not known by current node", username)
+	}
+	return info, nil
+}
+
+// claimantNames returns the qualified names of the peers claiming username, sorted, rfs.mu has to be held
+func (rfs *RemoteFilesystem) claimantNames(username string) []string {
+	names := make([]string, 0)
+	for peerId, claimed := range rfs.peerIdToUsername {
+		if claimed == username {
+			names = append(names, QualifiedName(claimed, peerId))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rosterPeerIds returns the peer IDs of every user in the roster
+func (rfs *RemoteFilesystem) rosterPeerIds() []string {
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	peerIds := make([]string, 0, len(rfs.usernameToPeerId))
+	for _, peerId := range rfs.usernameToPeerId {
+		peerIds = append(peerIds, peerId)
+	}
+	return peerIds
+}
+
+// supports reports whether the node of a user announced a capability
+func (rfs *RemoteFilesystem) supports(username, capability string) bool {
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	peerId, _ := rfs.resolve(username)
+	record, ok := rfs.presence[peerId]
+	if !ok {
+		return false
+	}
+	for _, announced := range record.Capabilities {
+		if announced == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPeers returns the details of every user in the roster. A user is online while its
+// node is connected or its last presence announcement is still fresh.
+func (rfs *RemoteFilesystem) GetPeers() []share.Peer {
+	rfs.mu.RLock()
+	defer rfs.mu.RUnlock()
+	peers := make([]share.Peer, 0, len(rfs.usernames))
+	for _, username := range rfs.usernames {
+		peerId := rfs.usernameToPeerId[username]
+		details := share.Peer{
+			Username: username,
+			PeerId:   peerId,
+			Claimed:  rfs.peerIdToUsername[peerId],
+			Conflict: username != rfs.peerIdToUsername[peerId],
+			Shares:   rfs.peerIdToShares[peerId],
+			LastSeen: rfs.lastSeen[peerId],
+			Online:   time.Since(rfs.lastSeen[peerId]) < presenceTTL,
+		}
+		if record, ok := rfs.presence[peerId]; ok {
+			details.Capabilities = record.Capabilities
+		}
+		if id, err := peer.Decode(peerId); err == nil {
+			details.Online = details.Online || rfs.host.Network().Connectedness(id) == network.Connected
+			details.Latency = rfs.host.Peerstore().LatencyEWMA(id)
+		}
+		peers = append(peers, details)
+	}
+	return peers
+}
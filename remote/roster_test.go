@@ -0,0 +1,49 @@
+package remote
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mungujn/web-exp/app"
+)
+
+func Test_expireUsers(t *testing.T) {
+	// prep
+	mn := mocknet.New()
+	defer mn.Close() // nolint:errcheck
+	h, err := mn.GenPeer()
+	assert.NoError(t, err)
+	rfs := New(app.Config{Username: "alice"})
+	rfs.host = h
+	peerIds := make([]string, 3)
+	for i := range peerIds {
+		prvKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		assert.NoError(t, err)
+		peerIds[i], err = PeerId(prvKey)
+		assert.NoError(t, err)
+	}
+	bob, impostor, carol := peerIds[0], peerIds[1], peerIds[2]
+	rfs.addUser("bob", bob, nil)
+	rfs.addUser("bob", impostor, nil)
+	rfs.addUser("carol", carol, nil)
+	rfs.presence[bob] = PresenceRecord{Username: "bob", PeerId: bob}
+	assert.ElementsMatch(t, []string{QualifiedName("bob", bob), QualifiedName("bob", impostor), "carol"}, rfs.usernames)
+
+	// claimants are kept while their presence record is fresh
+	now := time.Now()
+	rfs.lastSeen[bob] = now.Add(-presenceTTL - time.Second)
+	rfs.expireUsers(now.Add(-time.Minute))
+	assert.Len(t, rfs.usernames, 3)
+
+	// then dropped along with it, which gives their username back to the other claimant
+	rfs.expireUsers(now)
+	assert.ElementsMatch(t, []string{"bob", "carol"}, rfs.usernames)
+	assert.Equal(t, impostor, rfs.usernameToPeerId["bob"])
+	assert.NotContains(t, rfs.peerIdToUsername, bob)
+	assert.NotContains(t, rfs.presence, bob)
+}
@@ -1,16 +1,222 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	slashpath "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/share"
 )
 
 const (
-	plainText  = "text/plain"
+	plainText   = "text/plain"
+	jsonContent = "application/json"
+
+	// generatedPagePolicy is the Content-Security-Policy of pages the node generates, such as the home page.
+	// They may only load scripts, styles and images from the node and may not be framed by other sites.
+	generatedPagePolicy = "default-src 'none'; script-src 'self'; connect-src 'self'; img-src 'self' data:; " +
+		"style-src 'self' 'unsafe-inline'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'"
+
+	// staleWarning is the Warning header of offline copies, marking them as stale
+	staleWarning = `110 - "Response is Stale"`
+	// staleBanner is added to html pages served from an offline copy
+	staleBanner = `<div style="position: fixed; top: 0; left: 0; right: 0; z-index: 2147483647; padding: 4px; ` +
+		`background: #fff3cd; color: #664d03; font: 14px sans-serif; text-align: center">%s</div>`
+
+	// archiveQuery is the query parameter asking for a folder as an archive of the format it gives
+	archiveQuery = "archive"
+
+	// maxFormMemory is how much of an uploaded form is held in memory, the rest goes to temporary files
+	maxFormMemory = 32 << 20
 )
 
+// PeersResponse is the json body returned by the peers api
+type PeersResponse struct {
+	Peers []string `json:"peers"`
+}
+
+// SearchResponse is the json body returned by the search api
+type SearchResponse struct {
+	Results []share.SearchResult `json:"results"`
+}
+
+// DownloadsResponse is the json body returned by the downloads api
+type DownloadsResponse struct {
+	Downloads []share.Download `json:"downloads"`
+}
+
+// HealthResponse is the json body returned by the health check
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ReadinessResponse is the json body returned by the readiness check
+type ReadinessResponse struct {
+	Status string        `json:"status"`
+	Checks []share.Check `json:"checks"`
+}
+
+// ErrorResponse is the json body returned by the api on failure
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
 // SendResponse - sends a response
 func SendResponse(w http.ResponseWriter, statusCode int, responseType string, response []byte) {
 	w.Header().Set("Content-Type", responseType)
 	w.WriteHeader(statusCode)
 	_, _ = w.Write(response)
 }
+
+// SendJSON - sends a json encoded response
+func SendJSON(w http.ResponseWriter, statusCode int, response interface{}) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Error("error encoding json response: ", err)
+		SendResponse(w, http.StatusInternalServerError, plainText, []byte(err.Error()))
+		return
+	}
+	SendResponse(w, statusCode, jsonContent, data)
+}
+
+// archiveWriter sends an archive as a download, starting the response with its first bytes so that
+// errors reported before any are sent with a status of their own
+type archiveWriter struct {
+	w       http.ResponseWriter
+	name    string
+	format  string
+	started bool
+}
+
+func (a *archiveWriter) Write(data []byte) (int, error) {
+	if !a.started {
+		a.started = true
+		contentType := "application/zip"
+		if a.format == share.ArchiveTarGz {
+			contentType = "application/gzip"
+		}
+		a.w.Header().Set("Content-Type", contentType)
+		a.w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.name}))
+		a.w.Header().Set("X-Content-Type-Options", "nosniff")
+		a.w.WriteHeader(http.StatusOK)
+	}
+	return a.w.Write(data)
+}
+
+// archiveName returns the file name of an archive of the folder at path, named after the folder,
+// or the user when it holds all of their files
+func archiveName(host, path, format string) string {
+	name := slashpath.Base(slashpath.Clean("/" + path))
+	if name == "/" {
+		name = "files"
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if label := strings.SplitN(host, ".", 2)[0]; label != "" {
+			name = label
+		}
+	}
+	return name + "." + format
+}
+
+// renderRequested reports whether the render query parameter asks for markdown to be served as html
+func renderRequested(r *http.Request) bool {
+	return r.URL.Query().Get("render") == "1"
+}
+
+// setGeneratedPageHeaders restricts what a page generated by the node, rather than read from a share, may do
+func setGeneratedPageHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", generatedPagePolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+// isUserOrigin matches requests made to the isolated origin of a user, a sub domain of localhost
+func isUserOrigin(r *http.Request, _ *mux.RouteMatch) bool {
+	hostname := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = host
+	}
+	hostname = strings.ToLower(hostname)
+	return strings.HasSuffix(hostname, ".localhost") && hostname != ".localhost"
+}
+
+// isMainOrigin matches requests made to the nodes own origin, which is every origin unless origins are isolated
+func (s *Server) isMainOrigin(r *http.Request, _ *mux.RouteMatch) bool {
+	return !s.distributedSystem.IsolatesOrigins() || !isUserOrigin(r, nil)
+}
+
+// notOnUserOrigin answers requests the isolated origin of a user does not serve
+func notOnUserOrigin(w http.ResponseWriter, r *http.Request) {
+	SendResponse(w, http.StatusNotFound, plainText, []byte("the origin of a user only serves their files"))
+}
+
+// markStale sets the Warning header of a response carrying the offline copy of a file whose owner is offline,
+// returning the banner that marks html pages as such, or nil if err does not report an offline copy
+func markStale(w http.ResponseWriter, err error) []byte {
+	var stale interface{ SyncedTime() time.Time }
+	if !errors.As(err, &stale) {
+		return nil
+	}
+	w.Header().Set("Warning", staleWarning)
+	return []byte(fmt.Sprintf(staleBanner, html.EscapeString(err.Error())))
+}
+
+// sendBusy answers with 503 Service Unavailable and a Retry-After header if err is a peer turning a request down
+// because it is over its limits, reporting whether it did
+func sendBusy(w http.ResponseWriter, err error) bool {
+	var busy interface{ RetryAfter() time.Duration }
+	if !errors.As(err, &busy) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(busy.RetryAfter().Seconds())))
+	SendResponse(w, http.StatusServiceUnavailable, plainText, []byte(err.Error()))
+	return true
+}
+
+// sameOriginWrites refuses requests that change anything, such as uploads, downloads and WebDAV writes, unless they
+// come from the nodes own origin, the origin set in CORS_ALLOWED_HOST, or from outside a browser. Browsers send
+// simple cross origin requests, such as posted forms, without asking first, so any site visited could make them.
+func (s *Server) sameOriginWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		default:
+			if !s.sameOrigin(r) {
+				log.Warnf("refusing %s %s from origin %q", r.Method, r.URL.Path, r.Header.Get("Origin"))
+				SendResponse(w, http.StatusForbidden, plainText, []byte("requests from other origins may not change anything"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether a request comes from the main origin it is sent to, the origin set in CORS_ALLOWED_HOST,
+// or from outside a browser, which sends neither an Origin nor a Sec-Fetch-Site header.
+// The isolated origins of users run whatever scripts they share, so they are never trusted, not even by themselves.
+func (s *Server) sameOrigin(r *http.Request) bool {
+	if !s.isMainOrigin(r, nil) {
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if s.config.CORSAllowedHost != "*" && origin == s.config.CORSAllowedHost {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+	}
+	site := r.Header.Get("Sec-Fetch-Site")
+	return site == "" || site == "same-origin" || site == "none"
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubSystem answers uploads and reports whether origins are isolated, any other call panics
+type stubSystem struct {
+	System
+	isolated bool
+	uploads  int
+}
+
+func (s *stubSystem) IsolatesOrigins() bool {
+	return s.isolated
+}
+
+func (s *stubSystem) OriginUsername(host string) (string, bool) {
+	return "", false
+}
+
+func (s *stubSystem) PutFile(ctx context.Context, username, filename string, content io.Reader, size int64) error {
+	s.uploads++
+	return nil
+}
+
+func Test_originChecks(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Isolated       bool
+		Method         string
+		Host           string
+		Path           string
+		Origin         string
+		ExpectedStatus int
+	}{
+		{Name: "outside a browser", Method: http.MethodPut, Host: "localhost:8080", Path: "/alice/x.txt", ExpectedStatus: http.StatusCreated},
+		{Name: "main origin", Method: http.MethodPut, Host: "localhost:8080", Path: "/alice/x.txt", Origin: "http://localhost:8080", ExpectedStatus: http.StatusCreated},
+		{Name: "allowed origin", Method: http.MethodPut, Host: "localhost:8080", Path: "/alice/x.txt", Origin: "http://localhost:3000", ExpectedStatus: http.StatusCreated},
+		{Name: "path in a share", Method: http.MethodPut, Host: "localhost:8080", Path: "/alice/drop/x.txt", Origin: "http://localhost:8080", ExpectedStatus: http.StatusCreated},
+		{Name: "other origin", Method: http.MethodPut, Host: "localhost:8080", Path: "/alice/x.txt", Origin: "http://example.com", ExpectedStatus: http.StatusForbidden},
+		{Name: "user origin upload", Isolated: true, Method: http.MethodPut, Host: "localhost:8080", Path: "/alice/x.txt", Origin: "http://bob.localhost:8080", ExpectedStatus: http.StatusForbidden},
+		{Name: "user origin form", Isolated: true, Method: http.MethodPost, Host: "localhost:8080", Path: "/", Origin: "http://bob.localhost:8080", ExpectedStatus: http.StatusForbidden},
+		{Name: "user origin to itself", Isolated: true, Method: http.MethodPut, Host: "bob.localhost:8080", Path: "/alice/x.txt", Origin: "http://bob.localhost:8080", ExpectedStatus: http.StatusForbidden},
+		{Name: "main origin isolated", Isolated: true, Method: http.MethodPut, Host: "localhost:8080", Path: "/alice/x.txt", Origin: "http://localhost:8080", ExpectedStatus: http.StatusCreated},
+		{Name: "user origin webdav write", Isolated: true, Method: http.MethodPut, Host: "localhost:8080", Path: "/dav/alice/x.txt", Origin: "http://bob.localhost:8080", ExpectedStatus: http.StatusForbidden},
+		{Name: "webdav on user origin", Isolated: true, Method: "PROPFIND", Host: "bob.localhost:8080", Path: "/dav/alice/", ExpectedStatus: http.StatusNotFound},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			system := &stubSystem{isolated: testCase.Isolated}
+			srv, err := New(Config{URLPrefix: "/api", CORSAllowedHost: "http://localhost:3000", WebDAV: true, WebDAVWritable: true}, system)
+			assert.NoError(t, err)
+
+			r := httptest.NewRequest(testCase.Method, "http://"+testCase.Host+testCase.Path, nil)
+			if testCase.Origin != "" {
+				r.Header.Set("Origin", testCase.Origin)
+			}
+			w := httptest.NewRecorder()
+			srv.http.Handler.ServeHTTP(w, r)
+			assert.Equal(t, testCase.ExpectedStatus, w.Code)
+			if testCase.ExpectedStatus == http.StatusForbidden {
+				assert.Zero(t, system.uploads)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	liveReloadPath   = "/.live-reload.js"
+	changeEventsPath = "/.changes"
+	jsContent        = "text/javascript"
+)
+
+// liveReloadScript reloads the page when a file of the user whose page is shown changes
+var liveReloadScript = []byte(`(function () {
+	var user = window.location.pathname.split("/")[1];
+	// the origin of a user is only sent the changes of their files
+	if (window.location.hostname.endsWith(".localhost")) {
+		user = "";
+	}
+	var events = new EventSource("` + changeEventsPath + `");
+	events.onmessage = function (event) {
+		var change = JSON.parse(event.data);
+		if (user === "" || change.username.toLowerCase() === user.toLowerCase()) {
+			window.location.reload();
+		}
+	};
+})();
+`)
+
+// liveReloadTag is added to html pages when live reload is enabled
+var liveReloadTag = []byte(`<script src="` + liveReloadPath + `"></script>`)
+
+// GetLiveReloadScript returns the script that reloads a page when the files of its user change.
+// Pages can include it with <script src="/.live-reload.js"></script>.
+func (s *Server) GetLiveReloadScript(w http.ResponseWriter, r *http.Request) {
+	SendResponse(w, http.StatusOK, jsContent, liveReloadScript)
+}
+
+// GetChanges streams file change notifications of all users as server sent events,
+// and only those of its user on the isolated origin of a user
+func (s *Server) GetChanges(w http.ResponseWriter, r *http.Request) {
+	username, isolated := s.distributedSystem.OriginUsername(r.Host)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		SendResponse(w, http.StatusInternalServerError, plainText, []byte("streaming not supported"))
+		return
+	}
+	changes, cancel := s.distributedSystem.SubscribeChanges()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change := <-changes:
+			if isolated && !strings.EqualFold(change.Username, username) {
+				continue
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				log.Error("error encoding change: ", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// injectLiveReload adds the live reload script to an html page
+func injectLiveReload(contentType string, contents []byte) []byte {
+	return injectHTML(contentType, contents, liveReloadTag)
+}
+
+// injectHTML adds tag to the end of the body of an html page, other content is returned as is
+func injectHTML(contentType string, contents, tag []byte) []byte {
+	if !strings.HasPrefix(contentType, "text/html") {
+		return contents
+	}
+	index := bytes.LastIndex(contents, []byte("</body>"))
+	if index < 0 {
+		return append(contents, tag...)
+	}
+	injected := make([]byte, 0, len(contents)+len(tag))
+	injected = append(injected, contents[:index]...)
+	injected = append(injected, tag...)
+	return append(injected, contents[index:]...)
+}
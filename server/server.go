@@ -2,35 +2,103 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/mungujn/web-exp/config/validate"
+	"github.com/mungujn/web-exp/metrics"
+	"github.com/mungujn/web-exp/share"
+)
+
+const (
+	// metricsPath is where the Prometheus metrics are served
+	metricsPath = "/metrics"
+	// healthPath answers as long as the process is serving requests
+	healthPath = "/healthz"
+	// readyPath answers with 200 once every subsystem of the node is ready, 503 until then
+	readyPath = "/readyz"
+	// rawFilesPath is where files are served as they are, under the url prefix
+	rawFilesPath = "/files/"
 )
 
 // Server is the http server
 type Server struct {
 	http              *http.Server
+	admin             *http.Server
 	config            Config
 	distributedSystem System
 }
 
 // Config houses all the configurations for the web server
 type Config struct {
-	Port            int    `mapstructure:"PORT"  default:"8080"`
+	// Port is the port to listen on, set from LOCAL_WEB_SERVER_PORT as the pages link to it
+	Port            int    `mapstructure:"-"`
 	URLPrefix       string `mapstructure:"URL_PREFIX"  default:"/api"`
 	Domain          string `mapstructure:"DOMAIN"  default:"github.com/mungujn"`
 	CORSAllowedHost string `mapstructure:"CORS_ALLOWED_HOST"  default:"*"`
+	LiveReload      bool   `mapstructure:"LIVE_RELOAD"  default:"false"`
+	Metrics         bool   `mapstructure:"METRICS"  default:"true"`
+	MetricsPort     int    `mapstructure:"METRICS_PORT"  default:"9090"`
+	WebDAV          bool   `mapstructure:"WEBDAV"  default:"false"`
+	WebDAVWritable  bool   `mapstructure:"WEBDAV_WRITABLE"  default:"false"`
+}
+
+// Validate checks the configuration and reports every problem found
+func (c Config) Validate() error {
+	var errs validate.Errors
+	if !strings.HasPrefix(c.URLPrefix, "/") {
+		errs.Add("URL_PREFIX", "%q must start with /", c.URLPrefix)
+	}
+	errs.NotEmpty("CORS_ALLOWED_HOST", c.CORSAllowedHost)
+	if c.MetricsPort != 0 {
+		errs.Port("METRICS_PORT", c.MetricsPort)
+		if c.MetricsPort == c.Port {
+			errs.Add("METRICS_PORT", "port %d is already used by the web server, set 0 to serve metrics on it", c.MetricsPort)
+		}
+	}
+	if c.WebDAVWritable && !c.WebDAV {
+		errs.Add("WEBDAV_WRITABLE", "needs WEBDAV to be set")
+	}
+	return errs.Err()
 }
 
 // System specifies the interface that applications main service providers must provide
 type System interface {
-	GetFile(ctx context.Context, path string) ([]byte, string, error)
+	GetFile(ctx context.Context, host, path string, render bool) ([]byte, string, error)
+	// StatFile describes the file GetFile returns for the same host and path without transferring its contents
+	StatFile(ctx context.Context, host, path string) (share.FileStat, error)
+	GetArchive(ctx context.Context, host, path, format string, w io.Writer) error
+	// ListFolder lists a folder addressed as username/path, the top level holding a folder per online user
+	ListFolder(ctx context.Context, path string) ([]share.FileInfo, error)
+	// GetRange returns up to length bytes of a file addressed as username/path from offset, as stored
+	GetRange(ctx context.Context, path string, offset, length int64) ([]byte, error)
+	OriginRedirect(host, path string) string
+	// IsolatesOrigins reports whether the files of each user are served from an origin of their own
+	IsolatesOrigins() bool
+	// OriginUsername returns the user whose isolated origin host names, false for the main origin
+	OriginUsername(host string) (string, bool)
 	GetOnlineNodes() []string
+	PutFile(ctx context.Context, username, filename string, content io.Reader, size int64) error
+	GetIncomingFile(uploader, filename string) ([]byte, string, error)
+	SubscribeChanges() (<-chan share.Change, func())
+	Search(ctx context.Context, query string) []share.SearchResult
+	SearchPage(ctx context.Context, query string) ([]byte, string, error)
+	// Readiness reports whether the node is ready to serve files, with the result of every check made
+	Readiness() (bool, []share.Check)
+	StartDownload(path string) (share.Download, error)
+	Downloads() []share.Download
+	CancelDownload(path string) error
 }
 
 // New creates a new server
@@ -47,6 +115,11 @@ func New(
 	srv := Server{config: cfg, distributedSystem: distributedSystem}
 
 	srv.setupHTTP(&httpSrv)
+	if cfg.Metrics && cfg.MetricsPort != 0 {
+		admin := http.NewServeMux()
+		admin.Handle(metricsPath, metrics.Handler())
+		srv.admin = &http.Server{Addr: fmt.Sprintf(":%d", cfg.MetricsPort), Handler: admin}
+	}
 	return &srv, nil
 }
 
@@ -54,13 +127,20 @@ func New(
 func (s *Server) setupHTTP(srv *http.Server) {
 	router := s.GetRouter()
 
-	srv.Handler = cors.New(cors.Options{
-		AllowedOrigins:     []string{s.config.CORSAllowedHost},
-		AllowedMethods:     []string{http.MethodGet},
-		AllowedHeaders:     []string{"*"},
-		AllowCredentials:   true,
-		OptionsPassthrough: false,
-	}).Handler(router)
+	handler := s.sameOriginWrites(router)
+	// other origins may only read, and only send credentials when named rather than matched by a wildcard.
+	// A wildcard would let the origin of every user read the files of every other, so it is dropped when isolated.
+	if s.config.CORSAllowedHost != "*" || !s.distributedSystem.IsolatesOrigins() {
+		handler = cors.New(cors.Options{
+			AllowedOrigins:     []string{s.config.CORSAllowedHost},
+			AllowedMethods:     []string{http.MethodGet, http.MethodHead},
+			AllowedHeaders:     []string{"*"},
+			AllowCredentials:   s.config.CORSAllowedHost != "*",
+			OptionsPassthrough: false,
+			ExposedHeaders:     []string{requestIDHeader},
+		}).Handler(handler)
+	}
+	srv.Handler = metrics.Instrument(withRequestID(handler))
 
 	s.http = srv
 }
@@ -68,7 +148,46 @@ func (s *Server) setupHTTP(srv *http.Server) {
 // GetRouter returns a mux router
 func (s *Server) GetRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/{path:.*}", s.GetFile).Methods(http.MethodGet)
+	if s.distributedSystem.IsolatesOrigins() {
+		// the origin of a user serves their files and nothing else, as their pages run whatever scripts they share
+		user := r.MatcherFunc(isUserOrigin).Subrouter()
+		user.HandleFunc(liveReloadPath, s.GetLiveReloadScript).Methods(http.MethodGet)
+		user.HandleFunc(changeEventsPath, s.GetChanges).Methods(http.MethodGet)
+		// raw files are served from their owners origin too, so that the api does not get around isolated origins
+		user.Path(s.config.URLPrefix + rawFilesPath + "{path:.*}").Methods(http.MethodGet).HandlerFunc(s.GetRawFile)
+		user.Path("/{path:.*}").Methods(http.MethodGet, http.MethodHead).Queries(archiveQuery, "{format}").HandlerFunc(s.GetArchive)
+		user.Path("/{path:.*}").Methods(http.MethodGet).HandlerFunc(s.GetFile)
+		user.Path("/{path:.*}").Methods(http.MethodHead).HandlerFunc(s.HeadFile)
+		user.PathPrefix("/").HandlerFunc(notOnUserOrigin)
+	}
+	main := r.MatcherFunc(s.isMainOrigin).Subrouter()
+	main.HandleFunc(liveReloadPath, s.GetLiveReloadScript).Methods(http.MethodGet)
+	main.HandleFunc(changeEventsPath, s.GetChanges).Methods(http.MethodGet)
+	main.HandleFunc(healthPath, s.Health).Methods(http.MethodGet, http.MethodHead)
+	main.HandleFunc(readyPath, s.Ready).Methods(http.MethodGet, http.MethodHead)
+	if s.config.Metrics && s.config.MetricsPort == 0 {
+		main.Handle(metricsPath, metrics.Handler()).Methods(http.MethodGet)
+	}
+	if s.config.WebDAV {
+		// the mount holds the files of every user, so the origin of none of them may reach it
+		dav := s.webdavHandler()
+		main.Handle(webdavPath, dav)
+		main.PathPrefix(webdavPath + "/").Handler(dav)
+	}
+	api := main.PathPrefix(s.config.URLPrefix).Subrouter()
+	api.HandleFunc("/peers", s.GetPeers).Methods(http.MethodGet)
+	api.HandleFunc(rawFilesPath+"{path:.*}", s.GetRawFile).Methods(http.MethodGet)
+	api.HandleFunc("/search", s.Search).Methods(http.MethodGet)
+	api.HandleFunc("/downloads", s.GetDownloads).Methods(http.MethodGet)
+	api.HandleFunc("/downloads/{path:.*}", s.StartDownload).Methods(http.MethodPost)
+	api.HandleFunc("/downloads/{path:.*}", s.CancelDownload).Methods(http.MethodDelete)
+	main.HandleFunc("/search", s.SearchPage).Methods(http.MethodGet, http.MethodHead)
+	main.HandleFunc("/.inbox/{uploader}/{filename}", s.GetIncomingFile).Methods(http.MethodGet, http.MethodHead)
+	main.HandleFunc("/", s.UploadForm).Methods(http.MethodPost)
+	main.HandleFunc("/{username}/{filename:.+}", s.PutFile).Methods(http.MethodPut)
+	main.HandleFunc("/{path:.*}", s.GetArchive).Methods(http.MethodGet, http.MethodHead).Queries(archiveQuery, "{format}")
+	main.HandleFunc("/{path:.*}", s.GetFile).Methods(http.MethodGet)
+	main.HandleFunc("/{path:.*}", s.HeadFile).Methods(http.MethodHead)
 	return r
 }
 
@@ -76,18 +195,265 @@ func (s *Server) GetRouter() *mux.Router {
 func (s *Server) GetFile(w http.ResponseWriter, r *http.Request) {
 	path := mux.Vars(r)["path"]
 	ctx := r.Context()
-	contents, contentType, err := s.distributedSystem.GetFile(ctx, path)
+	if location := s.distributedSystem.OriginRedirect(r.Host, path); location != "" {
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, location, http.StatusFound)
+		return
+	}
+	render := renderRequested(r)
+	contents, contentType, err := s.distributedSystem.GetFile(ctx, r.Host, path, render)
+	if sendBusy(w, err) {
+		return
+	}
+	banner := markStale(w, err)
+	if banner != nil {
+		err = nil
+	}
 	if err != nil {
 		SendResponse(w, http.StatusOK, plainText, []byte(err.Error()))
 	} else {
 		if contentType == "" {
 			contentType = http.DetectContentType(contents)
 		}
+		if banner != nil {
+			contents = injectHTML(contentType, contents, banner)
+		}
+		if s.config.LiveReload {
+			contents = injectLiveReload(contentType, contents)
+		}
+		if (path == "" && !isUserOrigin(r, nil)) || render {
+			setGeneratedPageHeaders(w)
+		}
 		SendResponse(w, http.StatusOK, contentType, contents)
 	}
 
 }
 
+// HeadFile answers with the headers of a file, its size, modification time, content type and hash as its ETag,
+// without transferring its contents. Pages made up as they are sent, such as folders or offline copies with their
+// banner, are made up as for GetFile, only their body is dropped.
+func (s *Server) HeadFile(w http.ResponseWriter, r *http.Request) {
+	path := mux.Vars(r)["path"]
+	if renderRequested(r) || (path == "" && !isUserOrigin(r, nil)) || s.distributedSystem.OriginRedirect(r.Host, path) != "" {
+		s.GetFile(w, r)
+		return
+	}
+	stat, err := s.distributedSystem.StatFile(r.Context(), r.Host, path)
+	if sendBusy(w, err) {
+		return
+	}
+	var stale interface{ SyncedTime() time.Time }
+	generated := s.config.LiveReload && strings.HasPrefix(stat.ContentType, "text/html")
+	if errors.As(err, &stale) || stat.Mode.IsDir() || generated {
+		s.GetFile(w, r)
+		return
+	}
+	if err != nil {
+		SendResponse(w, http.StatusNotFound, plainText, nil)
+		return
+	}
+	etag := fmt.Sprintf(`"%s"`, stat.Hash)
+	w.Header().Set("ETag", etag)
+	if !stat.Modified.IsZero() {
+		w.Header().Set("Last-Modified", stat.Modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", stat.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetArchive streams an archive of a folder as a download, in the format given by the archive query parameter.
+// A folder that can not be archived is reported with a 404, but once the archive started a failure can only
+// cut the response short.
+func (s *Server) GetArchive(w http.ResponseWriter, r *http.Request) {
+	path, format := mux.Vars(r)["path"], mux.Vars(r)["format"]
+	if err := share.CheckArchiveFormat(format); err != nil {
+		SendResponse(w, http.StatusBadRequest, plainText, []byte(err.Error()))
+		return
+	}
+	archive := &archiveWriter{w: w, name: archiveName(r.Host, path, format), format: format}
+	err := s.distributedSystem.GetArchive(r.Context(), r.Host, path, format, archive)
+	if archive.started {
+		if err != nil {
+			log.Errorf("error streaming archive of %s, cutting the response short: %s", path, err)
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if sendBusy(w, err) {
+		return
+	}
+	if err != nil {
+		SendResponse(w, http.StatusNotFound, plainText, []byte(err.Error()))
+	}
+}
+
+// Health reports that the process is alive
+func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Ready reports whether the node is ready to serve files, as 200 or 503 with the checks made
+func (s *Server) Ready(w http.ResponseWriter, r *http.Request) {
+	ready, checks := s.distributedSystem.Readiness()
+	status, statusCode := "ready", http.StatusOK
+	if !ready {
+		status, statusCode = "not ready", http.StatusServiceUnavailable
+	}
+	SendJSON(w, statusCode, ReadinessResponse{Status: status, Checks: checks})
+}
+
+// GetPeers returns the usernames of all online peers as json
+func (s *Server) GetPeers(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, http.StatusOK, PeersResponse{Peers: s.distributedSystem.GetOnlineNodes()})
+}
+
+// GetRawFile returns a file, reporting failures as a json error with a non 200 status
+func (s *Server) GetRawFile(w http.ResponseWriter, r *http.Request) {
+	path := mux.Vars(r)["path"]
+	if location := s.distributedSystem.OriginRedirect(r.Host, path); location != "" {
+		s.redirectRaw(w, r, location)
+		return
+	}
+	contents, contentType, err := s.distributedSystem.GetFile(r.Context(), r.Host, path, renderRequested(r))
+	if sendBusy(w, err) {
+		return
+	}
+	if markStale(w, err) != nil {
+		err = nil
+	}
+	if err != nil {
+		SendJSON(w, http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(contents)
+	}
+	// raw files are never run as pages of the nodes origin, only downloaded or shown
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	SendResponse(w, http.StatusOK, contentType, contents)
+}
+
+// redirectRaw redirects a request for a raw file to the raw files route of the isolated origin location is on
+func (s *Server) redirectRaw(w http.ResponseWriter, r *http.Request, location string) {
+	target, err := url.Parse(location)
+	if err != nil {
+		SendJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+	target.Path = s.config.URLPrefix + strings.TrimSuffix(rawFilesPath, "/") + target.Path
+	target.RawPath = ""
+	target.RawQuery = r.URL.RawQuery
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// Search returns the files of every online user matching the q query parameter as json
+func (s *Server) Search(w http.ResponseWriter, r *http.Request) {
+	results := s.distributedSystem.Search(r.Context(), r.URL.Query().Get("q"))
+	SendJSON(w, http.StatusOK, SearchResponse{Results: results})
+}
+
+// GetDownloads returns every download started and its progress as json
+func (s *Server) GetDownloads(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, http.StatusOK, DownloadsResponse{Downloads: s.distributedSystem.Downloads()})
+}
+
+// StartDownload starts downloading a file of another user to the download folder, or resumes it
+func (s *Server) StartDownload(w http.ResponseWriter, r *http.Request) {
+	download, err := s.distributedSystem.StartDownload(mux.Vars(r)["path"])
+	if err != nil {
+		SendJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	SendJSON(w, http.StatusAccepted, download)
+}
+
+// CancelDownload stops a running download, keeping what was downloaded
+func (s *Server) CancelDownload(w http.ResponseWriter, r *http.Request) {
+	if err := s.distributedSystem.CancelDownload(mux.Vars(r)["path"]); err != nil {
+		SendJSON(w, http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SearchPage returns a page listing the files of every online user matching the q query parameter
+func (s *Server) SearchPage(w http.ResponseWriter, r *http.Request) {
+	contents, contentType, err := s.distributedSystem.SearchPage(r.Context(), r.URL.Query().Get("q"))
+	if err != nil {
+		SendResponse(w, http.StatusInternalServerError, plainText, []byte(err.Error()))
+		return
+	}
+	setGeneratedPageHeaders(w)
+	SendResponse(w, http.StatusOK, contentType, contents)
+}
+
+// PutFile uploads the request body to the inbox of a user, or to a file in one of their writable shares
+// when the path names a folder
+func (s *Server) PutFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if r.ContentLength < 0 {
+		SendJSON(w, http.StatusLengthRequired, ErrorResponse{Error: "uploads need a Content-Length"})
+		return
+	}
+	err := s.distributedSystem.PutFile(r.Context(), vars["username"], vars["filename"], r.Body, r.ContentLength)
+	if sendBusy(w, err) {
+		return
+	}
+	if err != nil {
+		SendJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadForm uploads a file sent from the home page form to the inbox of the selected user
+func (s *Server) UploadForm(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+		SendResponse(w, http.StatusBadRequest, plainText, []byte(err.Error()))
+		return
+	}
+	defer r.MultipartForm.RemoveAll() // nolint:errcheck
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		SendResponse(w, http.StatusBadRequest, plainText, []byte(err.Error()))
+		return
+	}
+	defer file.Close()
+	err = s.distributedSystem.PutFile(r.Context(), r.FormValue("username"), header.Filename, file, header.Size)
+	if sendBusy(w, err) {
+		return
+	}
+	if err != nil {
+		SendResponse(w, http.StatusBadRequest, plainText, []byte(err.Error()))
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// GetIncomingFile returns a file from the current users inbox
+func (s *Server) GetIncomingFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	contents, contentType, err := s.distributedSystem.GetIncomingFile(vars["uploader"], vars["filename"])
+	if err != nil {
+		SendResponse(w, http.StatusNotFound, plainText, []byte(err.Error()))
+		return
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(contents)
+	}
+	w.Header().Set("Content-Disposition", "attachment")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	SendResponse(w, http.StatusOK, contentType, contents)
+}
+
 // Run the web server
 func (s *Server) Run(ctx context.Context, wg *sync.WaitGroup) {
 	wg.Add(1)
@@ -101,12 +467,28 @@ func (s *Server) Run(ctx context.Context, wg *sync.WaitGroup) {
 		log.Info("http service: end run > ", err)
 	}()
 
+	if s.admin != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Debug("metrics service: addr=", s.admin.Addr)
+			err := s.admin.ListenAndServe()
+			log.Info("metrics service: end run > ", err)
+		}()
+	}
+
 	go func() {
 		<-ctx.Done()
-		sdCtx, _ := context.WithTimeout(context.Background(), 5*time.Second) // nolint
+		sdCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 		err := s.http.Shutdown(sdCtx)
 		if err != nil {
 			log.Info("http service shutdown (", err, ")")
 		}
+		if s.admin != nil {
+			if err := s.admin.Shutdown(sdCtx); err != nil {
+				log.Info("metrics service shutdown (", err, ")")
+			}
+		}
 	}()
 }
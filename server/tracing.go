@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mungujn/web-exp/tracing"
+)
+
+// requestIDHeader carries the request ID, set by the client or generated by the node
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID gives every request an ID, taken from the X-Request-ID header when the client sends a usable one,
+// returns it in the response, and wraps the request in a span
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !tracing.ValidRequestID(id) {
+			id = tracing.NewRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx, span := tracing.StartSpan(tracing.WithRequestID(r.Context(), id), "http "+r.Method,
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+			attribute.String("http.host", r.Host),
+		)
+		defer span.End()
+
+		start := time.Now()
+		next.ServeHTTP(w, r.WithContext(ctx))
+		log.WithField(tracing.RequestIDKey, id).Debugf("%s %s served in %s", r.Method, r.URL.Path, time.Since(start))
+	})
+}
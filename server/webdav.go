@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	slashpath "path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+
+	"github.com/mungujn/web-exp/share"
+)
+
+const (
+	// webdavPath is where the files of every online user are served over WebDAV
+	webdavPath = "/dav"
+	// davChunkSize is how much of a file is fetched at once as it is read
+	davChunkSize = 1 << 20
+)
+
+// webdavHandler serves the files of every online user over WebDAV, a folder per user. Nothing can be changed through it,
+// except that with WEBDAV_WRITABLE set files can be put into the folder of a user, which uploads them to their inbox.
+func (s *Server) webdavHandler() http.Handler {
+	dav := &webdav.Handler{
+		Prefix:     webdavPath,
+		FileSystem: &davFileSystem{system: s.distributedSystem, writable: s.config.WebDAVWritable},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Debugf("webdav %s %s: %s", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			if !s.config.WebDAVWritable {
+				SendResponse(w, http.StatusForbidden, plainText, []byte("webdav is read only, set WEBDAV_WRITABLE to upload files"))
+				return
+			}
+			if strings.Count(strings.Trim(strings.TrimPrefix(r.URL.Path, webdavPath), "/"), "/") != 1 {
+				SendResponse(w, http.StatusForbidden, plainText, []byte("files can only be put in the folder of a user, which uploads them to their inbox"))
+				return
+			}
+		case http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPPATCH":
+			SendResponse(w, http.StatusForbidden, plainText, []byte("files of other users can not be changed"))
+			return
+		}
+		// files are served from the nodes origin, like raw files they are never run as its pages
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		dav.ServeHTTP(w, r)
+	})
+}
+
+// davFileSystem is the webdav.FileSystem of the files of every online user, the top folder holding a folder per user
+type davFileSystem struct {
+	system   System
+	writable bool
+}
+
+func (d *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (d *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (d *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// Stat describes a file or folder as listed in the folder holding it, reporting anything that can not be listed,
+// such as the files of an offline user or of a share the current user may not access, as missing
+func (d *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return davFileInfo{info: share.FileInfo{Name: "/", Folder: true}}, nil
+	}
+	folder, base := slashpath.Split(name)
+	list, err := d.system.ListFolder(ctx, folder)
+	if err != nil {
+		log.Debugf("error listing webdav folder %s: %s", folder, err)
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	for _, info := range list {
+		if info.Name == base {
+			return davFileInfo{info: info}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// OpenFile opens a file or folder for reading, or when writes are allowed a file to upload to the inbox of a user,
+// or to one of their writable shares if it is in a folder
+func (d *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		parts := strings.SplitN(strings.Trim(name, "/"), "/", 2)
+		if !d.writable || len(parts) != 2 {
+			return nil, os.ErrPermission
+		}
+		temp, err := ioutil.TempFile("", "webdav-upload-*")
+		if err != nil {
+			return nil, err
+		}
+		return &davUpload{ctx: ctx, system: d.system, username: parts[0], filename: parts[1], temp: temp}, nil
+	}
+	info, err := d.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{ctx: ctx, system: d.system, name: strings.Trim(name, "/"), info: info.(davFileInfo)}, nil
+}
+
+// davFileInfo describes a listed file or folder to webdav
+type davFileInfo struct {
+	info share.FileInfo
+}
+
+func (i davFileInfo) Name() string       { return i.info.Name }
+func (i davFileInfo) Size() int64        { return i.info.Size }
+func (i davFileInfo) ModTime() time.Time { return i.info.Modified }
+func (i davFileInfo) IsDir() bool        { return i.info.Folder }
+func (i davFileInfo) Sys() interface{}   { return nil }
+
+func (i davFileInfo) Mode() os.FileMode {
+	if i.info.Folder {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// ETag returns the ETag of a file, the hash of its contents as for HEAD requests when its owner knows it,
+// or else one made of its size and modification time, so that listing a folder never reads the files in it
+func (i davFileInfo) ETag(ctx context.Context) (string, error) {
+	if i.info.Hash != "" {
+		return fmt.Sprintf(`"%s"`, i.info.Hash), nil
+	}
+	return fmt.Sprintf(`"%x-%x"`, i.info.Modified.UnixNano(), i.info.Size), nil
+}
+
+// ContentType returns the content type of a file from its extension, so that listing a folder never reads its files
+func (i davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if contentType := mime.TypeByExtension(slashpath.Ext(i.info.Name)); contentType != "" {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// davFile is a file or folder opened for reading. The contents of a file are fetched from its owner as they are read,
+// a chunk at a time from where they are read, so that seeking or reading part of a file never fetches all of it.
+type davFile struct {
+	ctx    context.Context
+	system System
+	name   string
+	info   davFileInfo
+	offset int64
+	// chunk holds the contents fetched last, from chunkOffset
+	chunk       []byte
+	chunkOffset int64
+	// listed is how much of the listing of a folder was returned by Readdir
+	listed int
+}
+
+func (f *davFile) Close() error {
+	return nil
+}
+
+// fetch fetches the chunk of the file at the offset read from. Files whose owners can not send parts of them,
+// and the offline copies of pinned files, are fetched whole, as a single chunk.
+func (f *davFile) fetch() error {
+	if f.info.IsDir() {
+		return fmt.Errorf("%s is a folder", f.name)
+	}
+	chunk, err := f.system.GetRange(f.ctx, f.name, f.offset, davChunkSize)
+	if err == nil {
+		f.chunk, f.chunkOffset = chunk, f.offset
+		return nil
+	}
+	log.Debugf("error fetching part of %s, fetching all of it: %s", f.name, err)
+	contents, _, err := f.system.GetFile(f.ctx, "", f.name, false)
+	// the offline copy of a pinned file is served as the file
+	var stale interface{ SyncedTime() time.Time }
+	if err != nil && !errors.As(err, &stale) {
+		return err
+	}
+	f.chunk, f.chunkOffset = contents, 0
+	return nil
+}
+
+func (f *davFile) Read(data []byte) (int, error) {
+	if f.offset >= f.info.Size() && !f.info.IsDir() {
+		return 0, io.EOF
+	}
+	if f.offset < f.chunkOffset || f.offset >= f.chunkOffset+int64(len(f.chunk)) {
+		if err := f.fetch(); err != nil {
+			return 0, err
+		}
+		// the file is shorter than listed
+		if f.offset >= f.chunkOffset+int64(len(f.chunk)) {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	read := copy(data, f.chunk[f.offset-f.chunkOffset:])
+	f.offset += int64(read)
+	return read, nil
+}
+
+// Seek moves the offset read from within the size the file is listed with, without fetching anything
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to %d before the start of %s", offset, f.name)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", f.name)
+	}
+	list, err := f.system.ListFolder(f.ctx, f.name)
+	if err != nil {
+		return nil, err
+	}
+	if f.listed > len(list) {
+		f.listed = len(list)
+	}
+	infos := make([]fs.FileInfo, 0)
+	for _, info := range list[f.listed:] {
+		if count > 0 && len(infos) == count {
+			break
+		}
+		infos = append(infos, davFileInfo{info: info})
+	}
+	f.listed += len(infos)
+	if count > 0 && len(infos) == 0 {
+		return infos, io.EOF
+	}
+	return infos, nil
+}
+
+// Stat describes the file as listed, with the hash its owner describes it with in place of an unknown one,
+// so that the ETag of a file served over webdav is the one it has when served otherwise
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	if !f.info.IsDir() && f.info.info.Hash == "" {
+		if stat, err := f.system.StatFile(f.ctx, "", f.name); err == nil {
+			f.info.info.Hash = stat.Hash
+		}
+	}
+	return f.info, nil
+}
+
+func (f *davFile) Write(data []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// davUpload is a file put through webdav, kept in a temporary file until it is closed and uploaded to the inbox of the user
+type davUpload struct {
+	ctx      context.Context
+	system   System
+	username string
+	filename string
+	temp     *os.File
+	size     int64
+}
+
+func (u *davUpload) Write(data []byte) (int, error) {
+	written, err := u.temp.Write(data)
+	u.size += int64(written)
+	return written, err
+}
+
+// Close uploads the file to the inbox of the user
+func (u *davUpload) Close() error {
+	defer os.Remove(u.temp.Name())
+	defer u.temp.Close()
+	if _, err := u.temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return u.system.PutFile(u.ctx, u.username, u.filename, u.temp, u.size)
+}
+
+func (u *davUpload) Read(data []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *davUpload) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrPermission
+}
+
+func (u *davUpload) Stat() (fs.FileInfo, error) {
+	return davFileInfo{info: share.FileInfo{Name: u.filename, Size: u.size, Modified: time.Now()}}, nil
+}
@@ -0,0 +1,162 @@
+package share
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	slashpath "path"
+	"strings"
+)
+
+const (
+	// ArchiveZip is the format of zip archives
+	ArchiveZip = "zip"
+	// ArchiveTarGz is the format of gzip compressed tar archives
+	ArchiveTarGz = "tar.gz"
+)
+
+// CheckArchiveFormat returns an error unless format is one archives are written in
+func CheckArchiveFormat(format string) error {
+	if format != ArchiveZip && format != ArchiveTarGz {
+		return fmt.Errorf("unknown archive format %q, use %s or %s", format, ArchiveZip, ArchiveTarGz)
+	}
+	return nil
+}
+
+// Archive is a shared folder to be written as an archive, holding the files under it
+type Archive struct {
+	files  fs.FS
+	folder string
+	format string
+	// Name is the folder every file lies under in the archive, the files lie at its top when empty
+	Name string
+}
+
+// Archive prepares an archive of a folder on behalf of requester, so that a missing folder or
+// denied access is reported before anything is written
+func (s Shares) Archive(requester, path, format string) (*Archive, error) {
+	if err := CheckArchiveFormat(format); err != nil {
+		return nil, err
+	}
+	share, rel, err := s.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if !share.Allows(requester) {
+		return nil, fmt.Errorf("access to share %s denied", share.Name)
+	}
+	folder := fileName(rel)
+	info, err := share.stat(folder)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", path)
+	}
+	name := slashpath.Base(folder)
+	if folder == "." {
+		name = share.Name
+	}
+	return &Archive{files: share.FS(), folder: folder, format: format, Name: name}, nil
+}
+
+// Write writes the archive to w as the files are read, never holding more than one buffer of them.
+// Hidden files are left out, as they are from the index, and so is anything but files and folders,
+// so that links never lead out of the share.
+func (a *Archive) Write(w io.Writer) error {
+	if a.format == ArchiveZip {
+		archive := zip.NewWriter(w)
+		if err := a.walk(func(name string, info fs.FileInfo, file io.Reader) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if info.IsDir() {
+				header.Name += "/"
+			} else {
+				header.Method = zip.Deflate
+			}
+			entry, err := archive.CreateHeader(header)
+			if err == nil && file != nil {
+				_, err = io.Copy(entry, file)
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+		return archive.Close()
+	}
+
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	if err := a.walk(func(name string, info fs.FileInfo, file io.Reader) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = archive.WriteHeader(header); err != nil || file == nil {
+			return err
+		}
+		// tar records the size up front, a file that changed size since is cut or reported
+		if _, err = io.CopyN(archive, file, header.Size); err != nil {
+			return fmt.Errorf("error archiving %s, it may have changed: %w", name, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// walk calls add with every folder and file of the archive, named as they are in it. file is nil for folders.
+func (a *Archive) walk(add func(name string, info fs.FileInfo, file io.Reader) error) error {
+	return fs.WalkDir(a.files, a.folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != a.folder {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if path == a.folder {
+			if a.Name == "" {
+				return nil
+			}
+			return add(a.Name, info, nil)
+		}
+		rel := strings.TrimPrefix(path, a.folder+"/")
+		if a.folder == "." {
+			rel = path
+		}
+		name := slashpath.Join(a.Name, rel)
+		if entry.IsDir() {
+			return add(name, info, nil)
+		}
+		file, err := a.files.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return add(name, info, file)
+	})
+}
@@ -0,0 +1,127 @@
+package share
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readArchive returns the contents of every entry of an archive by name, folders having no contents
+func readArchive(t *testing.T, format string, data []byte) map[string]string {
+	entries := make(map[string]string)
+	if format == ArchiveZip {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			assert.NoError(t, err)
+			contents, _ := ioutil.ReadAll(reader)
+			entries[file.Name] = string(contents)
+		}
+		return entries
+	}
+	compressed, err := gzip.NewReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries
+		}
+		assert.NoError(t, err)
+		contents, _ := ioutil.ReadAll(archive)
+		entries[header.Name] = string(contents)
+	}
+}
+
+func Test_Archive(t *testing.T) {
+	shares := Shares{
+		{Name: DefaultName, Files: fstest.MapFS{
+			"index.html":        {Data: []byte("home")},
+			"notes/a.md":        {Data: []byte("a")},
+			"notes/.draft":      {Data: []byte("draft")},
+			"notes/old/b.md":    {Data: []byte("b")},
+			"notes/.git/config": {Data: []byte("config")},
+		}},
+		{Name: "team", Allowed: []string{"bob"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+	}
+
+	cases := []struct {
+		Name          string
+		Requester     string
+		Path          string
+		Format        string
+		Expected      map[string]string
+		ExpectedError string
+	}{
+		{
+			Name:      "folder as zip",
+			Requester: "alice",
+			Path:      "notes",
+			Format:    ArchiveZip,
+			Expected:  map[string]string{"notes/": "", "notes/a.md": "a", "notes/old/": "", "notes/old/b.md": "b"},
+		},
+		{
+			Name:      "folder as tar.gz",
+			Requester: "alice",
+			Path:      "/notes/../notes/",
+			Format:    ArchiveTarGz,
+			Expected:  map[string]string{"notes/": "", "notes/a.md": "a", "notes/old/": "", "notes/old/b.md": "b"},
+		},
+		{
+			Name:      "whole default share",
+			Requester: "alice",
+			Path:      "",
+			Format:    ArchiveZip,
+			Expected:  map[string]string{"index.html": "home", "notes/": "", "notes/a.md": "a", "notes/old/": "", "notes/old/b.md": "b"},
+		},
+		{
+			Name:      "named share",
+			Requester: "bob",
+			Path:      "team",
+			Format:    ArchiveTarGz,
+			Expected:  map[string]string{"team/": "", "team/plan.md": "plan"},
+		},
+		{Name: "denied", Requester: "alice", Path: "team", Format: ArchiveZip, ExpectedError: "access to share team denied"},
+		{Name: "file", Requester: "alice", Path: "notes/a.md", Format: ArchiveZip, ExpectedError: "notes/a.md is not a folder"},
+		{Name: "missing", Requester: "alice", Path: "drafts", Format: ArchiveZip, ExpectedError: "open drafts: file does not exist"},
+		{Name: "unknown format", Requester: "alice", Path: "notes", Format: "rar", ExpectedError: `unknown archive format "rar", use zip or tar.gz`},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			archive, err := shares.Archive(testCase.Requester, testCase.Path, testCase.Format)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			var data bytes.Buffer
+			assert.NoError(t, archive.Write(&data))
+			assert.Equal(t, testCase.Expected, readArchive(t, testCase.Format, data.Bytes()))
+		})
+	}
+}
+
+func Test_Archive_links(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "docs"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("a"), 0644))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "docs", "secret.txt")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "docs", "outside")))
+
+	archive, err := Shares{{Name: DefaultName, Root: root}}.Archive("alice", "docs", ArchiveZip)
+	assert.NoError(t, err)
+	var data bytes.Buffer
+	assert.NoError(t, archive.Write(&data))
+	assert.Equal(t, map[string]string{"docs/": "", "docs/a.txt": "a"}, readArchive(t, ArchiveZip, data.Bytes()))
+}
@@ -0,0 +1,9 @@
+package share
+
+// Check is the outcome of checking one part of the node, reported by the readiness endpoint
+type Check struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Detail says what was found, or what is wrong
+	Detail string `json:"detail,omitempty"`
+}
@@ -0,0 +1,23 @@
+package share
+
+// States of a download
+const (
+	DownloadRunning   = "running"
+	DownloadComplete  = "complete"
+	DownloadFailed    = "failed"
+	DownloadCancelled = "cancelled"
+)
+
+// Download describes a file of another user being downloaded to the download folder
+type Download struct {
+	// Path is the path of the file, username first
+	Path string `json:"path"`
+	// File is the local path the file is saved to once complete
+	File string `json:"file"`
+	// Size is the size of the file, zero until its owner described it
+	Size int64 `json:"size"`
+	// Done counts the bytes downloaded so far, those of earlier attempts included
+	Done  int64  `json:"done"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
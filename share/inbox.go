@@ -0,0 +1,153 @@
+package share
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInboxDisabled is returned for uploads to a node without an inbox
+var ErrInboxDisabled = errors.New("inbox is not enabled")
+
+// Inbox is a folder other users can upload files to.
+// Each uploaders files are kept in a sub folder named after them.
+type Inbox struct {
+	Root    string
+	MaxSize int64
+	// Allowed lists the usernames that may upload, everyone may if empty
+	Allowed []string
+}
+
+// Incoming describes a file uploaded to the inbox
+type Incoming struct {
+	Uploader string
+	Name     string
+	Size     int64
+	Received time.Time
+}
+
+// Check reports why an upload can not be accepted, if it can not
+func (i *Inbox) Check(uploader string, size int64) error {
+	if i == nil {
+		return ErrInboxDisabled
+	}
+	if !(Share{Allowed: i.Allowed}).Allows(uploader) {
+		return fmt.Errorf("user %s may not upload to this inbox", uploader)
+	}
+	if size < 0 || size > i.MaxSize {
+		return fmt.Errorf("file of %d bytes exceeds the inbox limit of %d bytes", size, i.MaxSize)
+	}
+	return nil
+}
+
+// Save writes exactly size bytes of content to the uploaders folder, returning the name it was saved as.
+// Existing files are never overwritten, a numbered name is chosen instead.
+func (i *Inbox) Save(uploader, name string, content io.Reader, size int64) (string, error) {
+	if err := i.Check(uploader, size); err != nil {
+		return "", err
+	}
+	folderName, err := SafeName(uploader)
+	if err != nil {
+		return "", err
+	}
+	name, err = SafeName(name)
+	if err != nil {
+		return "", err
+	}
+	folder := filepath.Join(i.Root, folderName)
+	if err = os.MkdirAll(folder, 0750); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(folder, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	written, err := io.Copy(tmp, io.LimitReader(content, size))
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if written != size {
+		return "", fmt.Errorf("upload incomplete, expected %d bytes, got %d", size, written)
+	}
+
+	// linking fails on a name that is taken, so two uploads of the same name at once never get the same one
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		err = os.Link(tmp.Name(), filepath.Join(folder, name))
+		if !errors.Is(err, os.ErrExist) {
+			return name, err
+		}
+		name = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+// List returns all files in the inbox, newest first
+func (i *Inbox) List() ([]Incoming, error) {
+	incoming := make([]Incoming, 0)
+	if i == nil {
+		return incoming, nil
+	}
+	folders, err := ioutil.ReadDir(i.Root)
+	if err != nil {
+		return nil, err
+	}
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(i.Root, folder.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			incoming = append(incoming, Incoming{
+				Uploader: folder.Name(),
+				Name:     file.Name(),
+				Size:     file.Size(),
+				Received: file.ModTime(),
+			})
+		}
+	}
+	sort.Slice(incoming, func(a, b int) bool { return incoming[a].Received.After(incoming[b].Received) })
+	return incoming, nil
+}
+
+// ReadFile reads a file uploaded by uploader
+func (i *Inbox) ReadFile(uploader, name string) ([]byte, error) {
+	if i == nil {
+		return nil, ErrInboxDisabled
+	}
+	return ioutil.ReadFile(filepath.Join(i.Root, filepath.Base("/"+uploader), filepath.Base("/"+name)))
+}
+
+// SafeName returns name reduced to a plain file name that can not address other folders or hidden files
+func SafeName(name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "", errors.New("file name is empty")
+	}
+	return name, nil
+}
@@ -0,0 +1,115 @@
+package share
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SafeName(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Input         string
+		Expected      string
+		ExpectedError string
+	}{
+		{Name: "plain", Input: "report.pdf", Expected: "report.pdf"},
+		{Name: "path", Input: "../../etc/passwd", Expected: "passwd"},
+		{Name: "windows path", Input: `C:\Users\a\notes.txt`, Expected: "notes.txt"},
+		{Name: "hidden", Input: ".bashrc", Expected: "bashrc"},
+		{Name: "special characters", Input: "a<b>?.txt", Expected: "a_b__.txt"},
+		{Name: "dots only", Input: "..", ExpectedError: "file name is empty"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			name, err := SafeName(testCase.Input)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, name)
+		})
+	}
+}
+
+func Test_InboxSave(t *testing.T) {
+	inbox := &Inbox{Root: t.TempDir(), MaxSize: 10, Allowed: []string{"alice"}}
+
+	cases := []struct {
+		Name          string
+		Uploader      string
+		Filename      string
+		Content       string
+		Size          int64
+		Expected      string
+		ExpectedError string
+	}{
+		{Name: "saved", Uploader: "alice", Filename: "a.txt", Content: "hello", Size: 5, Expected: "a.txt"},
+		{Name: "never overwrites", Uploader: "alice", Filename: "a.txt", Content: "again", Size: 5, Expected: "a-1.txt"},
+		{
+			Name: "uploader not allowed", Uploader: "bob", Filename: "b.txt", Content: "hi", Size: 2,
+			ExpectedError: "user bob may not upload to this inbox",
+		},
+		{
+			Name: "too large", Uploader: "alice", Filename: "big.txt", Content: "01234567890", Size: 11,
+			ExpectedError: "file of 11 bytes exceeds the inbox limit of 10 bytes",
+		},
+		{
+			Name: "incomplete", Uploader: "alice", Filename: "short.txt", Content: "abc", Size: 5,
+			ExpectedError: "upload incomplete, expected 5 bytes, got 3",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			name, err := inbox.Save(testCase.Uploader, testCase.Filename, strings.NewReader(testCase.Content), testCase.Size)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, name)
+			data, err := inbox.ReadFile(testCase.Uploader, name)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Content, string(data))
+		})
+	}
+
+	incoming, err := inbox.List()
+	assert.NoError(t, err)
+	assert.Len(t, incoming, 2)
+}
+
+func Test_InboxSave_concurrent(t *testing.T) {
+	inbox := &Inbox{Root: t.TempDir(), MaxSize: 10}
+	const uploads = 20
+
+	var wg sync.WaitGroup
+	names := make([]string, uploads)
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := fmt.Sprintf("upload %d", i)
+			name, err := inbox.Save("alice", "a.txt", strings.NewReader(content), int64(len(content)))
+			assert.NoError(t, err)
+			names[i] = name
+		}(i)
+	}
+	wg.Wait()
+
+	// every upload is kept under a name of its own
+	for i, name := range names {
+		data, err := inbox.ReadFile("alice", name)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("upload %d", i), string(data))
+	}
+	incoming, err := inbox.List()
+	assert.NoError(t, err)
+	assert.Len(t, incoming, uploads)
+}
@@ -0,0 +1,197 @@
+package share
+
+import (
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxIndexedFileSize is the largest file whose text is indexed
+	maxIndexedFileSize = 1 << 20
+	// maxSearchResults is the most results a search returns
+	maxSearchResults = 50
+	snippetLength    = 120
+	// rebuildDelay is how long an invalidated index waits before rebuilding, to take in a burst of changes at once
+	rebuildDelay = time.Second
+)
+
+var (
+	htmlTags   = regexp.MustCompile(`(?s)<script.*?</script>|<style.*?</style>|<[^>]*>`)
+	whitespace = regexp.MustCompile(`\s+`)
+)
+
+// SearchResult is a file matching a search
+type SearchResult struct {
+	Username string `json:"username"`
+	// Path is the path of the file as requested from the user, share name included
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// Index is a searchable index of the file names, and optionally the text, of shared files
+type Index struct {
+	mu        sync.RWMutex
+	shares    Shares
+	indexText bool
+	entries   []indexEntry
+	pending   bool
+}
+
+type indexEntry struct {
+	share Share
+	path  string
+	name  string
+	text  string
+}
+
+// NewIndex creates an index of the shares, indexing the text of html and markdown files if indexText is set
+func NewIndex(shares Shares, indexText bool) *Index {
+	index := &Index{shares: shares, indexText: indexText}
+	index.Rebuild()
+	return index
+}
+
+// Rebuild indexes the shares again from scratch
+func (i *Index) Rebuild() {
+	entries := make([]indexEntry, 0)
+	for _, share := range i.shares {
+		share := share
+		files := share.FS()
+		err := fs.WalkDir(files, ".", func(name string, file fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(file.Name(), ".") && name != "." {
+				if file.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if file.IsDir() {
+				return nil
+			}
+			info, err := file.Info()
+			if err != nil {
+				return err
+			}
+			requestPath := name
+			if share.Name != DefaultName {
+				requestPath = share.Name + "/" + name
+			}
+			entry := indexEntry{share: share, path: requestPath, name: strings.ToLower(info.Name())}
+			if i.indexText && isText(name) && info.Size() <= maxIndexedFileSize {
+				entry.text = extractText(files, name)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			log.Error("error indexing share ", share.Name, ": ", err)
+		}
+	}
+	i.mu.Lock()
+	i.entries = entries
+	i.mu.Unlock()
+	log.Debugf("indexed %d shared files", len(entries))
+}
+
+// Invalidate schedules a rebuild of the index, unless one is already scheduled
+func (i *Index) Invalidate() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.pending {
+		return
+	}
+	i.pending = true
+	time.AfterFunc(rebuildDelay, func() {
+		i.mu.Lock()
+		i.pending = false
+		i.mu.Unlock()
+		i.Rebuild()
+	})
+}
+
+// Search returns the files requester may access whose path or text contains every word of the query.
+// Files matching on their path come first.
+func (i *Index) Search(query, requester string) []SearchResult {
+	words := strings.Fields(strings.ToLower(query))
+	results := make([]SearchResult, 0)
+	if len(words) == 0 {
+		return results
+	}
+	textResults := make([]SearchResult, 0)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, entry := range i.entries {
+		if !entry.share.Allows(requester) {
+			continue
+		}
+		result := SearchResult{Path: entry.path, Name: filepath.Base(entry.path)}
+		if containsAll(strings.ToLower(entry.path), words) {
+			results = append(results, result)
+		} else if entry.text != "" && containsAll(strings.ToLower(entry.text), words) {
+			result.Snippet = snippet(entry.text, words[0])
+			textResults = append(textResults, result)
+		}
+	}
+	sort.Slice(results, func(a, b int) bool { return results[a].Path < results[b].Path })
+	results = append(results, textResults...)
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+	return results
+}
+
+func containsAll(text string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// snippet returns the text around the first occurrence of word
+func snippet(text, word string) string {
+	index := strings.Index(strings.ToLower(text), word)
+	start := index - snippetLength/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+	}
+	return strings.ToValidUTF8(strings.TrimSpace(text[start:end]), "")
+}
+
+func isText(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm", ".md", ".markdown", ".txt":
+		return true
+	default:
+		return false
+	}
+}
+
+// extractText returns the text of a file, without html markup
+func extractText(files fs.FS, path string) string {
+	data, err := fs.ReadFile(files, path)
+	if err != nil {
+		return ""
+	}
+	text := string(data)
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".html" || ext == ".htm" {
+		text = htmlTags.ReplaceAllString(text, " ")
+	}
+	return strings.TrimSpace(whitespace.ReplaceAllString(text, " "))
+}
@@ -0,0 +1,78 @@
+package share
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IndexSearch(t *testing.T) {
+	shares := Shares{
+		{Name: DefaultName, Root: "test_data/root"},
+		{Name: "docs", Root: "test_data/docs", Allowed: []string{"alice"}},
+	}
+	index := NewIndex(shares, true)
+	namesOnly := NewIndex(shares, false)
+
+	cases := []struct {
+		Name      string
+		Index     *Index
+		Query     string
+		Requester string
+		Expected  []SearchResult
+	}{
+		{
+			Name:     "file name",
+			Index:    index,
+			Query:    "FILE",
+			Expected: []SearchResult{{Path: "file.txt", Name: "file.txt"}},
+		},
+		{
+			Name:     "path within named share",
+			Index:    index,
+			Query:    "notes release",
+			Expected: []SearchResult{{Path: "docs/notes/release.md", Name: "release.md"}},
+		},
+		{
+			Name:  "file text",
+			Index: index,
+			Query: "checklist",
+			Expected: []SearchResult{{
+				Path:    "docs/notes/release.md",
+				Name:    "release.md",
+				Snippet: "# Release notes The deployment checklist lives here.",
+			}},
+		},
+		{
+			Name:     "html markup is not indexed",
+			Index:    index,
+			Query:    "deployment",
+			Expected: []SearchResult{{Path: "docs/notes/release.md", Name: "release.md", Snippet: "# Release notes The deployment checklist lives here."}},
+		},
+		{
+			Name:     "text not indexed",
+			Index:    namesOnly,
+			Query:    "checklist",
+			Expected: []SearchResult{},
+		},
+		{
+			Name:      "share access is respected",
+			Index:     index,
+			Query:     "release",
+			Requester: "bob",
+			Expected:  []SearchResult{},
+		},
+		{
+			Name:     "empty query",
+			Index:    index,
+			Query:    " ",
+			Expected: []SearchResult{},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.Equal(t, testCase.Expected, testCase.Index.Search(testCase.Query, testCase.Requester))
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package share
+
+import (
+	"fmt"
+	"io/fs"
+	slashpath "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a file or folder in a listing of a folder
+type FileInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Folder   bool      `json:"folder"`
+	// Hash is the hex encoded sha256 of a file, set when known without reading the file
+	Hash string `json:"hash,omitempty"`
+}
+
+// List lists a folder on behalf of requester, by name. The top of the default share also lists the named shares
+// requester may access, as folders. Hidden files are left out, as they are from the index, and so is anything but
+// files and folders.
+func (s Shares) List(requester, path string) ([]FileInfo, error) {
+	list := make([]FileInfo, 0)
+	top := strings.Trim(path, "/") == ""
+	if top {
+		for _, share := range s {
+			if share.Name == DefaultName || !share.Allows(requester) {
+				continue
+			}
+			info, err := share.stat(".")
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, FileInfo{Name: share.Name, Modified: info.ModTime(), Folder: true})
+		}
+	}
+
+	share, rel, err := s.Resolve(path)
+	if top && (err != nil || !share.Allows(requester)) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !share.Allows(requester) {
+		return nil, fmt.Errorf("access to share %s denied", share.Name)
+	}
+	folder := fileName(rel)
+	info, err := share.stat(folder)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", path)
+	}
+	entries, err := fs.ReadDir(share.FS(), folder)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || (!entry.IsDir() && !entry.Type().IsRegular()) {
+			continue
+		}
+		// a named share hides what the default share has under its name
+		if top && s.isNamedShare(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		listed := FileInfo{Name: entry.Name(), Modified: info.ModTime(), Folder: entry.IsDir()}
+		if !listed.Folder {
+			listed.Size = info.Size()
+			listed.Hash = share.knownHash(slashpath.Join(folder, entry.Name()), info)
+		}
+		list = append(list, listed)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// isNamedShare reports whether name is the name of one of the named shares
+func (s Shares) isNamedShare(name string) bool {
+	for _, share := range s {
+		if share.Name != DefaultName && share.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package share
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_List(t *testing.T) {
+	modified := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	shares := Shares{
+		{Name: DefaultName, Files: fstest.MapFS{
+			"index.html":   {Data: []byte("home"), ModTime: modified},
+			"notes/a.md":   {Data: []byte("a"), ModTime: modified},
+			"notes/.draft": {Data: []byte("draft")},
+			"notes/old":    {Mode: fs.ModeDir | 0755, ModTime: modified},
+			".git/config":  {Data: []byte("config")},
+			"team/shadow":  {Data: []byte("shadowed")},
+		}},
+		{Name: "team", Allowed: []string{"bob"}, Files: fstest.MapFS{
+			".":       {Mode: fs.ModeDir | 0755, ModTime: modified},
+			"plan.md": {Data: []byte("plan"), ModTime: modified},
+		}},
+	}
+
+	cases := []struct {
+		Name          string
+		Requester     string
+		Path          string
+		Expected      []FileInfo
+		ExpectedError string
+	}{
+		{
+			Name:      "top",
+			Requester: "alice",
+			Expected: []FileInfo{
+				{Name: "index.html", Size: 4, Modified: modified},
+				{Name: "notes", Folder: true},
+			},
+		},
+		{
+			Name:      "top with named share",
+			Requester: "bob",
+			Path:      "/",
+			Expected: []FileInfo{
+				{Name: "index.html", Size: 4, Modified: modified},
+				{Name: "notes", Folder: true},
+				{Name: "team", Modified: modified, Folder: true},
+			},
+		},
+		{
+			Name:      "folder",
+			Requester: "alice",
+			Path:      "notes/",
+			Expected: []FileInfo{
+				{Name: "a.md", Size: 1, Modified: modified},
+				{Name: "old", Modified: modified, Folder: true},
+			},
+		},
+		{Name: "named share", Requester: "bob", Path: "team", Expected: []FileInfo{{Name: "plan.md", Size: 4, Modified: modified}}},
+		{Name: "denied", Requester: "alice", Path: "team", ExpectedError: "access to share team denied"},
+		{Name: "file", Requester: "alice", Path: "notes/a.md", ExpectedError: "notes/a.md is not a folder"},
+		{Name: "missing", Requester: "alice", Path: "drafts", ExpectedError: "open drafts: file does not exist"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			list, err := shares.List(testCase.Requester, testCase.Path)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, list)
+		})
+	}
+}
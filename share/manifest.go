@@ -0,0 +1,91 @@
+package share
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// ManifestEntry is a shared file as listed for mirroring
+type ManifestEntry struct {
+	// Path is the path of the file as requested from the user, share name included
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Hash is the hex encoded sha256 of the file contents
+	Hash string `json:"hash"`
+}
+
+// Manifest lists the files requester may access whose path is prefix or lies under it, with their hashes.
+// An empty prefix lists every file. Hidden files are left out, as they are from the index.
+func (s Shares) Manifest(requester, prefix string) ([]ManifestEntry, error) {
+	prefix = strings.Trim(prefix, "/")
+	entries := make([]ManifestEntry, 0)
+	for _, share := range s {
+		share := share
+		if !share.Allows(requester) {
+			continue
+		}
+		files := share.FS()
+		err := fs.WalkDir(files, ".", func(name string, file fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(file.Name(), ".") && name != "." {
+				if file.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			requestPath := name
+			if share.Name != DefaultName {
+				requestPath = share.Name + "/" + name
+			}
+			if name == "." {
+				requestPath = share.Name
+			}
+			if file.IsDir() {
+				// skip folders that neither lie under prefix nor hold it
+				if !underPrefix(requestPath, prefix) && !underPrefix(prefix, requestPath) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !underPrefix(requestPath, prefix) {
+				return nil
+			}
+			entry, err := manifestEntry(files, name)
+			if err != nil {
+				return err
+			}
+			entry.Path = requestPath
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// underPrefix reports whether path is prefix or lies in the folder prefix, every path lies under an empty prefix
+func underPrefix(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// manifestEntry hashes a file
+func manifestEntry(files fs.FS, name string) (ManifestEntry, error) {
+	file, err := files.Open(name)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{Size: size, Hash: hex.EncodeToString(hash.Sum(nil))}, nil
+}
@@ -0,0 +1,92 @@
+package share
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Manifest(t *testing.T) {
+	shares := Shares{
+		{Name: DefaultName, Files: fstest.MapFS{
+			"index.html":     {Data: []byte("home")},
+			"notes/a.md":     {Data: []byte("a")},
+			"notes/.draft":   {Data: []byte("draft")},
+			".git/config":    {Data: []byte("config")},
+			"notesmore/b.md": {Data: []byte("b")},
+		}},
+		{Name: "docs", Files: fstest.MapFS{"guide/intro.md": {Data: []byte("intro")}}},
+		{Name: "team", Allowed: []string{"bob"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+	}
+	hashes := map[string]string{
+		"home":  "4ea140588150773ce3aace786aeef7f4049ce100fa649c94fbbddb960f1da942",
+		"a":     "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+		"b":     "3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d",
+		"intro": "c432b372e0e30267e65e26a12a42c7957ab52e25dfe3c6d4b929213d88965e45",
+		"plan":  "64879f7d6b960a01909762d911a32d4582c20010c5641ee90278b644a9e3b525",
+	}
+	entry := func(path, contents string) ManifestEntry {
+		return ManifestEntry{Path: path, Size: int64(len(contents)), Hash: hashes[contents]}
+	}
+
+	cases := []struct {
+		Name      string
+		Requester string
+		Prefix    string
+		Expected  []ManifestEntry
+	}{
+		{
+			Name:      "everything",
+			Requester: "alice",
+			Expected: []ManifestEntry{
+				entry("index.html", "home"), entry("notes/a.md", "a"), entry("notesmore/b.md", "b"),
+				entry("docs/guide/intro.md", "intro"),
+			},
+		},
+		{
+			Name:      "folder",
+			Requester: "alice",
+			Prefix:    "notes/",
+			Expected:  []ManifestEntry{entry("notes/a.md", "a")},
+		},
+		{
+			Name:      "file",
+			Requester: "alice",
+			Prefix:    "notes/a.md",
+			Expected:  []ManifestEntry{entry("notes/a.md", "a")},
+		},
+		{
+			Name:      "named share",
+			Requester: "alice",
+			Prefix:    "docs",
+			Expected:  []ManifestEntry{entry("docs/guide/intro.md", "intro")},
+		},
+		{
+			Name:      "allowed share",
+			Requester: "bob",
+			Prefix:    "team",
+			Expected:  []ManifestEntry{entry("team/plan.md", "plan")},
+		},
+		{
+			Name:      "denied share",
+			Requester: "alice",
+			Prefix:    "team",
+			Expected:  []ManifestEntry{},
+		},
+		{
+			Name:      "nothing under prefix",
+			Requester: "alice",
+			Prefix:    "missing",
+			Expected:  []ManifestEntry{},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			entries, err := shares.Manifest(testCase.Requester, testCase.Prefix)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, entries)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package share
+
+import "time"
+
+// Peer describes another user on the network
+type Peer struct {
+	Username string
+	// PeerId is the ID of the users node, empty if not known
+	PeerId string
+	// Claimed is the username the node announced, Username is qualified by the end of PeerId
+	// and Conflict set when more than one node claims it
+	Claimed  string
+	Conflict bool
+	Online   bool
+	Shares   []string
+	// LastSeen is when the user last announced itself, zero if never
+	LastSeen time.Time
+	// Latency is the round trip time to the users node, zero if not measured
+	Latency time.Duration
+	// Capabilities are the features the users node announced, such as serving blocks
+	Capabilities []string
+}
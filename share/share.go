@@ -0,0 +1,359 @@
+package share
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mungujn/web-exp/markdown"
+)
+
+const (
+	// DefaultName is the name of the share served from LOCAL_ROOT_FOLDER
+	DefaultName = ""
+	// Self is the requester name used for reads made by the node itself
+	Self = ""
+
+	indexFile       = "index.html"
+	readWriteOption = "rw"
+	allowOption     = "allow="
+	markdownOption  = "md"
+)
+
+// Share is a local folder published to the network under a name
+type Share struct {
+	Name string
+	Root string
+	// ReadOnly shares can not be written to by anyone, other users may write to the others if they may read them
+	ReadOnly bool
+	// Allowed lists the usernames that may read the share, everyone may if empty
+	Allowed []string
+	// RenderMarkdown serves the shares .md files as html pages
+	RenderMarkdown bool
+	// Files holds the files of the share in place of the folder at Root when set, as tests do to share files from memory
+	Files fs.FS
+}
+
+// Shares are all the folders a node publishes
+type Shares []Share
+
+// Parse parses a comma separated list of share specs of the form
+// name=path[;rw][;md][;allow=user1|user2]. Shares are read only unless rw is given
+// and serve markdown files as html pages when md is given.
+func Parse(spec string) (Shares, error) {
+	shares := make(Shares, 0)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		options := strings.Split(item, ";")
+		nameAndRoot := strings.SplitN(options[0], "=", 2)
+		if len(nameAndRoot) != 2 || nameAndRoot[0] == "" || nameAndRoot[1] == "" {
+			return nil, fmt.Errorf("share %q is not of the form name=path", item)
+		}
+		if strings.Contains(nameAndRoot[0], "/") {
+			return nil, fmt.Errorf("share name %q must not contain /", nameAndRoot[0])
+		}
+		share := Share{Name: nameAndRoot[0], Root: nameAndRoot[1], ReadOnly: true}
+		for _, option := range options[1:] {
+			switch {
+			case option == readWriteOption:
+				share.ReadOnly = false
+			case option == markdownOption:
+				share.RenderMarkdown = true
+			case strings.HasPrefix(option, allowOption):
+				share.Allowed = strings.Split(strings.TrimPrefix(option, allowOption), "|")
+			default:
+				return nil, fmt.Errorf("share %s has unknown option %q", share.Name, option)
+			}
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// Allows reports whether requester may access the share
+func (s Share) Allows(requester string) bool {
+	if requester == Self || len(s.Allowed) == 0 {
+		return true
+	}
+	for _, allowed := range s.Allowed {
+		if allowed == requester {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the local path of a file in the share with its symbolic links resolved, refusing paths that lead
+// out of the shares root, through a symbolic link or otherwise. Files that do not exist yet are resolved as far as
+// the folders holding them exist.
+func (s Share) Path(rel string) (string, error) {
+	root, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		return "", err
+	}
+	path, err := resolvePath(filepath.Join(root, filepath.FromSlash(filepath.Clean("/"+rel))))
+	if err != nil {
+		return "", err
+	}
+	if !within(root, path) {
+		return "", &fs.PathError{Op: "open", Path: rel, Err: fs.ErrPermission}
+	}
+	return path, nil
+}
+
+// within reports whether path is folder or in it, either of them possibly relative
+func within(folder, path string) bool {
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(folder, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath resolves the symbolic links of path, of as much of it as exists
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return resolved, err
+	}
+	folder, name := filepath.Split(path)
+	folder = filepath.Clean(folder)
+	if folder == path {
+		return path, nil
+	}
+	if resolved, err = resolvePath(folder); err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, name), nil
+}
+
+// FS returns the files of the share, those of the folder at Root unless Files is set
+func (s Share) FS() fs.FS {
+	if s.Files != nil {
+		return s.Files
+	}
+	return folderFS{share: s}
+}
+
+// folderFS is the FS of the folder of a share, which opens files by their Path so that no file outside of the
+// folder is ever served through a symbolic link
+type folderFS struct {
+	share Share
+}
+
+func (f folderFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	path, err := f.share.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// fileName returns the name of a file in the FS of the share, never leaving the shares root
+func fileName(rel string) string {
+	name := strings.TrimPrefix(slashpath.Clean("/"+rel), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// stat describes a file of the share, name being a path as returned by fileName
+func (s Share) stat(name string) (fs.FileInfo, error) {
+	if s.Files != nil {
+		return fs.Stat(s.Files, name)
+	}
+	path, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+// readFile reads a file of the share, name being a path as returned by fileName
+func (s Share) readFile(name string) ([]byte, error) {
+	if s.Files != nil {
+		return fs.ReadFile(s.Files, name)
+	}
+	path, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// open opens a file of the share, name being a path as returned by fileName
+func (s Share) open(name string) (fs.File, error) {
+	if s.Files != nil {
+		return s.Files.Open(name)
+	}
+	path, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Names returns the names of all named shares
+func (s Shares) Names() []string {
+	names := make([]string, 0)
+	for _, share := range s {
+		if share.Name != DefaultName {
+			names = append(names, share.Name)
+		}
+	}
+	return names
+}
+
+// Resolve finds the share a request path addresses and the path within it.
+// A path whose first element names a share addresses that share,
+// any other path addresses the default share.
+func (s Shares) Resolve(path string) (Share, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	var fallback *Share
+	for i, share := range s {
+		if share.Name == DefaultName {
+			fallback = &s[i]
+			continue
+		}
+		if share.Name == parts[0] {
+			rel := ""
+			if len(parts) == 2 {
+				rel = parts[1]
+			}
+			return share, rel, nil
+		}
+	}
+	if fallback == nil {
+		return Share{}, "", fmt.Errorf("no share found for path %s", path)
+	}
+	return *fallback, path, nil
+}
+
+// ReadFile reads a file on behalf of requester. Folders are served by their
+// index.html, or failing that by their README.md rendered as a page.
+func (s Shares) ReadFile(requester, path string) ([]byte, error) {
+	file, err := s.resolveFile(requester, path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := file.share.readFile(file.name)
+	if err != nil || !file.render {
+		return data, err
+	}
+	return markdown.Render(data, markdown.Page{RequestPath: path, FilePath: file.path})
+}
+
+// FileVersion tells versions of a file apart by its size and modification time as stored, without reading it
+type FileVersion struct {
+	Size     int64
+	Modified time.Time
+}
+
+// Version returns the version of the file ReadFile reads for path on behalf of requester, so that what is made of
+// the file can be kept for as long as the file stays the same
+func (s Shares) Version(requester, path string) (FileVersion, error) {
+	file, err := s.resolveFile(requester, path)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	info, err := file.share.stat(file.name)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	return FileVersion{Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+// resolvedFile is the file of a share that ReadFile reads for a path
+type resolvedFile struct {
+	share Share
+	// name is the name of the file in the FS of the share, path the request path it is rendered as a page of
+	name   string
+	path   string
+	render bool
+}
+
+// resolveFile finds the file ReadFile reads for path on behalf of requester, the index.html or README.md of folders
+func (s Shares) resolveFile(requester, path string) (resolvedFile, error) {
+	share, rel, err := s.Resolve(path)
+	if err != nil {
+		return resolvedFile{}, err
+	}
+	if !share.Allows(requester) {
+		return resolvedFile{}, fmt.Errorf("access to share %s denied", share.Name)
+	}
+	file := resolvedFile{share: share, name: fileName(rel), path: path, render: share.RenderMarkdown && markdown.IsMarkdown(path)}
+	if info, err := share.stat(file.name); err == nil && info.IsDir() {
+		folder := file.name
+		file.name = slashpath.Join(folder, indexFile)
+		if _, err := share.stat(file.name); errors.Is(err, fs.ErrNotExist) {
+			file.name = slashpath.Join(folder, markdown.ReadmeFile)
+			file.path = strings.TrimSuffix(path, "/") + "/" + markdown.ReadmeFile
+			file.render = true
+		}
+	}
+	return file, nil
+}
+
+// ReadRange reads up to length bytes of a file from offset on behalf of requester, fewer at the end of the file.
+// Files are read as stored, folders are not served by their index and markdown is never rendered.
+func (s Shares) ReadRange(requester, path string, offset, length int64) ([]byte, error) {
+	share, rel, err := s.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if !share.Allows(requester) {
+		return nil, fmt.Errorf("access to share %s denied", share.Name)
+	}
+	file, err := share.open(fileName(rel))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a folder", path)
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("invalid length %d", length)
+	}
+	if offset < 0 || offset > info.Size() {
+		return nil, fmt.Errorf("offset %d is outside of %s, which has %d bytes", offset, path, info.Size())
+	}
+	if remaining := info.Size() - offset; length > remaining {
+		length = remaining
+	}
+	data := make([]byte, length)
+	read := 0
+	if readerAt, ok := file.(io.ReaderAt); ok {
+		read, err = readerAt.ReadAt(data, offset)
+	} else if _, err = io.CopyN(io.Discard, file, offset); err == nil {
+		read, err = io.ReadFull(file, data)
+	}
+	// the file may have shrunk since it was described
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return data[:read], nil
+}
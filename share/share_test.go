@@ -0,0 +1,269 @@
+package share
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Parse(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Spec          string
+		Expected      Shares
+		ExpectedError string
+	}{
+		{
+			Name:     "empty",
+			Spec:     "",
+			Expected: Shares{},
+		},
+		{
+			Name: "options",
+			Spec: "docs=/srv/docs, inbox=/srv/inbox;rw;allow=alice|bob",
+			Expected: Shares{
+				{Name: "docs", Root: "/srv/docs", ReadOnly: true},
+				{Name: "inbox", Root: "/srv/inbox", ReadOnly: false, Allowed: []string{"alice", "bob"}},
+			},
+		},
+		{
+			Name:          "missing path",
+			Spec:          "docs=",
+			ExpectedError: `share "docs=" is not of the form name=path`,
+		},
+		{
+			Name:          "nested name",
+			Spec:          "docs/old=/srv/docs",
+			ExpectedError: `share name "docs/old" must not contain /`,
+		},
+		{
+			Name:          "unknown option",
+			Spec:          "docs=/srv/docs;wx",
+			ExpectedError: `share docs has unknown option "wx"`,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			shares, err := Parse(testCase.Spec)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, shares)
+		})
+	}
+}
+
+func Test_ReadFile(t *testing.T) {
+	shares := Shares{
+		{Name: DefaultName, Root: "test_data/root"},
+		{Name: "docs", Root: "test_data/docs", Allowed: []string{"alice"}},
+		{Name: "wiki", Root: "test_data/wiki", RenderMarkdown: true},
+	}
+
+	cases := []struct {
+		Name          string
+		Requester     string
+		Path          string
+		Expected      string
+		Contains      []string
+		ExpectedError string
+	}{
+		{
+			Name:     "default share",
+			Path:     "file.txt",
+			Expected: "root file\n",
+		},
+		{
+			Name:      "named share index",
+			Requester: "alice",
+			Path:      "docs",
+			Expected:  "docs index\n",
+		},
+		{
+			Name:          "named share denied",
+			Requester:     "bob",
+			Path:          "docs/index.html",
+			ExpectedError: "access to share docs denied",
+		},
+		{
+			Name:     "markdown is served raw",
+			Path:     "docs/notes/release.md",
+			Expected: "# Release notes\n\nThe deployment checklist lives here.\n",
+		},
+		{
+			Name:     "markdown share renders pages",
+			Path:     "wiki/guide.md",
+			Contains: []string{"<title>Guide</title>", `<a href="./">wiki</a>`},
+		},
+		{
+			Name:     "readme is a folder index",
+			Path:     "wiki",
+			Contains: []string{"<title>Wiki</title>", `<a href="wiki/guide.md">guide</a>`},
+		},
+		{
+			Name:     "readme is a folder index with a trailing slash",
+			Path:     "wiki/",
+			Contains: []string{`<a href="guide.md">guide</a>`},
+		},
+		{
+			Name:          "path can not leave the share",
+			Path:          "../secret.txt",
+			ExpectedError: "open test_data/root/secret.txt: no such file or directory",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, err := shares.ReadFile(testCase.Requester, testCase.Path)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			if testCase.Contains != nil {
+				for _, expected := range testCase.Contains {
+					assert.Contains(t, string(data), expected)
+				}
+				return
+			}
+			assert.Equal(t, testCase.Expected, string(data))
+		})
+	}
+}
+
+func Test_Share_symlinks(t *testing.T) {
+	// prep
+	root, outside := t.TempDir(), t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "in.txt"), []byte("in"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600))
+	assert.NoError(t, os.Symlink(filepath.Join(root, "in.txt"), filepath.Join(root, "link.txt")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "out")))
+	assert.NoError(t, os.Symlink("../"+filepath.Base(outside), filepath.Join(root, "relative")))
+	shares := Shares{{Name: DefaultName, Root: root}}
+
+	cases := []struct {
+		Name          string
+		Path          string
+		Expected      string
+		ExpectedError string
+	}{
+		{Name: "file", Path: "in.txt", Expected: "in"},
+		{Name: "link inside the share", Path: "link.txt", Expected: "in"},
+		{Name: "link to a file outside", Path: "secret.txt", ExpectedError: "open secret.txt: permission denied"},
+		{Name: "link to a folder outside", Path: "out/secret.txt", ExpectedError: "open out/secret.txt: permission denied"},
+		{Name: "relative link", Path: "relative/secret.txt", ExpectedError: "open relative/secret.txt: permission denied"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, err := shares.ReadFile(Self, testCase.Path)
+			archiveData, archiveErr := fs.ReadFile(shares[0].FS(), testCase.Path)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				assert.True(t, errors.Is(archiveErr, fs.ErrPermission), "read through the FS: %v", archiveErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, archiveErr)
+			assert.Equal(t, testCase.Expected, string(data))
+			assert.Equal(t, testCase.Expected, string(archiveData))
+		})
+	}
+
+	// nor can files be written through a link
+	shares[0].ReadOnly = false
+	err := shares.WriteFile(Self, "out/new.txt", strings.NewReader("new"), 3)
+	assert.EqualError(t, err, "open out/new.txt: permission denied")
+	_, err = os.Stat(filepath.Join(outside, "new.txt"))
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func Test_ReadFile_files(t *testing.T) {
+	shares := Shares{
+		{Name: DefaultName, Files: fstest.MapFS{
+			"index.html":     {Data: []byte("home")},
+			"notes/a.txt":    {Data: []byte("note a")},
+			"wiki/README.md": {Data: []byte("# Wiki")},
+		}},
+	}
+
+	cases := []struct {
+		Name          string
+		Path          string
+		Expected      string
+		ExpectedError string
+	}{
+		{Name: "file", Path: "notes/a.txt", Expected: "note a"},
+		{Name: "root index", Path: "", Expected: "home"},
+		{Name: "path can not leave the share", Path: "../notes/a.txt", Expected: "note a"},
+		{Name: "missing file", Path: "notes/b.txt", ExpectedError: "open notes/b.txt: file does not exist"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, err := shares.ReadFile(Self, testCase.Path)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, string(data))
+		})
+	}
+
+	page, err := shares.ReadFile(Self, "wiki")
+	assert.NoError(t, err)
+	assert.Contains(t, string(page), `<h1 id="wiki">Wiki</h1>`)
+
+	results := NewIndex(shares, true).Search("note", Self)
+	assert.Equal(t, []SearchResult{{Path: "notes/a.txt", Name: "a.txt"}}, results)
+}
+
+func Test_ReadRange(t *testing.T) {
+	shares := Shares{
+		{Name: DefaultName, Files: fstest.MapFS{
+			"notes/a.txt":    {Data: []byte("0123456789")},
+			"wiki/README.md": {Data: []byte("# Wiki")},
+		}},
+		{Name: "team", Allowed: []string{"bob"}, Files: fstest.MapFS{"plan.md": {Data: []byte("# Plan")}}},
+	}
+
+	cases := []struct {
+		Name          string
+		Requester     string
+		Path          string
+		Offset        int64
+		Length        int64
+		Expected      string
+		ExpectedError string
+	}{
+		{Name: "start", Path: "notes/a.txt", Length: 4, Expected: "0123"},
+		{Name: "middle", Path: "notes/a.txt", Offset: 4, Length: 3, Expected: "456"},
+		{Name: "past the end", Path: "notes/a.txt", Offset: 8, Length: 4, Expected: "89"},
+		{Name: "at the end", Path: "notes/a.txt", Offset: 10, Length: 4, Expected: ""},
+		{Name: "outside", Path: "notes/a.txt", Offset: 11, Length: 4, ExpectedError: "offset 11 is outside of notes/a.txt, which has 10 bytes"},
+		{Name: "markdown as stored", Requester: "bob", Path: "team/plan.md", Length: 100, Expected: "# Plan"},
+		{Name: "folder", Path: "wiki", Length: 100, ExpectedError: "wiki is a folder"},
+		{Name: "denied", Requester: "alice", Path: "team/plan.md", Length: 100, ExpectedError: "access to share team denied"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			data, err := shares.ReadRange(testCase.Requester, testCase.Path, testCase.Offset, testCase.Length)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, string(data))
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package share
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mungujn/web-exp/markdown"
+)
+
+// sniffLength is how much of a file is looked at to detect its content type
+const sniffLength = 512
+
+// FileStat describes a file as it is served, without its contents
+type FileStat struct {
+	Size     int64       `json:"size"`
+	Modified time.Time   `json:"modified"`
+	Mode     fs.FileMode `json:"mode"`
+	// ContentType is detected from the contents, empty for folders
+	ContentType string `json:"content_type"`
+	// Hash is the hex encoded sha256 of the contents, empty for folders
+	Hash string `json:"hash"`
+}
+
+// Stat describes a file on behalf of requester. Markdown of a share that renders it is described as the page it is
+// served as. Folders are described as such, with neither size nor hash.
+func (s Shares) Stat(requester, path string) (FileStat, error) {
+	share, rel, err := s.Resolve(path)
+	if err != nil {
+		return FileStat{}, err
+	}
+	if !share.Allows(requester) {
+		return FileStat{}, fmt.Errorf("access to share %s denied", share.Name)
+	}
+	name := fileName(rel)
+	info, err := share.stat(name)
+	if err != nil {
+		return FileStat{}, err
+	}
+	stat := FileStat{Modified: info.ModTime(), Mode: info.Mode()}
+	if info.IsDir() {
+		return stat, nil
+	}
+	if !info.Mode().IsRegular() {
+		return FileStat{}, fmt.Errorf("%s is not a file", path)
+	}
+
+	// files on disk are only read again once they changed, pages rendered from markdown are made up every time
+	render := share.RenderMarkdown && markdown.IsMarkdown(path)
+	local, err := share.Path(name)
+	if err != nil && share.Files == nil {
+		return FileStat{}, err
+	}
+	key := describedKey{path: local, version: FileVersion{Size: info.Size(), Modified: info.ModTime()}}
+	cached := share.Files == nil && !render
+	if cached {
+		if known, ok := described.get(key); ok {
+			stat.Size, stat.ContentType, stat.Hash = known.Size, known.ContentType, known.Hash
+			return stat, nil
+		}
+	}
+
+	var contents io.Reader
+	if render {
+		data, err := share.readFile(name)
+		if err != nil {
+			return FileStat{}, err
+		}
+		page, err := markdown.Render(data, markdown.Page{RequestPath: path, FilePath: path})
+		if err != nil {
+			return FileStat{}, err
+		}
+		contents = bytes.NewReader(page)
+	} else {
+		file, err := share.open(name)
+		if err != nil {
+			return FileStat{}, err
+		}
+		defer file.Close()
+		contents = file
+	}
+	hash := sha256.New()
+	head := &bytes.Buffer{}
+	size, err := io.Copy(io.MultiWriter(hash, &limitedBuffer{buffer: head, limit: sniffLength}), contents)
+	if err != nil {
+		return FileStat{}, err
+	}
+	stat.Size = size
+	stat.ContentType = http.DetectContentType(head.Bytes())
+	stat.Hash = hex.EncodeToString(hash.Sum(nil))
+	if cached && size == key.version.Size {
+		described.put(key, stat)
+	}
+	return stat, nil
+}
+
+// knownHash returns the hash of a file of the share if Stat described the same version of it, empty otherwise
+func (s Share) knownHash(name string, info fs.FileInfo) string {
+	if s.Files != nil || (s.RenderMarkdown && markdown.IsMarkdown(name)) {
+		return ""
+	}
+	path, err := s.Path(name)
+	if err != nil {
+		return ""
+	}
+	stat, _ := described.get(describedKey{path: path, version: FileVersion{Size: info.Size(), Modified: info.ModTime()}})
+	return stat.Hash
+}
+
+// describedCacheSize is how many files Stat keeps the description of
+const describedCacheSize = 4096
+
+// described keeps what Stat reads files on disk for, their content type and hash, by path and version
+var described = &describedCache{order: list.New(), entries: make(map[describedKey]*list.Element)}
+
+// describedKey is a version of a file on disk, by its size and modification time
+type describedKey struct {
+	path    string
+	version FileVersion
+}
+
+// describedCache is a least recently used cache of file descriptions, bounded by their count
+type describedCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[describedKey]*list.Element
+}
+
+type describedEntry struct {
+	key  describedKey
+	stat FileStat
+}
+
+// get returns the description of a version of a file
+func (c *describedCache) get(key describedKey) (FileStat, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return FileStat{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*describedEntry).stat, true
+}
+
+// put keeps the description of a version of a file, dropping the least recently used once full
+func (c *describedCache) put(key describedKey, stat FileStat) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&describedEntry{key: key, stat: stat})
+	for c.order.Len() > describedCacheSize {
+		delete(c.entries, c.order.Remove(c.order.Back()).(*describedEntry).key)
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it and drops the rest
+type limitedBuffer struct {
+	buffer *bytes.Buffer
+	limit  int
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	if room := b.limit - b.buffer.Len(); room > 0 {
+		if len(data) < room {
+			room = len(data)
+		}
+		b.buffer.Write(data[:room])
+	}
+	return len(data), nil
+}
@@ -0,0 +1,154 @@
+package share
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Stat(t *testing.T) {
+	modified := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	shares := Shares{
+		{Name: DefaultName, Files: fstest.MapFS{
+			"hello.txt":  {Data: []byte("hello"), Mode: 0640, ModTime: modified},
+			"index.html": {Data: []byte("<html><body>home</body></html>"), Mode: 0644, ModTime: modified},
+			"notes":      {Mode: fs.ModeDir | 0755, ModTime: modified},
+			"notes/a.md": {Data: []byte("# a"), ModTime: modified},
+		}},
+		{Name: "team", Allowed: []string{"bob"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+	}
+
+	cases := []struct {
+		Name          string
+		Requester     string
+		Path          string
+		Expected      FileStat
+		ExpectedError string
+	}{
+		{
+			Name:      "file",
+			Requester: "alice",
+			Path:      "hello.txt",
+			Expected: FileStat{
+				Size:        5,
+				Modified:    modified,
+				Mode:        0640,
+				ContentType: "text/plain; charset=utf-8",
+				Hash:        "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			},
+		},
+		{
+			Name:      "page",
+			Requester: "alice",
+			Path:      "/index.html",
+			Expected: FileStat{
+				Size:        30,
+				Modified:    modified,
+				Mode:        0644,
+				ContentType: "text/html; charset=utf-8",
+				Hash:        "1b6a007ccaec0688a90b7f1b5f2c2afa55b915caec855d7c6aa8d70e770eb283",
+			},
+		},
+		{Name: "folder", Requester: "alice", Path: "notes/", Expected: FileStat{Modified: modified, Mode: fs.ModeDir | 0755}},
+		{Name: "denied", Requester: "alice", Path: "team/plan.md", ExpectedError: "access to share team denied"},
+		{Name: "missing", Requester: "alice", Path: "drafts.md", ExpectedError: "open drafts.md: file does not exist"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			stat, err := shares.Stat(testCase.Requester, testCase.Path)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, stat)
+		})
+	}
+}
+
+func Test_Stat_rendered(t *testing.T) {
+	shares := Shares{{Name: DefaultName, Root: "test_data/wiki", RenderMarkdown: true}}
+	page, err := shares.ReadFile("alice", "guide.md")
+	assert.NoError(t, err)
+
+	stat, err := shares.Stat("alice", "guide.md")
+	assert.NoError(t, err)
+	hash := sha256.Sum256(page)
+	assert.Equal(t, int64(len(page)), stat.Size)
+	assert.Equal(t, hex.EncodeToString(hash[:]), stat.Hash)
+	assert.Equal(t, "text/html; charset=utf-8", stat.ContentType)
+}
+
+func Test_Stat_cached(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "a.txt")
+	modified := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	write := func(contents string, modified time.Time) {
+		assert.NoError(t, os.WriteFile(file, []byte(contents), 0644))
+		assert.NoError(t, os.Chtimes(file, modified, modified))
+	}
+	shares := Shares{{Name: DefaultName, Root: root}}
+	hashOf := func(contents string) string {
+		hash := sha256.Sum256([]byte(contents))
+		return hex.EncodeToString(hash[:])
+	}
+
+	write("aaa", modified)
+	stat, err := shares.Stat("alice", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, hashOf("aaa"), stat.Hash)
+
+	// a file of the same size and modification time is taken to be the same, and not read again
+	write("bbb", modified)
+	stat, err = shares.Stat("alice", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, hashOf("aaa"), stat.Hash)
+
+	write("bbb", modified.Add(time.Second))
+	stat, err = shares.Stat("alice", "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, hashOf("bbb"), stat.Hash)
+}
+
+func Test_Version(t *testing.T) {
+	modified := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	shares := Shares{
+		{Name: DefaultName, Files: fstest.MapFS{
+			"hello.txt":       {Data: []byte("hello"), ModTime: modified},
+			"site/index.html": {Data: []byte("<html></html>"), ModTime: modified.Add(time.Hour)},
+			"notes/README.md": {Data: []byte("# notes"), ModTime: modified},
+		}},
+		{Name: "team", Allowed: []string{"bob"}, Files: fstest.MapFS{"plan.md": {Data: []byte("plan")}}},
+	}
+
+	cases := []struct {
+		Name          string
+		Path          string
+		Expected      FileVersion
+		ExpectedError string
+	}{
+		{Name: "file", Path: "hello.txt", Expected: FileVersion{Size: 5, Modified: modified}},
+		{Name: "folder served by its index", Path: "site/", Expected: FileVersion{Size: 13, Modified: modified.Add(time.Hour)}},
+		{Name: "folder served by its readme", Path: "notes", Expected: FileVersion{Size: 7, Modified: modified}},
+		{Name: "denied", Path: "team/plan.md", ExpectedError: "access to share team denied"},
+		{Name: "missing", Path: "drafts.md", ExpectedError: "open drafts.md: file does not exist"},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			version, err := shares.Version("alice", testCase.Path)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Expected, version)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package share
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchDebounce is how long changes are collected before they are reported,
+// editors often write a file several times when saving
+const watchDebounce = 250 * time.Millisecond
+
+// Change is a file that was created, modified or removed in a users share
+type Change struct {
+	Username string `json:"username"`
+	// Path is the path of the file as requested from the user, share name included
+	Path string `json:"path"`
+}
+
+// Watch reports changes to files in any of the shares until ctx is done.
+// The reported changes have no username set.
+func (s Shares) Watch(ctx context.Context, onChange func(Change)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, share := range s {
+		if share.Files != nil {
+			continue
+		}
+		if err = addRecursive(watcher, share.Root); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		pending := make(map[string]bool)
+		ticker := time.NewTicker(watchDebounce)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if strings.HasPrefix(filepath.Base(event.Name), ".") {
+					continue
+				}
+				if event.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						if err = addRecursive(watcher, event.Name); err != nil {
+							log.Error("error watching new folder: ", err)
+						}
+					}
+				}
+				if path, ok := s.requestPath(event.Name); ok {
+					pending[path] = true
+				}
+			case err := <-watcher.Errors:
+				log.Error("error watching shares: ", err)
+			case <-ticker.C:
+				for path := range pending {
+					onChange(Change{Path: path})
+				}
+				pending = make(map[string]bool)
+			}
+		}
+	}()
+	return nil
+}
+
+// requestPath returns the path a local file is requested by, using the share with the most specific root
+func (s Shares) requestPath(localPath string) (string, bool) {
+	var best *Share
+	var bestRel string
+	for i, share := range s {
+		if share.Files != nil {
+			continue
+		}
+		rel, err := filepath.Rel(share.Root, localPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if best == nil || len(share.Root) > len(best.Root) {
+			best, bestRel = &s[i], filepath.ToSlash(rel)
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	if best.Name == DefaultName {
+		return bestRel, true
+	}
+	return best.Name + "/" + bestRel, true
+}
+
+// addRecursive watches a folder and all folders below it
+func addRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,45 @@
+package share
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Watch(t *testing.T) {
+	root := t.TempDir()
+	docs := filepath.Join(root, "docs")
+	assert.NoError(t, os.Mkdir(docs, 0750))
+	shares := Shares{{Name: DefaultName, Root: root}, {Name: "docs", Root: docs}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan Change, 10)
+	assert.NoError(t, shares.Watch(ctx, func(change Change) { changes <- change }))
+
+	cases := []struct {
+		Name         string
+		File         string
+		ExpectedPath string
+	}{
+		{Name: "default share", File: filepath.Join(root, "index.html"), ExpectedPath: "index.html"},
+		{Name: "named share", File: filepath.Join(docs, "notes.md"), ExpectedPath: "docs/notes.md"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.NoError(t, ioutil.WriteFile(testCase.File, []byte("changed"), 0600))
+			select {
+			case change := <-changes:
+				assert.Equal(t, Change{Path: testCase.ExpectedPath}, change)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for change")
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package share
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsSharePath reports whether an upload names a file in a folder, which is written to a share,
+// rather than a plain file name, which is saved to the inbox
+func IsSharePath(name string) bool {
+	return strings.Contains(fileName(name), "/")
+}
+
+// writable finds the share a file is written to on behalf of requester and its name in the share,
+// or why requester may not write it
+func (s Shares) writable(requester, path string) (Share, string, error) {
+	share, rel, err := s.Resolve(path)
+	if err != nil {
+		return Share{}, "", err
+	}
+	if !share.Allows(requester) {
+		return Share{}, "", fmt.Errorf("access to share %s denied", share.Name)
+	}
+	if share.ReadOnly {
+		return Share{}, "", fmt.Errorf("%s is in a read only share", path)
+	}
+	if share.Files != nil || share.Root == "" {
+		return Share{}, "", fmt.Errorf("%s is in a share that is not a folder", path)
+	}
+	name := fileName(rel)
+	if name == "." {
+		return Share{}, "", errors.New("file name is empty")
+	}
+	return share, name, nil
+}
+
+// CheckWrite reports why requester may not write a file at path, if they may not
+func (s Shares) CheckWrite(requester, path string) error {
+	_, _, err := s.writable(requester, path)
+	return err
+}
+
+// WriteFile writes exactly size bytes of content to the file at path on behalf of requester, replacing any file
+// there and creating the folders holding it. Only shares that are not read only can be written to.
+func (s Shares) WriteFile(requester, path string, content io.Reader, size int64) error {
+	share, name, err := s.writable(requester, path)
+	if err != nil {
+		return err
+	}
+	dest, err := share.Path(name)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a folder", path)
+	}
+	folder := filepath.Dir(dest)
+	if err = os.MkdirAll(folder, 0750); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(folder, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	written, err := io.Copy(tmp, io.LimitReader(content, size))
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("upload incomplete, expected %d bytes, got %d", size, written)
+	}
+	return os.Rename(tmp.Name(), dest)
+}
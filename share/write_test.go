@@ -0,0 +1,79 @@
+package share
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IsSharePath(t *testing.T) {
+	assert.False(t, IsSharePath("notes.txt"))
+	assert.False(t, IsSharePath("/notes.txt/"))
+	assert.False(t, IsSharePath("../notes.txt"))
+	assert.True(t, IsSharePath("drop/notes.txt"))
+	assert.True(t, IsSharePath("/drop/old/notes.txt"))
+}
+
+func Test_WriteFile(t *testing.T) {
+	root, drop := t.TempDir(), t.TempDir()
+	shares := Shares{
+		{Name: DefaultName, Root: root, ReadOnly: true},
+		{Name: "drop", Root: drop},
+		{Name: "team", Root: drop, Allowed: []string{"alice"}},
+		{Name: "memory", Files: fstest.MapFS{}},
+	}
+	cases := []struct {
+		Name          string
+		Requester     string
+		Path          string
+		Content       string
+		Size          int64
+		ExpectedFile  string
+		ExpectedError string
+		// Refused writes are refused by CheckWrite too, before any content is read
+		Refused bool
+	}{
+		{Name: "writable share", Requester: "bob", Path: "drop/a.txt", Content: "a", Size: 1, ExpectedFile: "a.txt"},
+		{Name: "new folder", Requester: "bob", Path: "drop/old/b.txt", Content: "b", Size: 1, ExpectedFile: "old/b.txt"},
+		{Name: "outside the share", Requester: "bob", Path: "drop/../../c.txt", Content: "c", Size: 1, ExpectedFile: "c.txt"},
+		{Name: "allowed user", Requester: "alice", Path: "team/d.txt", Content: "d", Size: 1, ExpectedFile: "d.txt"},
+		{Name: "read only share", Requester: "bob", Path: "sub/e.txt", Content: "e", Size: 1, ExpectedError: "sub/e.txt is in a read only share", Refused: true},
+		{Name: "read only for the node too", Requester: Self, Path: "sub/e.txt", Content: "e", Size: 1, ExpectedError: "sub/e.txt is in a read only share", Refused: true},
+		{Name: "not allowed", Requester: "bob", Path: "team/f.txt", Content: "f", Size: 1, ExpectedError: "access to share team denied", Refused: true},
+		{Name: "not a folder", Requester: "bob", Path: "memory/g.txt", Content: "g", Size: 1, ExpectedError: "memory/g.txt is in a share that is not a folder", Refused: true},
+		{Name: "share itself", Requester: "bob", Path: "drop/", ExpectedError: "file name is empty", Refused: true},
+		{Name: "folder", Requester: "bob", Path: "drop/old", Content: "h", Size: 1, ExpectedError: "drop/old is a folder"},
+		{Name: "cut short", Requester: "bob", Path: "drop/i.txt", Content: "i", Size: 2, ExpectedError: "upload incomplete, expected 2 bytes, got 1"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := shares.WriteFile(testCase.Requester, testCase.Path, strings.NewReader(testCase.Content), testCase.Size)
+			if testCase.ExpectedError != "" {
+				assert.EqualError(t, err, testCase.ExpectedError)
+				if testCase.Refused {
+					assert.EqualError(t, shares.CheckWrite(testCase.Requester, testCase.Path), testCase.ExpectedError)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, shares.CheckWrite(testCase.Requester, testCase.Path))
+			data, err := ioutil.ReadFile(filepath.Join(drop, testCase.ExpectedFile))
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Content, string(data))
+		})
+	}
+
+	// files are replaced, and no temporary file is left behind
+	assert.NoError(t, shares.WriteFile("bob", "drop/a.txt", strings.NewReader("new"), 3))
+	data, err := ioutil.ReadFile(filepath.Join(drop, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	files, err := filepath.Glob(filepath.Join(drop, ".upload-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}